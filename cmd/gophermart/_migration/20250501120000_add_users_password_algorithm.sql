@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- алгоритм и параметры хеширования пароля
+-- plain - пароль сохранён в открытом виде до введения хеширования, будет перехеширован при входе
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_algorithm text NOT NULL DEFAULT 'plain';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_params text NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN IF EXISTS password_params;
+ALTER TABLE users DROP COLUMN IF EXISTS password_algorithm;
+-- +goose StatementEnd
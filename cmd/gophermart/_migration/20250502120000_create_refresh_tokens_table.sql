@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+-- таблица для refresh-токенов
+-- token_hash - sha256 от токена, сам токен не хранится
+-- family_id - общий идентификатор цепочки токенов, полученных ротацией
+-- used_at - время ротации, повторное предъявление использованного токена отзывает всю цепочку
+CREATE TABLE IF NOT EXISTS refresh_tokens
+(
+    token_hash text CONSTRAINT refresh_tokens_pkey PRIMARY KEY,
+    family_id text NOT NULL,
+    user_id int NOT NULL,
+    created_at timestamp NOT NULL,
+    expires_at timestamp NOT NULL,
+    used_at timestamp,
+    revoked_at timestamp
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE refresh_tokens;
+-- +goose StatementEnd
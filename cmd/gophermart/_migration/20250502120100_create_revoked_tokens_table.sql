@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- таблица для отозванных access-токенов (jti)
+-- запись нужна только до истечения срока действия токена
+CREATE TABLE IF NOT EXISTS revoked_tokens
+(
+    jti text CONSTRAINT revoked_tokens_pkey PRIMARY KEY,
+    expires_at timestamp NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE revoked_tokens;
+-- +goose StatementEnd
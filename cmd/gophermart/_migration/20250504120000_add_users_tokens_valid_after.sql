@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- access-токены, выпущенные раньше tokens_valid_after, недействительны (например, после смены пароля)
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tokens_valid_after timestamp;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN IF EXISTS tokens_valid_after;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+-- таблица для API-ключей пользователей
+-- key_hash - sha256 от ключа, сам ключ показывается пользователю один раз при создании
+-- prefix - начало ключа, чтобы пользователь мог отличить ключи в списке
+-- scopes - разрешения ключа через пробел, например "orders:write balance:read"
+CREATE TABLE IF NOT EXISTS api_keys
+(
+    id int GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    user_id int NOT NULL,
+    name text NOT NULL,
+    key_hash text CONSTRAINT api_keys_key_hash_ukey UNIQUE NOT NULL,
+    prefix text NOT NULL,
+    scopes text NOT NULL,
+    created_at timestamp NOT NULL,
+    last_used_at timestamp,
+    revoked_at timestamp
+);
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE api_keys;
+-- +goose StatementEnd
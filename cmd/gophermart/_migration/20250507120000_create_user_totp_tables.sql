@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+-- секрет TOTP пользователя, enabled = false до подтверждения первым кодом
+-- last_used_step - последний принятый временной шаг, чтобы код нельзя было использовать повторно
+CREATE TABLE IF NOT EXISTS user_totp
+(
+    user_id int CONSTRAINT user_totp_pkey PRIMARY KEY,
+    secret text NOT NULL,
+    enabled boolean NOT NULL DEFAULT false,
+    last_used_step bigint NOT NULL DEFAULT 0,
+    created_at timestamp NOT NULL
+);
+-- одноразовые коды восстановления, хранится sha256 от кода
+CREATE TABLE IF NOT EXISTS totp_recovery_codes
+(
+    user_id int NOT NULL,
+    code_hash text NOT NULL,
+    used_at timestamp,
+    CONSTRAINT totp_recovery_codes_pkey PRIMARY KEY (user_id, code_hash)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE totp_recovery_codes;
+DROP TABLE user_totp;
+-- +goose StatementEnd
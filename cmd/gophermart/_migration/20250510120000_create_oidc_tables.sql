@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+-- привязка учётных записей внешнего OpenID Connect провайдера к пользователям
+-- reauthenticated_at - последнее неиспользованное повторное подтверждение входа у провайдера
+CREATE TABLE IF NOT EXISTS user_identities
+(
+    issuer text NOT NULL,
+    subject text NOT NULL,
+    user_id int NOT NULL,
+    created_at timestamp NOT NULL,
+    reauthenticated_at timestamptz,
+    CONSTRAINT user_identities_pkey PRIMARY KEY (issuer, subject)
+);
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
+-- незавершённые входы через провайдера
+-- state_hash - sha256 от параметра state, code_verifier - секрет PKCE
+-- link_user_id - пользователь, к которому привязывается внешняя учётная запись, NULL при входе
+-- reauth - пользователь link_user_id повторно подтверждает вход, а не привязывает учётную запись
+CREATE TABLE IF NOT EXISTS oidc_states
+(
+    state_hash text CONSTRAINT oidc_states_pkey PRIMARY KEY,
+    nonce text NOT NULL,
+    code_verifier text NOT NULL,
+    link_user_id int,
+    reauth boolean NOT NULL DEFAULT false,
+    expires_at timestamp NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE oidc_states;
+DROP TABLE user_identities;
+-- +goose StatementEnd
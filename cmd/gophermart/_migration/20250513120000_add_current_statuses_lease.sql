@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- аренда заказа экземпляром сервиса на время опроса системы начислений
+-- locked_by - идентификатор экземпляра, lease_until - после этого времени заказ может забрать другой экземпляр
+ALTER TABLE current_statuses ADD COLUMN IF NOT EXISTS locked_by text;
+ALTER TABLE current_statuses ADD COLUMN IF NOT EXISTS lease_until timestamp;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE current_statuses DROP COLUMN lease_until;
+ALTER TABLE current_statuses DROP COLUMN locked_by;
+-- +goose StatementEnd
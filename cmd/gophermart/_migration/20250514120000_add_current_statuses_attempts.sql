@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- attempts - сколько раз заказ опрошен в системе начислений без окончательного статуса
+-- next_attempt_at - раньше этого времени заказ не опрашивается, NULL - сразу
+ALTER TABLE current_statuses ADD COLUMN IF NOT EXISTS attempts int NOT NULL DEFAULT 0;
+ALTER TABLE current_statuses ADD COLUMN IF NOT EXISTS next_attempt_at timestamp;
+CREATE INDEX IF NOT EXISTS current_statuses_next_attempt_at_idx ON current_statuses (next_attempt_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS current_statuses_next_attempt_at_idx;
+ALTER TABLE current_statuses DROP COLUMN next_attempt_at;
+ALTER TABLE current_statuses DROP COLUMN attempts;
+-- +goose StatementEnd
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strings"
 	"sync"
 	"syscall"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/nasik90/gophermart/cmd/gophermart/settings"
+	"github.com/nasik90/gophermart/internal/app/accrual"
 	"github.com/nasik90/gophermart/internal/app/handler"
+	"github.com/nasik90/gophermart/internal/app/hasher"
 	"github.com/nasik90/gophermart/internal/app/logger"
+	middleware "github.com/nasik90/gophermart/internal/app/middlewares"
+	"github.com/nasik90/gophermart/internal/app/notifier"
+	"github.com/nasik90/gophermart/internal/app/oidc"
+	"github.com/nasik90/gophermart/internal/app/ordervalidator"
 	"github.com/nasik90/gophermart/internal/app/server"
 	"github.com/nasik90/gophermart/internal/app/service"
 	"github.com/nasik90/gophermart/internal/app/storage/pg"
@@ -34,12 +43,123 @@ func main() {
 	if err != nil {
 		logger.Log.Fatal("create pg repo", zap.String("DatabaseDSN", options.DatabaseURI), zap.String("error", err.Error()))
 	}
-	s := service.NewService(repo, options.CheckOrderID)
-	h := handler.NewHandler(s)
+	passwordHasher, err := hasher.New(options.PasswordHashAlgorithm, options.BcryptCost, hasher.Argon2Params{
+		Time:    uint32(options.Argon2Time),
+		Memory:  uint32(options.Argon2Memory),
+		Threads: uint8(options.Argon2Threads),
+		KeyLen:  hasher.DefaultArgon2Params().KeyLen,
+		SaltLen: hasher.DefaultArgon2Params().SaltLen,
+	})
+	if err != nil {
+		logger.Log.Fatal("create password hasher", zap.String("algorithm", options.PasswordHashAlgorithm), zap.String("error", err.Error()))
+	}
+	credentials, err := credentialsPolicy(options)
+	if err != nil {
+		logger.Log.Fatal("load credentials policy", zap.String("error", err.Error()))
+	}
+	orderValidator, err := orderValidatorChain(options)
+	if err != nil {
+		logger.Log.Fatal("parse order validators", zap.String("error", err.Error()))
+	}
+	var userNotifier service.Notifier = notifier.NewLog()
+	if options.NotificationsFile != "" {
+		userNotifier = notifier.NewFile(options.NotificationsFile)
+	}
+	accrualClient, err := accrual.NewClient(accrual.Config{
+		Address:        options.AccrualServerAddress,
+		Timeout:        options.AccrualTimeout,
+		ConnectTimeout: options.AccrualConnectTimeout,
+		CAFile:         options.AccrualCAFile,
+		CertFile:       options.AccrualCertFile,
+		KeyFile:        options.AccrualKeyFile,
+	})
+	if err != nil {
+		logger.Log.Fatal("create accrual client", zap.String("address", options.AccrualServerAddress), zap.String("error", err.Error()))
+	}
+	var identityProvider service.IdentityProvider
+	if options.OIDCIssuer != "" {
+		provider, err := oidc.NewProvider(context.Background(), oidc.Config{
+			Issuer:       options.OIDCIssuer,
+			ClientID:     options.OIDCClientID,
+			ClientSecret: options.OIDCClientSecret,
+			RedirectURL:  options.OIDCRedirectURL,
+			Scopes:       strings.Fields(options.OIDCScopes),
+		})
+		if err != nil {
+			logger.Log.Fatal("create oidc provider", zap.String("issuer", options.OIDCIssuer), zap.String("error", err.Error()))
+		}
+		identityProvider = provider
+	}
+	s := service.NewService(repo, passwordHasher, userNotifier, service.Config{
+		OrderValidator:  orderValidator,
+		RefreshTokenExp: options.RefreshTokenExp,
+		ResetTokenExp:   options.ResetTokenExp,
+		Lockout: service.LockoutPolicy{
+			LoginMaxFailures: options.LoginMaxFailures,
+			IPMaxFailures:    options.IPMaxFailures,
+			BaseDelay:        options.LockoutBaseDelay,
+			MaxDelay:         options.LockoutMaxDelay,
+			ResetAfter:       options.LockoutResetAfter,
+		},
+		ResetLimit: service.PasswordResetLimit{
+			LoginMaxRequests: options.ResetLoginMaxRequests,
+			IPMaxRequests:    options.ResetIPMaxRequests,
+			Window:           options.ResetWindow,
+		},
+		Credentials:          credentials,
+		WithdrawStepUpAmount: options.WithdrawStepUpAmount,
+		IdempotencyKeyTTL:    options.IdempotencyKeyTTL,
+		AccrualWorkers:       options.AccrualWorkers,
+		AccrualRateLimit:     options.AccrualRateLimit,
+		AccrualBatchSize:     options.AccrualBatchSize,
+		AccrualLease:         options.AccrualLease,
+		AccrualRetryBase:     options.AccrualRetryBase,
+		AccrualRetryMax:      options.AccrualRetryMax,
+		AccrualMaxAttempts:   options.AccrualMaxAttempts,
+		AccrualMaxAge:        options.AccrualMaxAge,
+		InstanceID:           options.InstanceID,
+		AccrualClient:        accrualClient,
+		IdentityProvider:     identityProvider,
+	})
+	if options.AdminLogin != "" {
+		if err := s.BootstrapAdmin(context.Background(), options.AdminLogin, options.AdminPassword); err != nil {
+			logger.Log.Fatal("bootstrap admin", zap.String("login", options.AdminLogin), zap.String("error", err.Error()))
+		}
+	}
+	keys, err := loadKeySet(options)
+	if err != nil {
+		logger.Log.Fatal("load jwt keys", zap.String("error", err.Error()))
+	}
+	auth := middleware.NewAuthenticator(keys, options.TokenExp, s, s, s)
+	cookieSameSite, err := middleware.ParseSameSite(options.CookieSameSite)
+	if err != nil {
+		logger.Log.Fatal("parse cookie options", zap.String("error", err.Error()))
+	}
+	err = auth.SetCookieOptions(middleware.CookieOptions{
+		Path:            options.CookiePath,
+		Domain:          options.CookieDomain,
+		HttpOnly:        options.CookieHTTPOnly,
+		Secure:          options.CookieSecure,
+		SameSite:        cookieSameSite,
+		Persistent:      options.CookiePersistent,
+		RefreshTokenExp: options.RefreshTokenExp,
+	})
+	if err != nil {
+		logger.Log.Fatal("set cookie options", zap.String("error", err.Error()))
+	}
+	h := handler.NewHandler(s, auth)
 	stopCh := make(chan bool)
-	go s.HandleOrderQueue(options.AccrualServerAddress, stopCh)
+	queueDone := make(chan struct{})
+	go func() {
+		defer close(queueDone)
+		s.HandleOrderQueue(stopCh)
+	}()
 
-	server := server.NewServer(h, options.ServerAddress)
+	trustedProxies, err := middleware.NewTrustedProxies(strings.Split(options.TrustedProxies, ","))
+	if err != nil {
+		logger.Log.Fatal("parse trusted proxies", zap.String("error", err.Error()))
+	}
+	server := server.NewServer(h, auth, middleware.NewIdempotency(s), trustedProxies, options.ServerAddress)
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	var wg sync.WaitGroup
@@ -49,7 +169,9 @@ func main() {
 		<-sigs
 
 		logger.Log.Info("stopping gourutine")
-		stopCh <- true
+		// воркеры дорабатывают начатые запросы до закрытия хранилища
+		close(stopCh)
+		<-queueDone
 
 		logger.Log.Info("closing the server")
 		if err := server.StopServer(); err != nil {
@@ -72,3 +194,57 @@ func main() {
 	wg.Wait()
 	logger.Log.Info("closed gracefuly")
 }
+
+func loadKeySet(options *settings.Options) (*middleware.KeySet, error) {
+	if options.JWTKeysFile != "" {
+		return middleware.LoadKeySet(options.JWTKeysFile)
+	}
+	if options.JWTSecret != "" {
+		return middleware.NewHMACKeySet("default", []byte(options.JWTSecret))
+	}
+	logger.Log.Warn("jwt keys are not configured, using random key: tokens will not survive restart")
+	return middleware.NewRandomKeySet()
+}
+
+// orderValidatorChain собирает правила проверки номеров заказов. Если правила не заданы,
+// номер должен состоять из цифр, а алгоритм Луна включается флагом -c.
+func orderValidatorChain(options *settings.Options) (ordervalidator.Chain, error) {
+	spec := options.OrderValidators
+	if spec == "" {
+		spec = `regex=^[0-9]+$;length=1-64`
+		if options.CheckOrderID {
+			spec += ";" + ordervalidator.RuleLuhn
+		}
+	}
+	return ordervalidator.Parse(spec)
+}
+
+func credentialsPolicy(options *settings.Options) (service.CredentialsPolicy, error) {
+	policy := service.CredentialsPolicy{
+		LoginMinLength:     options.LoginMinLength,
+		LoginMaxLength:     options.LoginMaxLength,
+		PasswordMinLength:  options.PasswordMinLength,
+		PasswordMaxLength:  options.PasswordMaxLength,
+		PasswordMinClasses: options.PasswordMinClasses,
+	}
+	// более длинный пароль bcrypt отвергает при хешировании, и клиент получил бы 500 вместо 400
+	if options.PasswordHashAlgorithm == hasher.AlgorithmBcrypt &&
+		(policy.PasswordMaxLength <= 0 || policy.PasswordMaxLength > hasher.BcryptMaxPasswordBytes) {
+		policy.PasswordMaxLength = hasher.BcryptMaxPasswordBytes
+	}
+	if options.LoginPattern != "" {
+		loginPattern, err := regexp.Compile(options.LoginPattern)
+		if err != nil {
+			return policy, err
+		}
+		policy.LoginPattern = loginPattern
+	}
+	if options.BannedPasswordsFile != "" {
+		bannedPasswords, err := service.LoadBannedPasswords(options.BannedPasswordsFile)
+		if err != nil {
+			return policy, err
+		}
+		policy.BannedPasswords = bannedPasswords
+	}
+	return policy, nil
+}
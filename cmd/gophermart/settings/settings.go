@@ -4,17 +4,75 @@ import (
 	"flag"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/nasik90/gophermart/internal/app/logger"
 	"go.uber.org/zap"
 )
 
 type Options struct {
-	ServerAddress        string
-	LogLevel             string
-	DatabaseURI          string
-	AccrualServerAddress string
-	CheckOrderID         bool
+	ServerAddress         string
+	LogLevel              string
+	DatabaseURI           string
+	AccrualServerAddress  string
+	AccrualTimeout        time.Duration
+	AccrualConnectTimeout time.Duration
+	AccrualCAFile         string
+	AccrualCertFile       string
+	AccrualKeyFile        string
+	CheckOrderID          bool
+	OrderValidators       string
+	IdempotencyKeyTTL     time.Duration
+	AccrualWorkers        int
+	AccrualRateLimit      float64
+	AccrualBatchSize      int
+	AccrualLease          time.Duration
+	AccrualRetryBase      time.Duration
+	AccrualRetryMax       time.Duration
+	AccrualMaxAttempts    int
+	AccrualMaxAge         time.Duration
+	InstanceID            string
+	PasswordHashAlgorithm string
+	BcryptCost            int
+	Argon2Time            int
+	Argon2Memory          int
+	Argon2Threads         int
+	JWTKeysFile           string
+	JWTSecret             string
+	TokenExp              time.Duration
+	RefreshTokenExp       time.Duration
+	LoginMaxFailures      int
+	TrustedProxies        string
+	IPMaxFailures         int
+	LockoutBaseDelay      time.Duration
+	LockoutMaxDelay       time.Duration
+	LockoutResetAfter     time.Duration
+	AdminLogin            string
+	AdminPassword         string
+	ResetTokenExp         time.Duration
+	ResetLoginMaxRequests int
+	ResetIPMaxRequests    int
+	ResetWindow           time.Duration
+	NotificationsFile     string
+	LoginMinLength        int
+	LoginMaxLength        int
+	LoginPattern          string
+	PasswordMinLength     int
+	PasswordMaxLength     int
+	PasswordMinClasses    int
+	BannedPasswordsFile   string
+	WithdrawStepUpAmount  float64
+	OIDCIssuer            string
+	OIDCClientID          string
+	OIDCClientSecret      string
+	OIDCRedirectURL       string
+	OIDCScopes            string
+	CookiePath            string
+	CookieDomain          string
+	CookieHTTPOnly        bool
+	CookieSecure          bool
+	CookieSameSite        string
+	CookiePersistent      bool
 }
 
 func ParseFlags(o *Options) {
@@ -23,7 +81,60 @@ func ParseFlags(o *Options) {
 	flag.StringVar(&o.DatabaseURI, "d", "host=localhost user=postgres password=xxxx dbname=gophermart sslmode=disable", "database connection string")
 	//flag.StringVar(&o.DatabaseURI, "d", "", "database connection string")
 	flag.StringVar(&o.AccrualServerAddress, "r", "localhost:8181", "accrual address and port to run server")
+	flag.DurationVar(&o.AccrualTimeout, "accrual-timeout", 10*time.Second, "accrual system request timeout")
+	flag.DurationVar(&o.AccrualConnectTimeout, "accrual-connect-timeout", 5*time.Second, "accrual system connect and TLS handshake timeout")
+	flag.StringVar(&o.AccrualCAFile, "accrual-ca-file", "", "PEM file with CA certificates trusted for accrual system in addition to system ones")
+	flag.StringVar(&o.AccrualCertFile, "accrual-cert-file", "", "PEM client certificate for mutual TLS with accrual system")
+	flag.StringVar(&o.AccrualKeyFile, "accrual-key-file", "", "PEM client key for mutual TLS with accrual system")
 	flag.BoolVar(&o.CheckOrderID, "c", true, "checking order ID by luhn algorithm is required")
+	flag.IntVar(&o.AccrualWorkers, "accrual-workers", 4, "number of concurrent accrual system requests")
+	flag.Float64Var(&o.AccrualRateLimit, "accrual-rate-limit", 10, "max accrual system requests per second shared by all workers, 0 disables")
+	flag.IntVar(&o.AccrualBatchSize, "accrual-batch-size", 100, "orders claimed for accrual polling at once")
+	flag.DurationVar(&o.AccrualLease, "accrual-lease", time.Minute, "order claim lease, after it expires another instance may poll the order")
+	flag.DurationVar(&o.AccrualRetryBase, "accrual-retry-base", time.Second, "pause before the first repeated poll of an unfinished order, doubled on each attempt")
+	flag.DurationVar(&o.AccrualRetryMax, "accrual-retry-max", 10*time.Minute, "max pause between polls of an unfinished order")
+	flag.IntVar(&o.AccrualMaxAttempts, "accrual-max-attempts", 100, "polls answered 'not registered' or unreadable before an order is marked STUCK, 0 disables")
+	flag.DurationVar(&o.AccrualMaxAge, "accrual-max-age", 72*time.Hour, "how long an order is polled before a failed poll marks it STUCK, 0 disables")
+	flag.StringVar(&o.InstanceID, "instance-id", "", "instance id used for order claims, generated if empty")
+	flag.DurationVar(&o.IdempotencyKeyTTL, "idempotency-key-ttl", 24*time.Hour, "how long responses to requests with Idempotency-Key are kept")
+	flag.StringVar(&o.OrderValidators, "order-validators", "", "order number rules separated by ';': regex=<re>, length=<min>-<max>, prefix=<p1>,<p2>, luhn; digits only with luhn per -c if empty")
+	flag.StringVar(&o.PasswordHashAlgorithm, "password-hash", "bcrypt", "password hash algorithm: bcrypt or argon2id")
+	flag.IntVar(&o.BcryptCost, "bcrypt-cost", 10, "bcrypt cost")
+	flag.IntVar(&o.Argon2Time, "argon2-time", 1, "argon2id iterations")
+	flag.IntVar(&o.Argon2Memory, "argon2-memory", 64*1024, "argon2id memory in KiB")
+	flag.IntVar(&o.Argon2Threads, "argon2-threads", 4, "argon2id parallelism")
+	flag.StringVar(&o.JWTKeysFile, "jwt-keys", "", "path to JSON file with JWT signing keys")
+	flag.DurationVar(&o.TokenExp, "token-exp", 15*time.Minute, "access token lifetime")
+	flag.DurationVar(&o.RefreshTokenExp, "refresh-token-exp", 30*24*time.Hour, "refresh token lifetime")
+	flag.IntVar(&o.LoginMaxFailures, "login-max-failures", 5, "failed logins per login before lockout, 0 disables")
+	flag.IntVar(&o.IPMaxFailures, "ip-max-failures", 20, "failed logins per IP before lockout, 0 disables; behind a reverse proxy set -trusted-proxies or disable it")
+	flag.StringVar(&o.TrustedProxies, "trusted-proxies", "", "comma separated proxy addresses or CIDRs whose X-Forwarded-For is trusted for the client IP")
+	flag.DurationVar(&o.LockoutBaseDelay, "lockout-base-delay", 30*time.Second, "first lockout duration")
+	flag.DurationVar(&o.LockoutMaxDelay, "lockout-max-delay", time.Hour, "max lockout duration")
+	flag.DurationVar(&o.LockoutResetAfter, "lockout-reset-after", 24*time.Hour, "failed logins counter reset period")
+	flag.DurationVar(&o.ResetTokenExp, "reset-token-exp", time.Hour, "password reset token lifetime")
+	flag.IntVar(&o.ResetLoginMaxRequests, "reset-login-max-requests", 3, "password reset requests per login before they are limited, 0 disables")
+	flag.IntVar(&o.ResetIPMaxRequests, "reset-ip-max-requests", 20, "password reset requests per IP before they are limited, 0 disables")
+	flag.DurationVar(&o.ResetWindow, "reset-window", time.Hour, "how long password reset requests stay limited")
+	flag.StringVar(&o.NotificationsFile, "notifications-file", "", "file to write user notifications to, log is used if empty")
+	flag.IntVar(&o.LoginMinLength, "login-min-length", 3, "min login length")
+	flag.IntVar(&o.LoginMaxLength, "login-max-length", 64, "max login length")
+	flag.StringVar(&o.LoginPattern, "login-pattern", `^[A-Za-z0-9._@-]+$`, "regexp allowed logins must match")
+	flag.IntVar(&o.PasswordMinLength, "password-min-length", 8, "min password length")
+	flag.IntVar(&o.PasswordMaxLength, "password-max-length", 72, "max password length in bytes, bcrypt accepts at most 72")
+	flag.IntVar(&o.PasswordMinClasses, "password-min-classes", 1, "min number of character classes in password")
+	flag.StringVar(&o.BannedPasswordsFile, "banned-passwords", "", "file with banned passwords, one per line")
+	flag.Float64Var(&o.WithdrawStepUpAmount, "withdraw-step-up-amount", 0, "withdrawals above this sum require a TOTP code, 0 disables")
+	flag.StringVar(&o.OIDCIssuer, "oidc-issuer", "", "OpenID Connect issuer URL, empty disables SSO login")
+	flag.StringVar(&o.OIDCClientID, "oidc-client-id", "", "OpenID Connect client id")
+	flag.StringVar(&o.OIDCRedirectURL, "oidc-redirect-url", "", "OpenID Connect redirect URL, e.g. https://host/api/user/oidc/callback")
+	flag.StringVar(&o.OIDCScopes, "oidc-scopes", "openid profile email", "OpenID Connect scopes separated by spaces")
+	flag.StringVar(&o.CookiePath, "cookie-path", "/", "auth cookie Path attribute")
+	flag.StringVar(&o.CookieDomain, "cookie-domain", "", "auth cookie Domain attribute")
+	flag.BoolVar(&o.CookieHTTPOnly, "cookie-http-only", true, "set HttpOnly on auth cookie")
+	flag.BoolVar(&o.CookieSecure, "cookie-secure", false, "set Secure on auth cookies, enable when served over HTTPS")
+	flag.StringVar(&o.CookieSameSite, "cookie-same-site", "lax", "auth cookies SameSite attribute: lax, strict, none or default")
+	flag.BoolVar(&o.CookiePersistent, "cookie-persistent", true, "set Expires on auth cookies, otherwise they are session cookies")
 	flag.Parse()
 
 	if serverAddress := os.Getenv("RUN_ADDRESS"); serverAddress != "" {
@@ -38,12 +149,143 @@ func ParseFlags(o *Options) {
 	if accrualServerAddress := os.Getenv("ACCRUAL_SYSTEM_ADDRESS"); accrualServerAddress != "" {
 		o.AccrualServerAddress = accrualServerAddress
 	}
-	if checkOrderID := os.Getenv("CHECK_ORDERID"); checkOrderID != "" {
-		val, err := strconv.ParseBool(checkOrderID)
+	durationFromEnv("ACCRUAL_TIMEOUT", &o.AccrualTimeout)
+	durationFromEnv("ACCRUAL_CONNECT_TIMEOUT", &o.AccrualConnectTimeout)
+	if accrualCAFile := os.Getenv("ACCRUAL_CA_FILE"); accrualCAFile != "" {
+		o.AccrualCAFile = accrualCAFile
+	}
+	if accrualCertFile := os.Getenv("ACCRUAL_CERT_FILE"); accrualCertFile != "" {
+		o.AccrualCertFile = accrualCertFile
+	}
+	if accrualKeyFile := os.Getenv("ACCRUAL_KEY_FILE"); accrualKeyFile != "" {
+		o.AccrualKeyFile = accrualKeyFile
+	}
+	boolFromEnv("CHECK_ORDERID", &o.CheckOrderID)
+	if orderValidators := os.Getenv("ORDER_VALIDATORS"); orderValidators != "" {
+		o.OrderValidators = orderValidators
+	}
+	durationFromEnv("IDEMPOTENCY_KEY_TTL", &o.IdempotencyKeyTTL)
+	intFromEnv("ACCRUAL_WORKERS", &o.AccrualWorkers)
+	floatFromEnv("ACCRUAL_RATE_LIMIT", &o.AccrualRateLimit)
+	intFromEnv("ACCRUAL_BATCH_SIZE", &o.AccrualBatchSize)
+	durationFromEnv("ACCRUAL_LEASE", &o.AccrualLease)
+	durationFromEnv("ACCRUAL_RETRY_BASE", &o.AccrualRetryBase)
+	durationFromEnv("ACCRUAL_RETRY_MAX", &o.AccrualRetryMax)
+	intFromEnv("ACCRUAL_MAX_ATTEMPTS", &o.AccrualMaxAttempts)
+	durationFromEnv("ACCRUAL_MAX_AGE", &o.AccrualMaxAge)
+	if instanceID := os.Getenv("INSTANCE_ID"); instanceID != "" {
+		o.InstanceID = instanceID
+	}
+	if passwordHashAlgorithm := os.Getenv("PASSWORD_HASH_ALGORITHM"); passwordHashAlgorithm != "" {
+		o.PasswordHashAlgorithm = passwordHashAlgorithm
+	}
+	intFromEnv("BCRYPT_COST", &o.BcryptCost)
+	intFromEnv("ARGON2_TIME", &o.Argon2Time)
+	intFromEnv("ARGON2_MEMORY", &o.Argon2Memory)
+	intFromEnv("ARGON2_THREADS", &o.Argon2Threads)
+	if jwtKeysFile := os.Getenv("JWT_KEYS_FILE"); jwtKeysFile != "" {
+		o.JWTKeysFile = jwtKeysFile
+	}
+	// секрет задаётся только через окружение, чтобы не светиться в списке процессов
+	o.JWTSecret = os.Getenv("JWT_SECRET")
+	durationFromEnv("TOKEN_EXP", &o.TokenExp)
+	durationFromEnv("REFRESH_TOKEN_EXP", &o.RefreshTokenExp)
+	intFromEnv("LOGIN_MAX_FAILURES", &o.LoginMaxFailures)
+	intFromEnv("IP_MAX_FAILURES", &o.IPMaxFailures)
+	if trustedProxies := os.Getenv("TRUSTED_PROXIES"); trustedProxies != "" {
+		o.TrustedProxies = trustedProxies
+	}
+	durationFromEnv("LOCKOUT_BASE_DELAY", &o.LockoutBaseDelay)
+	durationFromEnv("LOCKOUT_MAX_DELAY", &o.LockoutMaxDelay)
+	durationFromEnv("LOCKOUT_RESET_AFTER", &o.LockoutResetAfter)
+	// учётная запись администратора, создаётся при старте; существующий пользователь
+	// повышается до администратора, только если его пароль совпадает с ADMIN_PASSWORD
+	o.AdminLogin = os.Getenv("ADMIN_LOGIN")
+	o.AdminPassword = os.Getenv("ADMIN_PASSWORD")
+	durationFromEnv("RESET_TOKEN_EXP", &o.ResetTokenExp)
+	intFromEnv("RESET_LOGIN_MAX_REQUESTS", &o.ResetLoginMaxRequests)
+	intFromEnv("RESET_IP_MAX_REQUESTS", &o.ResetIPMaxRequests)
+	durationFromEnv("RESET_WINDOW", &o.ResetWindow)
+	if notificationsFile := os.Getenv("NOTIFICATIONS_FILE"); notificationsFile != "" {
+		o.NotificationsFile = notificationsFile
+	}
+	intFromEnv("LOGIN_MIN_LENGTH", &o.LoginMinLength)
+	intFromEnv("LOGIN_MAX_LENGTH", &o.LoginMaxLength)
+	if loginPattern := os.Getenv("LOGIN_PATTERN"); loginPattern != "" {
+		o.LoginPattern = loginPattern
+	}
+	intFromEnv("PASSWORD_MIN_LENGTH", &o.PasswordMinLength)
+	intFromEnv("PASSWORD_MAX_LENGTH", &o.PasswordMaxLength)
+	intFromEnv("PASSWORD_MIN_CLASSES", &o.PasswordMinClasses)
+	if bannedPasswordsFile := os.Getenv("BANNED_PASSWORDS_FILE"); bannedPasswordsFile != "" {
+		o.BannedPasswordsFile = bannedPasswordsFile
+	}
+	floatFromEnv("WITHDRAW_STEP_UP_AMOUNT", &o.WithdrawStepUpAmount)
+	if oidcIssuer := os.Getenv("OIDC_ISSUER"); oidcIssuer != "" {
+		o.OIDCIssuer = oidcIssuer
+	}
+	if oidcClientID := os.Getenv("OIDC_CLIENT_ID"); oidcClientID != "" {
+		o.OIDCClientID = oidcClientID
+	}
+	// секрет задаётся только через окружение, как и JWT_SECRET
+	o.OIDCClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	if oidcRedirectURL := os.Getenv("OIDC_REDIRECT_URL"); oidcRedirectURL != "" {
+		o.OIDCRedirectURL = oidcRedirectURL
+	}
+	if oidcScopes := os.Getenv("OIDC_SCOPES"); oidcScopes != "" {
+		o.OIDCScopes = oidcScopes
+	}
+	if cookiePath := os.Getenv("COOKIE_PATH"); cookiePath != "" {
+		o.CookiePath = cookiePath
+	}
+	if cookieDomain := os.Getenv("COOKIE_DOMAIN"); cookieDomain != "" {
+		o.CookieDomain = cookieDomain
+	}
+	boolFromEnv("COOKIE_HTTP_ONLY", &o.CookieHTTPOnly)
+	boolFromEnv("COOKIE_SECURE", &o.CookieSecure)
+	if cookieSameSite := os.Getenv("COOKIE_SAME_SITE"); cookieSameSite != "" {
+		o.CookieSameSite = cookieSameSite
+	}
+	boolFromEnv("COOKIE_PERSISTENT", &o.CookiePersistent)
+}
+
+func boolFromEnv(name string, value *bool) {
+	if envValue := os.Getenv(name); envValue != "" {
+		val, err := strconv.ParseBool(envValue)
+		if err != nil {
+			logger.Log.Fatal(name+" parsing", zap.String("error", err.Error()))
+		}
+		*value = val
+	}
+}
+
+func intFromEnv(name string, value *int) {
+	if envValue := os.Getenv(name); envValue != "" {
+		val, err := strconv.Atoi(envValue)
+		if err != nil {
+			logger.Log.Fatal(name+" parsing", zap.String("error", err.Error()))
+		}
+		*value = val
+	}
+}
+
+func floatFromEnv(name string, value *float64) {
+	if envValue := os.Getenv(name); envValue != "" {
+		val, err := strconv.ParseFloat(envValue, 64)
+		if err != nil {
+			logger.Log.Fatal(name+" parsing", zap.String("error", err.Error()))
+		}
+		*value = val
+	}
+}
+
+func durationFromEnv(name string, value *time.Duration) {
+	if envValue := os.Getenv(name); envValue != "" {
+		val, err := time.ParseDuration(envValue)
 		if err != nil {
-			logger.Log.Fatal("CHECK_ORDERID parsing", zap.String("error", err.Error()))
+			logger.Log.Fatal(name+" parsing", zap.String("error", err.Error()))
 		}
-		o.CheckOrderID = val
+		*value = val
 	}
 }
 
@@ -0,0 +1,237 @@
+// Package accrual - клиент системы расчёта начислений баллов лояльности.
+package accrual
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nasik90/gophermart/internal/app/logger"
+	"github.com/nasik90/gophermart/internal/app/storage"
+)
+
+const (
+	DefaultTimeout        = 10 * time.Second
+	DefaultConnectTimeout = 5 * time.Second
+)
+
+// Статусы расчёта начислений
+const (
+	StatusREGISTERED = "REGISTERED"
+	StatusINVALID    = "INVALID"
+	StatusPROCESSING = "PROCESSING"
+	StatusPROCESSED  = "PROCESSED"
+)
+
+var (
+	ErrOrderNotRegistered = errors.New("order not registered")
+	ErrTooManyRequests    = errors.New("too many requests")
+	ErrServer             = errors.New("accrual system error")
+	ErrUnexpectedStatus   = errors.New("unexpected accrual system response status")
+	ErrDecode             = errors.New("malformed accrual system response")
+	ErrNetwork            = errors.New("accrual system is unavailable")
+	ErrInvalidBaseURL     = errors.New("invalid accrual system address")
+)
+
+// RateLimitError - ответ 429. RetryAfter - пауза из заголовка Retry-After, 0 - если заголовка нет
+// или он некорректен.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrTooManyRequests, e.RetryAfter)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrTooManyRequests
+}
+
+// StatusError - ответ с неожиданным кодом. Ошибки 5xx оборачивают ErrServer, остальные - ErrUnexpectedStatus.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("accrual system responded %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *StatusError) Unwrap() error {
+	if e.StatusCode >= http.StatusInternalServerError {
+		return ErrServer
+	}
+	return ErrUnexpectedStatus
+}
+
+// Order - расчёт начислений по заказу
+type Order struct {
+	Order   string  `json:"order"`
+	Status  string  `json:"status"`
+	Accrual float64 `json:"accrual"`
+}
+
+// Config - параметры подключения к системе начислений.
+// CAFile - сертификаты, которым доверяется в дополнение к системным,
+// CertFile и KeyFile - клиентский сертификат для взаимной аутентификации.
+type Config struct {
+	Address        string
+	Timeout        time.Duration
+	ConnectTimeout time.Duration
+	CAFile         string
+	CertFile       string
+	KeyFile        string
+}
+
+type Client struct {
+	baseURL *url.URL
+	client  *http.Client
+}
+
+// NewClient проверяет адрес системы начислений и готовит HTTP-клиент с таймаутами и настройками TLS.
+func NewClient(config Config) (*Client, error) {
+	baseURL, err := ParseBaseURL(config.Address)
+	if err != nil {
+		return nil, err
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.ConnectTimeout <= 0 {
+		config.ConnectTimeout = DefaultConnectTimeout
+	}
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: config.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = config.ConnectTimeout
+	transport.TLSClientConfig = tlsConfig
+	return &Client{
+		baseURL: baseURL,
+		client:  &http.Client{Timeout: config.Timeout, Transport: transport},
+	}, nil
+}
+
+// ParseBaseURL разбирает адрес системы начислений. Адрес без схемы считается http://,
+// путь в адресе сохраняется как префикс API.
+func ParseBaseURL(address string) (*url.URL, error) {
+	address = strings.TrimSpace(address)
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	baseURL, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBaseURL, err)
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, fmt.Errorf("%w: unsupported scheme %q", ErrInvalidBaseURL, baseURL.Scheme)
+	}
+	if baseURL.Host == "" {
+		return nil, fmt.Errorf("%w: empty host", ErrInvalidBaseURL)
+	}
+	if baseURL.RawQuery != "" || baseURL.Fragment != "" {
+		return nil, fmt.Errorf("%w: query and fragment are not allowed", ErrInvalidBaseURL)
+	}
+	baseURL.Path = strings.TrimSuffix(baseURL.Path, "/")
+	baseURL.RawPath = strings.TrimSuffix(baseURL.RawPath, "/")
+	return baseURL, nil
+}
+
+func newTLSConfig(config Config) (*tls.Config, error) {
+	if config.CAFile == "" && config.CertFile == "" && config.KeyFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// GetOrder запрашивает расчёт начислений по заказу.
+// Для незарегистрированного заказа возвращается ErrOrderNotRegistered, для ответа 429 - *RateLimitError.
+func (c *Client) GetOrder(ctx context.Context, orderID storage.OrderNumber) (*Order, error) {
+	start := time.Now()
+	orderURL := *c.baseURL
+	orderURL.Path = c.baseURL.Path + "/api/orders/" + string(orderID)
+	orderURL.RawPath = c.baseURL.EscapedPath() + "/api/orders/" + url.PathEscape(string(orderID))
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, orderURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+	defer response.Body.Close()
+	logger.Log.Sugar().Infoln(
+		"uri", request.URL.Path,
+		"method", request.Method,
+		"status", response.StatusCode,
+		"duration", time.Since(start),
+	)
+
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return nil, ErrOrderNotRegistered
+	case http.StatusTooManyRequests:
+		return nil, &RateLimitError{RetryAfter: parseRetryAfter(response.Header.Get("Retry-After"), time.Now())}
+	default:
+		return nil, &StatusError{StatusCode: response.StatusCode}
+	}
+	var order Order
+	if err := json.NewDecoder(response.Body).Decode(&order); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	return &order, nil
+}
+
+// parseRetryAfter читает Retry-After в секундах или в виде HTTP-даты.
+// Некорректное значение и дата в прошлом дают 0.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(value)
+	if err != nil || !date.After(now) {
+		return 0
+	}
+	return date.Sub(now)
+}
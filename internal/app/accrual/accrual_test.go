@@ -0,0 +1,141 @@
+package accrual
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_GetOrder(t *testing.T) {
+	retryDate := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prefix/api/orders/{number}", func(w http.ResponseWriter, r *http.Request) {
+		switch r.PathValue("number") {
+		case "1":
+			w.Header().Set("content-type", "application/json")
+			w.Write([]byte(`{"order":"1","status":"PROCESSED","accrual":500}`))
+		case "2":
+			w.WriteHeader(http.StatusNoContent)
+		case "3":
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "4":
+			w.Header().Set("Retry-After", retryDate)
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "5":
+			w.WriteHeader(http.StatusBadGateway)
+		case "6":
+			w.Write([]byte(`{"order":`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client, err := NewClient(Config{Address: server.URL + "/prefix/"})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	order, err := client.GetOrder(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, &Order{Order: "1", Status: StatusPROCESSED, Accrual: 500}, order)
+
+	_, err = client.GetOrder(ctx, "2")
+	assert.ErrorIs(t, err, ErrOrderNotRegistered)
+
+	var rateLimitErr *RateLimitError
+	_, err = client.GetOrder(ctx, "3")
+	require.ErrorAs(t, err, &rateLimitErr)
+	assert.ErrorIs(t, err, ErrTooManyRequests)
+	assert.Equal(t, time.Minute, rateLimitErr.RetryAfter)
+
+	_, err = client.GetOrder(ctx, "4")
+	require.ErrorAs(t, err, &rateLimitErr)
+	assert.InDelta(t, time.Minute, rateLimitErr.RetryAfter, float64(2*time.Second))
+
+	var statusErr *StatusError
+	_, err = client.GetOrder(ctx, "5")
+	require.ErrorAs(t, err, &statusErr)
+	assert.ErrorIs(t, err, ErrServer)
+	assert.Equal(t, http.StatusBadGateway, statusErr.StatusCode)
+
+	_, err = client.GetOrder(ctx, "6")
+	assert.ErrorIs(t, err, ErrDecode)
+
+	_, err = client.GetOrder(ctx, "7")
+	assert.ErrorIs(t, err, ErrUnexpectedStatus)
+	assert.NotErrorIs(t, err, ErrServer)
+
+	server.Close()
+	_, err = client.GetOrder(ctx, "1")
+	assert.ErrorIs(t, err, ErrNetwork)
+}
+
+func TestClient_CustomCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"order":"1","status":"INVALID"}`))
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	client, err := NewClient(Config{Address: server.URL})
+	require.NoError(t, err)
+	_, err = client.GetOrder(ctx, "1")
+	assert.ErrorIs(t, err, ErrNetwork)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+	client, err = NewClient(Config{Address: server.URL, CAFile: caFile})
+	require.NoError(t, err)
+	order, err := client.GetOrder(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, StatusINVALID, order.Status)
+
+	_, err = NewClient(Config{Address: server.URL, CertFile: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Error(t, err)
+}
+
+func TestParseBaseURL(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		wantErr bool
+	}{
+		{address: "localhost:8080", want: "http://localhost:8080"},
+		{address: "https://accrual.example.com/", want: "https://accrual.example.com"},
+		{address: "http://accrual.example.com/v1/", want: "http://accrual.example.com/v1"},
+		{address: "ftp://accrual.example.com", wantErr: true},
+		{address: "http://", wantErr: true},
+		{address: "http://accrual.example.com?debug=1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			baseURL, err := ParseBaseURL(tt.address)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidBaseURL)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, baseURL.String())
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(t, 2*time.Minute, parseRetryAfter(now.Add(2*time.Minute).Format(http.TimeFormat), now))
+	assert.Zero(t, parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now))
+	assert.Zero(t, parseRetryAfter("-5", now))
+	assert.Zero(t, parseRetryAfter("soon", now))
+	assert.Zero(t, parseRetryAfter("", now))
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/nasik90/gophermart/internal/app/logger"
+	middleware "github.com/nasik90/gophermart/internal/app/middlewares"
+	"github.com/nasik90/gophermart/internal/app/service"
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"go.uber.org/zap"
+)
+
+const exportFileName = "gophermart-export"
+
+// ExportUserData отдаёт все данные пользователя одним JSON-файлом или, если запрошен
+// формат zip (?format=zip или Accept: application/zip), архивом с отдельным файлом на каждый раздел.
+func (h *Handler) ExportUserData() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		login := middleware.LoginFromContext(ctx)
+		export, err := h.service.ExportUserData(ctx, login)
+		if err != nil {
+			logger.Log.Error("export user data", zap.String("error", err.Error()))
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if req.URL.Query().Get("format") == "zip" || strings.Contains(req.Header.Get("Accept"), "application/zip") {
+			archive, err := buildExportZip(export)
+			if err != nil {
+				logger.Log.Error("build export archive", zap.String("error", err.Error()))
+				http.Error(res, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res.Header().Set("content-type", "application/zip")
+			res.Header().Set("Content-Disposition", `attachment; filename="`+exportFileName+`.zip"`)
+			res.WriteHeader(http.StatusOK)
+			res.Write(archive)
+			return
+		}
+		exportJSON, err := json.Marshal(export)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.Header().Set("content-type", "application/json")
+		res.Header().Set("Content-Disposition", `attachment; filename="`+exportFileName+`.json"`)
+		res.WriteHeader(http.StatusOK)
+		res.Write(exportJSON)
+	}
+}
+
+// buildExportZip собирает архив целиком в памяти, чтобы ошибка не оборвала уже начатый ответ 200.
+func buildExportZip(export *storage.UserExport) ([]byte, error) {
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{name: "profile.json", data: export.Profile},
+		{name: "orders.json", data: export.Orders},
+		{name: "history_statuses.json", data: export.HistoryStatuses},
+		{name: "orders_points.json", data: export.OrdersPoints},
+	}
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, file := range files {
+		w, err := archive.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.NewEncoder(w).Encode(file.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DeleteUser удаляет учётную запись текущего пользователя после подтверждения паролем.
+// Пользователь с привязанным провайдером может вместо пароля передать код второго фактора
+// в заголовке X-OTP-Code или предварительно повторно войти у провайдера (/api/user/oidc/reauth).
+func (h *Handler) DeleteUser() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		login := middleware.LoginFromContext(ctx)
+		var input struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := h.service.DeleteUser(ctx, login, input.Password, req.Header.Get(otpHeader), middleware.ClientIP(req))
+		if writeLoginLocked(res, err) {
+			return
+		}
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, service.ErrWrongPassword) || errors.Is(err, service.ErrInvalidOTP) ||
+				errors.Is(err, service.ErrReauthRequired) {
+				status = http.StatusForbidden
+			}
+			http.Error(res, err.Error(), status)
+			return
+		}
+		h.auth.ClearAuthCookies(res)
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/nasik90/gophermart/internal/app/logger"
+	middleware "github.com/nasik90/gophermart/internal/app/middlewares"
+	"github.com/nasik90/gophermart/internal/app/service"
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"go.uber.org/zap"
+)
+
+type apiKeyResponse struct {
+	storage.APIKey
+	// Key возвращается только при создании ключа
+	Key string `json:"key"`
+}
+
+// CreateAPIKey создаёт API-ключ. Ключ отдаётся в ответе один раз, получить его повторно нельзя.
+func (h *Handler) CreateAPIKey() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		var input struct {
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if input.Name == "" {
+			http.Error(res, "name is required", http.StatusBadRequest)
+			return
+		}
+		login := middleware.LoginFromContext(ctx)
+		key, apiKey, err := h.service.CreateAPIKey(ctx, login, input.Name, input.Scopes)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, service.ErrUnknownScope) {
+				status = http.StatusBadRequest
+			}
+			http.Error(res, err.Error(), status)
+			return
+		}
+		resJSON, err := json.Marshal(apiKeyResponse{APIKey: *apiKey, Key: key})
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.Header().Set("content-type", "application/json")
+		res.WriteHeader(http.StatusCreated)
+		res.Write(resJSON)
+	}
+}
+
+func (h *Handler) GetAPIKeys() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		login := middleware.LoginFromContext(ctx)
+		apiKeys, err := h.service.GetAPIKeys(ctx, login)
+		if err != nil {
+			logger.Log.Error("get api keys", zap.String("error", err.Error()))
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(apiKeys) == 0 {
+			res.WriteHeader(http.StatusNoContent)
+			return
+		}
+		resJSON, err := json.Marshal(apiKeys)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.Header().Set("content-type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		res.Write(resJSON)
+	}
+}
+
+func (h *Handler) RevokeAPIKey() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		id, err := strconv.Atoi(chi.URLParam(req, "id"))
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		login := middleware.LoginFromContext(ctx)
+		if err := h.service.RevokeAPIKey(ctx, login, id); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, storage.ErrAPIKeyNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(res, err.Error(), status)
+			return
+		}
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
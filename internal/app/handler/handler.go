@@ -5,8 +5,10 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"math"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/nasik90/gophermart/internal/app/logger"
 	middleware "github.com/nasik90/gophermart/internal/app/middlewares"
@@ -17,20 +19,49 @@ import (
 
 type Service interface {
 	RegisterNewUser(ctx context.Context, user, password string) error
-	UserIsValid(ctx context.Context, login, password string) (bool, error)
-	LoadOrder(ctx context.Context, orderNumber int, login string) error
-	GetOrderList(ctx context.Context, login string) (*[]storage.OrderData, error)
-	WithdrawPoints(ctx context.Context, login string, OrderID int, points float64) error
+	UserIsValid(ctx context.Context, login, password, ip string) (bool, error)
+	UnlockLogin(ctx context.Context, login, ip string) error
+	GetUserRole(ctx context.Context, login string) (string, error)
+	SetUserRole(ctx context.Context, login, role string) error
+	LoadOrder(ctx context.Context, orderNumber string, login string) error
+	LoadOrders(ctx context.Context, numbers []string, login string) ([]service.OrderBatchResult, error)
+	GetOrderList(ctx context.Context, login string, params service.ListParams) (*[]storage.OrderData, string, error)
+	GetOrder(ctx context.Context, login string, orderNumber string) (*storage.OrderDetails, error)
+	GetStuckOrders(ctx context.Context, params service.ListParams) ([]storage.StuckOrder, string, error)
+	RequeueOrder(ctx context.Context, orderNumber string) error
+	WithdrawPoints(ctx context.Context, login string, orderNumber string, points float64, otpCode string) error
 	GetUserBalance(ctx context.Context, login string) (*storage.UserBalance, error)
-	GetWithdrawals(ctx context.Context, login string) (*[]storage.Withdrawals, error)
+	GetWithdrawals(ctx context.Context, login string, params service.ListParams) (*[]storage.Withdrawals, string, error)
+	IssueRefreshToken(ctx context.Context, login string) (string, string, error)
+	RotateRefreshToken(ctx context.Context, token string) (string, string, string, error)
+	Logout(ctx context.Context, login, jti string, expiresAt time.Time, sessionID, refreshToken string) error
+	ChangePassword(ctx context.Context, login, oldPassword, newPassword, ip string) error
+	RequestPasswordReset(ctx context.Context, login, ip string) error
+	ResetPassword(ctx context.Context, token, newPassword string) error
+	CreateAPIKey(ctx context.Context, login, name string, scopes []string) (string, *storage.APIKey, error)
+	GetAPIKeys(ctx context.Context, login string) ([]storage.APIKey, error)
+	RevokeAPIKey(ctx context.Context, login string, id int) error
+	GetSessions(ctx context.Context, login string) ([]storage.Session, error)
+	RevokeSession(ctx context.Context, login, id string) error
+	ExportUserData(ctx context.Context, login string) (*storage.UserExport, error)
+	DeleteUser(ctx context.Context, login, password, otpCode, ip string) error
+	StartOIDCLogin(ctx context.Context, linkLogin string) (string, string, error)
+	StartOIDCReauth(ctx context.Context, login string) (string, string, error)
+	FinishOIDCLogin(ctx context.Context, state, code string) (string, bool, error)
+	EnrollTOTP(ctx context.Context, login string) (*service.TOTPEnrollment, error)
+	ConfirmTOTP(ctx context.Context, login, code string) error
+	DisableTOTP(ctx context.Context, login, code string) error
+	TOTPEnabled(ctx context.Context, login string) (bool, error)
+	VerifyLoginOTP(ctx context.Context, login, code, ip string) error
 }
 
 type Handler struct {
 	service Service
+	auth    *middleware.Authenticator
 }
 
-func NewHandler(service Service) *Handler {
-	return &Handler{service: service}
+func NewHandler(service Service, auth *middleware.Authenticator) *Handler {
+	return &Handler{service: service, auth: auth}
 }
 
 func (h *Handler) RegisterNewUser() http.HandlerFunc {
@@ -45,6 +76,9 @@ func (h *Handler) RegisterNewUser() http.HandlerFunc {
 			return
 		}
 		if err := h.service.RegisterNewUser(ctx, input.Login, input.Password); err != nil {
+			if writePolicyError(res, err) {
+				return
+			}
 			status := http.StatusInternalServerError
 			if errors.Is(err, storage.ErrUserNotUnique) {
 				status = http.StatusConflict
@@ -52,45 +86,336 @@ func (h *Handler) RegisterNewUser() http.HandlerFunc {
 			http.Error(res, err.Error(), status)
 			return
 		}
-		if err := middleware.SetAuthCookie(input.Login, res); err != nil {
+		h.writeTokens(req, input.Login, res)
+	}
+}
+
+func (h *Handler) LoginUser() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		var input struct {
+			Login    string `json:"login"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		isValid, err := h.service.UserIsValid(ctx, input.Login, input.Password, middleware.ClientIP(req))
+		if writeLoginLocked(res, err) {
+			return
+		}
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !isValid {
+			http.Error(res, "", http.StatusUnauthorized)
+			return
+		}
+		totpEnabled, err := h.service.TOTPEnabled(ctx, input.Login)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if totpEnabled {
+			h.writeMFAChallenge(input.Login, res)
+			return
+		}
+		h.writeTokens(req, input.Login, res)
+	}
+}
+
+// writeLoginLocked отвечает 429 с заголовком Retry-After, если вход заблокирован.
+func writeLoginLocked(res http.ResponseWriter, err error) bool {
+	var lockedErr *service.LoginLockedError
+	if !errors.As(err, &lockedErr) {
+		return false
+	}
+	writeRetryAfter(res, err, lockedErr.RetryAfter)
+	return true
+}
+
+func writeRetryAfter(res http.ResponseWriter, err error, retryAfter time.Duration) {
+	res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(res, err.Error(), http.StatusTooManyRequests)
+}
+
+// ChangePassword меняет пароль текущего пользователя. Все сессии завершаются, API-ключи отзываются,
+// текущему клиенту выдаётся новая пара токенов.
+func (h *Handler) ChangePassword() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		login := middleware.LoginFromContext(ctx)
+		var input struct {
+			OldPassword string `json:"old_password"`
+			NewPassword string `json:"new_password"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := h.service.ChangePassword(ctx, login, input.OldPassword, input.NewPassword, middleware.ClientIP(req))
+		if writeLoginLocked(res, err) {
+			return
+		}
+		if err != nil {
+			if writePolicyError(res, err) {
+				return
+			}
+			status := http.StatusInternalServerError
+			if errors.Is(err, service.ErrWrongPassword) {
+				status = http.StatusForbidden
+			}
+			http.Error(res, err.Error(), status)
+			return
+		}
+		h.writeTokens(req, login, res)
+	}
+}
+
+// RequestPasswordReset отправляет пользователю токен сброса пароля.
+// Ответ не зависит от того, существует ли пользователь.
+func (h *Handler) RequestPasswordReset() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		var input struct {
+			Login string `json:"login"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := h.service.RequestPasswordReset(ctx, input.Login, middleware.ClientIP(req))
+		var limitErr *service.ResetLimitError
+		if errors.As(err, &limitErr) {
+			writeRetryAfter(res, err, limitErr.RetryAfter)
+			return
+		}
+		if err != nil {
+			logger.Log.Error("request password reset", zap.String("error", err.Error()))
 			http.Error(res, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		res.Header().Set("content-type", "text/plain")
+		res.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// ResetPassword устанавливает новый пароль по токену сброса.
+func (h *Handler) ResetPassword() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		var input struct {
+			Token       string `json:"token"`
+			NewPassword string `json:"new_password"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.service.ResetPassword(ctx, input.Token, input.NewPassword); err != nil {
+			if writePolicyError(res, err) {
+				return
+			}
+			status := http.StatusInternalServerError
+			if errors.Is(err, storage.ErrResetTokenInvalid) {
+				status = http.StatusBadRequest
+			}
+			http.Error(res, err.Error(), status)
+			return
+		}
+		res.Header().Set("content-type", "text/plain")
+		res.WriteHeader(http.StatusOK)
+	}
+}
 
+// UnlockLogin снимает блокировку входа с логина и/или IP-адреса.
+func (h *Handler) UnlockLogin() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		var input struct {
+			Login string `json:"login"`
+			IP    string `json:"ip"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if input.Login == "" && input.IP == "" {
+			http.Error(res, "login or ip is required", http.StatusBadRequest)
+			return
+		}
+		if err := h.service.UnlockLogin(ctx, input.Login, input.IP); err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		res.Header().Set("content-type", "text/plain")
 		res.WriteHeader(http.StatusOK)
 	}
 }
 
-func (h *Handler) LoginUser() http.HandlerFunc {
+// SetUserRole назначает пользователю роль. Выпущенные ранее токены пользователя отзываются,
+// новая роль попадёт в токены, выпущенные после изменения.
+func (h *Handler) SetUserRole() http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		ctx := req.Context()
 		var input struct {
-			Login    string `json:"login"`
-			Password string `json:"password"`
+			Login string `json:"login"`
+			Role  string `json:"role"`
 		}
 		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
 			http.Error(res, err.Error(), http.StatusBadRequest)
 			return
 		}
-		isValid, err := h.service.UserIsValid(ctx, input.Login, input.Password)
+		if err := h.service.SetUserRole(ctx, input.Login, input.Role); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, service.ErrUnknownRole) {
+				status = http.StatusBadRequest
+			} else if errors.Is(err, storage.ErrUserNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(res, err.Error(), status)
+			return
+		}
+		res.Header().Set("content-type", "text/plain")
+		res.WriteHeader(http.StatusOK)
+	}
+}
+
+// RefreshToken обменивает refresh-токен из cookie или тела запроса на новую пару токенов.
+func (h *Handler) RefreshToken() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		refreshToken := refreshTokenFromRequest(req)
+		if refreshToken == "" {
+			http.Error(res, "refresh token is required", http.StatusUnauthorized)
+			return
+		}
+		login, sessionID, newRefreshToken, err := h.service.RotateRefreshToken(ctx, refreshToken)
 		if err != nil {
+			if errors.Is(err, storage.ErrRefreshTokenNotFound) ||
+				errors.Is(err, storage.ErrRefreshTokenExpired) ||
+				errors.Is(err, storage.ErrRefreshTokenReused) {
+				if errors.Is(err, storage.ErrRefreshTokenReused) {
+					logger.Log.Warn("refresh token reuse detected, token family revoked")
+				}
+				h.auth.ClearAuthCookies(res)
+				http.Error(res, err.Error(), http.StatusUnauthorized)
+				return
+			}
 			http.Error(res, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if !isValid {
+		h.writeTokenResponse(req, login, sessionID, newRefreshToken, res)
+	}
+}
+
+// Logout отзывает текущий access-токен и цепочку refresh-токена.
+func (h *Handler) Logout() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		claims := middleware.ClaimsFromContext(ctx)
+		if claims == nil {
 			http.Error(res, "", http.StatusUnauthorized)
 			return
 		}
-		if err := middleware.SetAuthCookie(input.Login, res); err != nil {
+		var expiresAt time.Time
+		if claims.ExpiresAt != nil {
+			expiresAt = claims.ExpiresAt.Time
+		}
+		if err := h.service.Logout(ctx, claims.UserID, claims.ID, expiresAt, claims.SessionID, refreshTokenFromRequest(req)); err != nil {
 			http.Error(res, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		h.auth.ClearAuthCookies(res)
 		res.Header().Set("content-type", "text/plain")
 		res.WriteHeader(http.StatusOK)
 	}
 }
 
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// writeTokens выпускает пару токенов и отдаёт их в cookie, заголовке Authorization и теле ответа.
+// Каждая выдача начинает новую сессию.
+func (h *Handler) writeTokens(req *http.Request, login string, res http.ResponseWriter) {
+	refreshToken, sessionID, err := h.service.IssueRefreshToken(req.Context(), login)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.writeTokenResponse(req, login, sessionID, refreshToken, res)
+}
+
+func (h *Handler) writeTokenResponse(req *http.Request, login, sessionID, refreshToken string, res http.ResponseWriter) {
+	role, err := h.service.GetUserRole(req.Context(), login)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	accessToken, err := h.auth.SetAuthCookie(req, login, role, sessionID, res)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.auth.SetRefreshCookie(refreshToken, res)
+	tokensJSON, err := json.Marshal(tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(h.auth.TokenExp().Seconds()),
+		RefreshToken: refreshToken,
+	})
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("content-type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(tokensJSON)
+}
+
+// writePolicyError отвечает 400 со списком нарушенных правил, если err - *service.PolicyError.
+func writePolicyError(res http.ResponseWriter, err error) bool {
+	var policyErr *service.PolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+	responseJSON, err := json.Marshal(struct {
+		Error      string                    `json:"error"`
+		Violations []service.PolicyViolation `json:"violations"`
+	}{
+		Error:      service.ErrPolicyViolation.Error(),
+		Violations: policyErr.Violations,
+	})
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	res.Header().Set("content-type", "application/json")
+	res.WriteHeader(http.StatusBadRequest)
+	res.Write(responseJSON)
+	return true
+}
+
+// refreshTokenFromRequest достаёт refresh-токен из cookie, а для клиентов без cookie - из тела запроса.
+func refreshTokenFromRequest(req *http.Request) string {
+	if refreshToken := middleware.RefreshTokenFromRequest(req); refreshToken != "" {
+		return refreshToken
+	}
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		return ""
+	}
+	return input.RefreshToken
+}
+
 func (h *Handler) LoadOrder() http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		var buf bytes.Buffer
@@ -106,12 +431,7 @@ func (h *Handler) LoadOrder() http.HandlerFunc {
 			return
 		}
 		login := middleware.LoginFromContext(ctx)
-		orderNumberInt, err := strconv.Atoi(orderNumber)
-		if err != nil {
-			http.Error(res, service.ErrOrderFormat.Error(), http.StatusUnprocessableEntity)
-			return
-		}
-		err = h.service.LoadOrder(ctx, orderNumberInt, login)
+		err = h.service.LoadOrder(ctx, orderNumber, login)
 		resStatus := http.StatusAccepted
 		if err != nil {
 			if errors.Is(err, storage.ErrOrderLoadedByAnotherUser) {
@@ -136,7 +456,16 @@ func (h *Handler) GetOrderList() http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		ctx := req.Context()
 		login := middleware.LoginFromContext(ctx)
-		orderList, err := h.service.GetOrderList(ctx, login)
+		params, err := listParamsFromRequest(req)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		orderList, nextCursor, err := h.service.GetOrderList(ctx, login, params)
+		if errors.Is(err, service.ErrInvalidListParams) {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			logger.Log.Error("get order list", zap.String("error", err.Error()))
 			http.Error(res, err.Error(), http.StatusInternalServerError)
@@ -153,6 +482,7 @@ func (h *Handler) GetOrderList() http.HandlerFunc {
 			}
 			resStatus = http.StatusOK
 		}
+		writeNextPage(req, nextCursor, res)
 		res.Header().Set("content-type", "application/json")
 		res.WriteHeader(resStatus)
 		res.Write(orderListJSON)
@@ -172,15 +502,19 @@ func (h *Handler) WithdrawPoints() http.HandlerFunc {
 			http.Error(res, err.Error(), http.StatusBadRequest)
 			return
 		}
-		orderNumberInt, err := strconv.Atoi(input.Order)
-		if err != nil {
-			http.Error(res, service.ErrOrderFormat.Error(), http.StatusUnprocessableEntity)
+		err := h.service.WithdrawPoints(ctx, login, input.Order, input.Sum, req.Header.Get(otpHeader))
+		if writeLoginLocked(res, err) {
 			return
 		}
-		err = h.service.WithdrawPoints(ctx, login, orderNumberInt, input.Sum)
 		resStatus := http.StatusOK
 		if err != nil {
-			if errors.Is(err, storage.ErrOrderLoadedByAnotherUser) {
+			if errors.Is(err, service.ErrTOTPRequired) || errors.Is(err, service.ErrInvalidOTP) {
+				http.Error(res, err.Error(), http.StatusForbidden)
+				return
+			} else if errors.Is(err, service.ErrWithdrawalSum) {
+				http.Error(res, err.Error(), http.StatusUnprocessableEntity)
+				return
+			} else if errors.Is(err, storage.ErrOrderLoadedByAnotherUser) {
 				http.Error(res, err.Error(), http.StatusConflict)
 				return
 			} else if errors.Is(err, service.ErrOrderFormat) {
@@ -227,7 +561,16 @@ func (h *Handler) GetWithdrawals() http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		ctx := req.Context()
 		login := middleware.LoginFromContext(ctx)
-		orderList, err := h.service.GetWithdrawals(ctx, login)
+		params, err := listParamsFromRequest(req)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		orderList, nextCursor, err := h.service.GetWithdrawals(ctx, login, params)
+		if errors.Is(err, service.ErrInvalidListParams) {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			http.Error(res, err.Error(), http.StatusInternalServerError)
 			return
@@ -242,6 +585,7 @@ func (h *Handler) GetWithdrawals() http.HandlerFunc {
 			}
 			resStatus = http.StatusOK
 		}
+		writeNextPage(req, nextCursor, res)
 		res.Header().Set("content-type", "application/json")
 		res.WriteHeader(resStatus)
 		res.Write(orderListJSON)
@@ -1,27 +1,66 @@
 package handler
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
-	"strconv"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-chi/chi"
 	"github.com/golang/mock/gomock"
+	"github.com/nasik90/gophermart/internal/app/hasher"
 	middleware "github.com/nasik90/gophermart/internal/app/middlewares"
 	mock_service "github.com/nasik90/gophermart/internal/app/mocks"
+	"github.com/nasik90/gophermart/internal/app/notifier"
+	"github.com/nasik90/gophermart/internal/app/oidc"
+	"github.com/nasik90/gophermart/internal/app/oidc/oidctest"
+	"github.com/nasik90/gophermart/internal/app/ordervalidator"
 	"github.com/nasik90/gophermart/internal/app/service"
 	"github.com/nasik90/gophermart/internal/app/storage"
+	"github.com/nasik90/gophermart/internal/app/totp"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
+func newTestService(repo service.Repository) *service.Service {
+	orderValidator, err := ordervalidator.Parse(`regex=^[0-9]+$;luhn`)
+	if err != nil {
+		panic(err)
+	}
+	return service.NewService(repo, hasher.NewBcrypt(bcrypt.MinCost), notifier.NewLog(), service.Config{
+		OrderValidator:  orderValidator,
+		RefreshTokenExp: time.Hour,
+		ResetTokenExp:   time.Hour,
+		Lockout: service.LockoutPolicy{
+			LoginMaxFailures: 3,
+			IPMaxFailures:    10,
+			BaseDelay:        time.Minute,
+			MaxDelay:         time.Hour,
+			ResetAfter:       time.Hour,
+		},
+		WithdrawStepUpAmount: 1000,
+	})
+}
+
+func newTestAuthenticator(t *testing.T) *middleware.Authenticator {
+	keys, err := middleware.NewHMACKeySet("test", []byte("test secret"))
+	assert.NoError(t, err)
+	return middleware.NewAuthenticator(keys, time.Hour, nil, nil, nil)
+}
+
 func TestHandler_RegisterNewUser(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockRepo := mock_service.NewMockRepository(ctrl)
-	s := service.NewService(mockRepo, true)
-	h := NewHandler(s)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
 
 	type input struct {
 		Login    string `json:"login"`
@@ -51,17 +90,29 @@ func TestHandler_RegisterNewUser(t *testing.T) {
 			body.Write(inputJSON)
 			request := httptest.NewRequest(http.MethodPost, "/", body)
 
-			mockRepo.EXPECT().SaveNewUser(request.Context(), tt.input.Login, tt.input.Password).Return(nil).MinTimes(1).MaxTimes(2)
+			mockRepo.EXPECT().SaveNewUser(request.Context(), tt.input.Login, gomock.Any()).
+				DoAndReturn(func(_ context.Context, _ string, password storage.PasswordHash) error {
+					assert.Equal(t, hasher.AlgorithmBcrypt, password.Algorithm)
+					assert.NotEqual(t, tt.input.Password, password.Hash)
+					return nil
+				}).MinTimes(1).MaxTimes(2)
+			mockRepo.EXPECT().SaveRefreshToken(request.Context(), tt.input.Login, gomock.Any()).Return(nil)
+			mockRepo.EXPECT().GetUserRole(request.Context(), tt.input.Login).Return(storage.RoleUser, nil)
 
 			if tt.responseCode == http.StatusConflict {
-				mockRepo.SaveNewUser(context.Background(), tt.input.Login, tt.input.Password)
+				mockRepo.SaveNewUser(context.Background(), tt.input.Login, storage.PasswordHash{})
 			}
 
 			w := httptest.NewRecorder()
 			h.RegisterNewUser()(w, request)
 			res := w.Result()
+			var tokens tokenResponse
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(&tokens))
 			res.Body.Close()
 			assert.Equal(t, tt.responseCode, res.StatusCode)
+			assert.NotEmpty(t, tokens.AccessToken)
+			assert.NotEmpty(t, tokens.RefreshToken)
+			assert.Equal(t, "Bearer "+tokens.AccessToken, res.Header.Get("Authorization"))
 		})
 	}
 }
@@ -70,24 +121,59 @@ func TestHandler_LoginUser(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockRepo := mock_service.NewMockRepository(ctrl)
-	s := service.NewService(mockRepo, true)
-	h := NewHandler(s)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
 
 	type input struct {
 		Login    string `json:"login"`
 		Password string `json:"password"`
 	}
 
+	bcryptHash, err := hasher.NewBcrypt(bcrypt.MinCost).Hash("123")
+	assert.NoError(t, err)
+
 	tests := []struct {
 		name         string
 		input        input
+		storedHash   storage.PasswordHash
+		rehash       bool
+		failures     int
+		lockedUntil  time.Time
 		responseCode int
 	}{
 		{
 			name:         "positive test #1",
 			input:        input{Login: "vasiliy", Password: "123"},
+			storedHash:   bcryptHash,
+			responseCode: http.StatusOK,
+		},
+		{
+			name:         "plain password is rehashed",
+			input:        input{Login: "vasiliy", Password: "123"},
+			storedHash:   storage.PasswordHash{Hash: "123", Algorithm: hasher.AlgorithmPlain},
+			rehash:       true,
 			responseCode: http.StatusOK,
 		},
+		{
+			name:         "wrong password",
+			input:        input{Login: "vasiliy", Password: "1234"},
+			storedHash:   bcryptHash,
+			failures:     1,
+			responseCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "wrong password locks login",
+			input:        input{Login: "vasiliy", Password: "1234"},
+			storedHash:   bcryptHash,
+			failures:     3,
+			responseCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "locked login",
+			input:        input{Login: "vasiliy", Password: "123"},
+			lockedUntil:  time.Now().Add(90 * time.Second),
+			responseCode: http.StatusTooManyRequests,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -95,14 +181,38 @@ func TestHandler_LoginUser(t *testing.T) {
 			inputJSON, _ := json.Marshal(&tt.input)
 			body.Write(inputJSON)
 			request := httptest.NewRequest(http.MethodPost, "/", body)
+			keys := []string{"login:" + tt.input.Login, "ip:192.0.2.1"}
 
-			mockRepo.EXPECT().UserIsValid(request.Context(), tt.input.Login, tt.input.Password).Return(true, nil)
+			mockRepo.EXPECT().LockedUntil(request.Context(), keys).Return(tt.lockedUntil, nil)
+			if tt.responseCode != http.StatusTooManyRequests {
+				storedHash := tt.storedHash
+				mockRepo.EXPECT().GetPasswordHash(request.Context(), tt.input.Login).Return(&storedHash, nil)
+			}
+			if tt.rehash {
+				mockRepo.EXPECT().UpdatePasswordHash(request.Context(), tt.input.Login, gomock.Any()).Return(nil)
+			}
+			if tt.responseCode == http.StatusOK {
+				mockRepo.EXPECT().ResetAttempts(request.Context(), keys[:1]).Return(nil)
+				mockRepo.EXPECT().GetTOTP(request.Context(), tt.input.Login).Return(nil, storage.ErrTOTPNotFound)
+				mockRepo.EXPECT().SaveRefreshToken(request.Context(), tt.input.Login, gomock.Any()).Return(nil)
+				mockRepo.EXPECT().GetUserRole(request.Context(), tt.input.Login).Return(storage.RoleUser, nil)
+			}
+			if tt.failures > 0 {
+				mockRepo.EXPECT().RegisterAttempt(request.Context(), keys[0], gomock.Any()).Return(tt.failures, nil)
+				mockRepo.EXPECT().RegisterAttempt(request.Context(), keys[1], gomock.Any()).Return(1, nil)
+			}
+			if tt.failures >= 3 {
+				mockRepo.EXPECT().LockKey(request.Context(), keys[0], gomock.Any()).Return(nil)
+			}
 
 			w := httptest.NewRecorder()
 			h.LoginUser()(w, request)
 			res := w.Result()
 			res.Body.Close()
 			assert.Equal(t, tt.responseCode, res.StatusCode)
+			if tt.responseCode == http.StatusTooManyRequests {
+				assert.Equal(t, "90", res.Header.Get("Retry-After"))
+			}
 		})
 	}
 }
@@ -113,8 +223,8 @@ func TestHandler_LoadOrder(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockRepo := mock_service.NewMockRepository(ctrl)
-	s := service.NewService(mockRepo, true)
-	h := NewHandler(s)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
 
 	tests := []struct {
 		name         string
@@ -134,11 +244,23 @@ func TestHandler_LoadOrder(t *testing.T) {
 			responseCode: http.StatusUnprocessableEntity,
 			login:        "vasya",
 		},
+		{
+			name:         "number longer than int64",
+			orderID:      "12345678901234567890121",
+			responseCode: http.StatusAccepted,
+			login:        "vasya",
+		},
+		{
+			name:         "non-numeric number",
+			orderID:      "AB-378282246310005",
+			responseCode: http.StatusUnprocessableEntity,
+			login:        "vasya",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
-			orderIDint, _ := strconv.Atoi(tt.orderID)
+			orderIDint := storage.OrderNumber(tt.orderID)
 
 			body := httptest.NewRecorder().Body
 			body.Write([]byte(tt.orderID))
@@ -161,13 +283,176 @@ func TestHandler_LoadOrder(t *testing.T) {
 	}
 }
 
+func TestHandler_LoadOrders(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "json array",
+			contentType: "application/json",
+			body:        `["378282246310005", 371449635398431, "1789372997", "4111111111111111"]`,
+		},
+		{
+			name:        "text lines",
+			contentType: "text/plain",
+			body:        "378282246310005\n371449635398431\r\n\n1789372997\n4111111111111111\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(tt.body)).
+				WithContext(context.WithValue(ctx, middleware.LoginContextKey{}, "vasya"))
+			request.Header.Set("Content-Type", tt.contentType)
+
+			mockRepo.EXPECT().SaveNewOrders(request.Context(), []storage.OrderNumber{"378282246310005", "371449635398431", "4111111111111111"}, "vasya").
+				Return([]storage.OrderBatchItem{
+					{ID: "378282246310005"},
+					{ID: "371449635398431", Err: storage.ErrOrderIDNotUnique},
+					{ID: "4111111111111111", Err: storage.ErrOrderLoadedByAnotherUser},
+				}, nil)
+
+			w := httptest.NewRecorder()
+			h.LoadOrders()(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+
+			var result []service.OrderBatchResult
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+			assert.Equal(t, []service.OrderBatchResult{
+				{Number: "378282246310005", Result: service.OrderBatchAccepted},
+				{Number: "371449635398431", Result: service.OrderBatchDuplicate},
+				{Number: "1789372997", Result: service.OrderBatchInvalidFormat, Error: "order format is not valid: luhn: check digit mismatch"},
+				{Number: "4111111111111111", Result: service.OrderBatchAnotherUser},
+			}, result)
+		})
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("[]")).
+		WithContext(context.WithValue(ctx, middleware.LoginContextKey{}, "vasya"))
+	request.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.LoadOrders()(w, request)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// слишком большой пакет отклоняется без сохранения
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "too many json items",
+			contentType: "application/json",
+			body:        "[" + strings.Repeat(`"378282246310005",`, service.MaxOrderBatchSize) + `"378282246310005"]`,
+		},
+		{
+			name:        "too many text lines",
+			contentType: "text/plain",
+			body:        strings.Repeat("378282246310005\n", service.MaxOrderBatchSize+1),
+		},
+		{
+			name:        "too large json body",
+			contentType: "application/json",
+			body:        `["` + strings.Repeat("1", 2<<20) + `"]`,
+		},
+	} {
+		request = httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(tt.body)).
+			WithContext(context.WithValue(ctx, middleware.LoginContextKey{}, "vasya"))
+		request.Header.Set("Content-Type", tt.contentType)
+		w = httptest.NewRecorder()
+		h.LoadOrders()(w, request)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, tt.name)
+	}
+}
+
+func TestHandler_GetOrder(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
+	r := chi.NewRouter()
+	r.Get("/api/user/orders/{number}", h.GetOrder())
+
+	uploadedAt := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	order := &storage.OrderDetails{
+		OrderData: storage.OrderData{Number: "378282246310005", Status: "PROCESSED", Accrual: 500, UploadedAt: uploadedAt},
+		Login:     "vasya",
+		History: []storage.OrderStatusChange{
+			{Status: "NEW", DateTime: uploadedAt},
+			{Status: "PROCESSED", DateTime: uploadedAt.Add(time.Minute)},
+		},
+	}
+	tests := []struct {
+		name         string
+		number       string
+		login        string
+		order        *storage.OrderDetails
+		err          error
+		responseCode int
+	}{
+		{
+			name:         "own order",
+			number:       "378282246310005",
+			login:        "vasya",
+			order:        order,
+			responseCode: http.StatusOK,
+		},
+		{
+			name:         "another user's order",
+			number:       "378282246310005",
+			login:        "petya",
+			order:        order,
+			responseCode: http.StatusForbidden,
+		},
+		{
+			name:         "unknown order",
+			number:       "4111111111111111",
+			login:        "vasya",
+			err:          storage.ErrOrderNotFound,
+			responseCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/user/orders/"+tt.number, nil).
+				WithContext(context.WithValue(ctx, middleware.LoginContextKey{}, tt.login))
+			mockRepo.EXPECT().GetOrder(gomock.Any(), storage.OrderNumber(tt.number)).Return(tt.order, tt.err)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.responseCode, res.StatusCode)
+			if tt.responseCode == http.StatusOK {
+				var result map[string]interface{}
+				assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+				assert.Equal(t, "PROCESSED", result["status"])
+				assert.NotContains(t, result, "Login")
+				assert.Len(t, result["history"], 2)
+			}
+		})
+	}
+}
+
 func TestHandler_GetOrderList(t *testing.T) {
 	ctx := context.Background()
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockRepo := mock_service.NewMockRepository(ctrl)
-	s := service.NewService(mockRepo, true)
-	h := NewHandler(s)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
 
 	tests := []struct {
 		name         string
@@ -187,7 +472,7 @@ func TestHandler_GetOrderList(t *testing.T) {
 			request := httptest.NewRequest(http.MethodGet, "/", body).
 				WithContext(context.WithValue(ctx, middleware.LoginContextKey{}, tt.login))
 
-			mockRepo.EXPECT().GetOrderList(request.Context(), tt.login).Return(nil, nil)
+			mockRepo.EXPECT().GetOrderList(request.Context(), tt.login, storage.ListFilter{Limit: service.DefaultPageSize + 1}).Return(nil, nil)
 
 			w := httptest.NewRecorder()
 			h.GetOrderList()(w, request)
@@ -198,12 +483,126 @@ func TestHandler_GetOrderList(t *testing.T) {
 	}
 }
 
+func TestHandler_GetOrderListPagination(t *testing.T) {
+	ctx := context.WithValue(context.Background(), middleware.LoginContextKey{}, "vasya")
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
+
+	uploadedAt := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	orders := []storage.OrderData{
+		{Number: "4111111111111111", Status: "NEW", UploadedAt: uploadedAt.Add(2 * time.Hour)},
+		{Number: "378282246310005", Status: "NEW", UploadedAt: uploadedAt.Add(time.Hour)},
+		{Number: "371449635398431", Status: "NEW", UploadedAt: uploadedAt},
+	}
+	request := httptest.NewRequest(http.MethodGet, "/api/user/orders?status=new&from=2025-05-01T00:00:00Z&limit=2", nil).WithContext(ctx)
+	mockRepo.EXPECT().GetOrderList(gomock.Any(), "vasya", storage.ListFilter{
+		Statuses: []string{"NEW"},
+		From:     time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC),
+		Limit:    3,
+	}).Return(&orders, nil)
+
+	w := httptest.NewRecorder()
+	h.GetOrderList()(w, request)
+	res := w.Result()
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var page []storage.OrderData
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&page))
+	assert.Len(t, page, 2)
+	cursor := res.Header.Get("X-Next-Cursor")
+	assert.NotEmpty(t, cursor)
+	assert.Contains(t, res.Header.Get("Link"), "cursor="+cursor)
+	assert.Contains(t, res.Header.Get("Link"), `rel="next"`)
+
+	request = httptest.NewRequest(http.MethodGet, "/api/user/orders?sort=asc&cursor="+cursor, nil).WithContext(ctx)
+	mockRepo.EXPECT().GetOrderList(gomock.Any(), "vasya", storage.ListFilter{
+		Ascending: true,
+		Limit:     service.DefaultPageSize + 1,
+		Cursor:    &storage.ListCursor{Time: uploadedAt.Add(time.Hour), ID: "378282246310005"},
+	}).Return(&[]storage.OrderData{orders[0]}, nil)
+	w = httptest.NewRecorder()
+	h.GetOrderList()(w, request)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Link"))
+
+	for _, query := range []string{"status=DONE", "sort=random", "cursor=broken", "limit=5000", "from=yesterday"} {
+		request = httptest.NewRequest(http.MethodGet, "/api/user/orders?"+query, nil).WithContext(ctx)
+		w = httptest.NewRecorder()
+		h.GetOrderList()(w, request)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestHandler_StuckOrders(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
+	r := chi.NewRouter()
+	r.Get("/api/admin/orders/stuck", h.GetStuckOrders())
+	r.Post("/api/admin/orders/{number}/requeue", h.RequeueOrder())
+
+	stuckAt := time.Date(2025, 5, 3, 10, 0, 0, 0, time.UTC)
+	stuckOrders := []storage.StuckOrder{
+		{Number: "378282246310005", Login: "vasya", Attempts: 120, Failures: 100, Reason: "order not registered", StuckAt: stuckAt},
+		{Number: "4111111111111111", Login: "petya", Attempts: 120, Failures: 100, Reason: "order not registered", StuckAt: stuckAt.Add(-time.Hour)},
+	}
+	mockRepo.EXPECT().GetStuckOrders(gomock.Any(), storage.ListFilter{Limit: 2}).Return(stuckOrders, nil)
+	request := httptest.NewRequest(http.MethodGet, "/api/admin/orders/stuck?limit=1", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[{"number":"378282246310005","login":"vasya","attempts":120,"failures":100,"reason":"order not registered",
+		"uploaded_at":"0001-01-01T00:00:00Z","stuck_at":"2025-05-03T10:00:00Z"}]`, w.Body.String())
+	assert.NotEmpty(t, w.Header().Get(nextCursorHeader))
+
+	tests := []struct {
+		name         string
+		number       string
+		err          error
+		responseCode int
+	}{
+		{
+			name:         "stuck order",
+			number:       "378282246310005",
+			responseCode: http.StatusAccepted,
+		},
+		{
+			name:         "order is not stuck",
+			number:       "378282246310005",
+			err:          storage.ErrOrderNotStuck,
+			responseCode: http.StatusConflict,
+		},
+		{
+			name:         "unknown order",
+			number:       "4111111111111111",
+			err:          storage.ErrOrderNotFound,
+			responseCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockRepo.EXPECT().RequeueOrder(gomock.Any(), storage.OrderNumber(tt.number)).Return(tt.err)
+			request := httptest.NewRequest(http.MethodPost, "/api/admin/orders/"+tt.number+"/requeue", nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, request)
+			res := w.Result()
+			res.Body.Close()
+			assert.Equal(t, tt.responseCode, res.StatusCode)
+		})
+	}
+}
+
 func TestHandler_WithdrawPoints(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockRepo := mock_service.NewMockRepository(ctrl)
-	s := service.NewService(mockRepo, true)
-	h := NewHandler(s)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
 
 	type input struct {
 		Order string  `json:"order"`
@@ -228,6 +627,12 @@ func TestHandler_WithdrawPoints(t *testing.T) {
 			login:        "testUser",
 			responseCode: http.StatusPaymentRequired,
 		},
+		{
+			name:         "negative test sum is not positive",
+			input:        input{Order: "378282246310005", Sum: -450.0},
+			login:        "testUser",
+			responseCode: http.StatusUnprocessableEntity,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -237,11 +642,11 @@ func TestHandler_WithdrawPoints(t *testing.T) {
 			request := httptest.NewRequest(http.MethodPost, "/", body).
 				WithContext(context.WithValue(context.Background(), middleware.LoginContextKey{}, tt.login))
 
-			orderInt, err := strconv.Atoi(tt.input.Order)
-			assert.NoError(t, err)
-			if tt.responseCode == http.StatusPaymentRequired {
+			orderInt := storage.OrderNumber(tt.input.Order)
+			switch tt.responseCode {
+			case http.StatusPaymentRequired:
 				mockRepo.EXPECT().WithdrawPoints(request.Context(), tt.login, orderInt, tt.input.Sum).Return(storage.ErrOutOfBalance)
-			} else {
+			case http.StatusOK:
 				mockRepo.EXPECT().WithdrawPoints(request.Context(), tt.login, orderInt, tt.input.Sum).Return(nil)
 			}
 
@@ -259,8 +664,8 @@ func TestHandler_GetUserBalance(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockRepo := mock_service.NewMockRepository(ctrl)
-	s := service.NewService(mockRepo, true)
-	h := NewHandler(s)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
 
 	tests := []struct {
 		name         string
@@ -296,8 +701,8 @@ func TestHandler_GetWithdrawals(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	mockRepo := mock_service.NewMockRepository(ctrl)
-	s := service.NewService(mockRepo, true)
-	h := NewHandler(s)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
 
 	tests := []struct {
 		name         string
@@ -317,7 +722,7 @@ func TestHandler_GetWithdrawals(t *testing.T) {
 			request := httptest.NewRequest(http.MethodGet, "/", body).
 				WithContext(context.WithValue(ctx, middleware.LoginContextKey{}, tt.login))
 
-			mockRepo.EXPECT().GetWithdrawals(request.Context(), tt.login).Return(nil, nil)
+			mockRepo.EXPECT().GetWithdrawals(request.Context(), tt.login, storage.ListFilter{Limit: service.DefaultPageSize + 1}).Return(nil, nil)
 
 			w := httptest.NewRecorder()
 			h.GetWithdrawals()(w, request)
@@ -327,3 +732,1180 @@ func TestHandler_GetWithdrawals(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_RefreshToken(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
+
+	tests := []struct {
+		name         string
+		refreshToken string
+		rotateErr    error
+		responseCode int
+	}{
+		{
+			name:         "positive test #1",
+			refreshToken: "token",
+			responseCode: http.StatusOK,
+		},
+		{
+			name:         "reused token",
+			refreshToken: "token",
+			rotateErr:    storage.ErrRefreshTokenReused,
+			responseCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "no refresh cookie",
+			responseCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tt.refreshToken != "" {
+				request.AddCookie(&http.Cookie{Name: "gophermart_refresh", Value: tt.refreshToken})
+				login := "vasya"
+				if tt.rotateErr != nil {
+					login = ""
+				}
+				mockRepo.EXPECT().RotateRefreshToken(request.Context(), gomock.Not(tt.refreshToken), gomock.Any()).Return(login, "family", tt.rotateErr)
+				if tt.rotateErr == nil {
+					mockRepo.EXPECT().GetUserRole(request.Context(), login).Return(storage.RoleUser, nil)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			h.RefreshToken()(w, request)
+			res := w.Result()
+			res.Body.Close()
+			assert.Equal(t, tt.responseCode, res.StatusCode)
+		})
+	}
+}
+
+func TestHandler_AuthPrecedence(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
+
+	issueToken := func(login string) string {
+		token, err := h.auth.SetAuthCookie(httptest.NewRequest(http.MethodPost, "/", nil), login, storage.RoleUser, "", httptest.NewRecorder())
+		assert.NoError(t, err)
+		return token
+	}
+	vasyaToken := issueToken("vasya")
+	petyaToken := issueToken("petya")
+
+	tests := []struct {
+		name          string
+		authorization string
+		cookie        string
+		responseCode  int
+		login         string
+		source        string
+	}{
+		{
+			name:          "bearer only",
+			authorization: "Bearer " + vasyaToken,
+			responseCode:  http.StatusOK,
+			login:         "vasya",
+			source:        middleware.AuthSourceBearer,
+		},
+		{
+			name:         "cookie only",
+			cookie:       vasyaToken,
+			responseCode: http.StatusOK,
+			login:        "vasya",
+			source:       middleware.AuthSourceCookie,
+		},
+		{
+			name:          "bearer wins over cookie",
+			authorization: "Bearer " + petyaToken,
+			cookie:        vasyaToken,
+			responseCode:  http.StatusOK,
+			login:         "petya",
+			source:        middleware.AuthSourceBearer,
+		},
+		{
+			name:          "invalid bearer is not rescued by cookie",
+			authorization: "Bearer invalid",
+			cookie:        vasyaToken,
+			responseCode:  http.StatusUnauthorized,
+		},
+		{
+			name:          "other scheme falls back to cookie",
+			authorization: "Basic dmFzeWE6MTIz",
+			cookie:        vasyaToken,
+			responseCode:  http.StatusOK,
+			login:         "vasya",
+			source:        middleware.AuthSourceCookie,
+		},
+		{
+			name:         "no credentials",
+			responseCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.authorization != "" {
+				request.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.cookie != "" {
+				request.AddCookie(&http.Cookie{Name: "gophermart_auth", Value: tt.cookie})
+			}
+
+			var login, source string
+			w := httptest.NewRecorder()
+			h.auth.Auth(func(res http.ResponseWriter, req *http.Request) {
+				login = middleware.LoginFromContext(req.Context())
+				source = middleware.AuthSourceFromContext(req.Context())
+			})(w, request)
+			res := w.Result()
+			res.Body.Close()
+			assert.Equal(t, tt.responseCode, res.StatusCode)
+			assert.Equal(t, tt.login, login)
+			assert.Equal(t, tt.source, source)
+		})
+	}
+}
+
+func TestHandler_ChangePassword(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
+
+	type input struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+
+	bcryptHash, err := hasher.NewBcrypt(bcrypt.MinCost).Hash("123")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		input        input
+		lockedUntil  time.Time
+		responseCode int
+	}{
+		{
+			name:         "positive test #1",
+			input:        input{OldPassword: "123", NewPassword: "456"},
+			responseCode: http.StatusOK,
+		},
+		{
+			name:         "wrong old password",
+			input:        input{OldPassword: "000", NewPassword: "456"},
+			responseCode: http.StatusForbidden,
+		},
+		{
+			name:         "locked login",
+			input:        input{OldPassword: "123", NewPassword: "456"},
+			lockedUntil:  time.Now().Add(time.Minute),
+			responseCode: http.StatusTooManyRequests,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := httptest.NewRecorder().Body
+			inputJSON, _ := json.Marshal(&tt.input)
+			body.Write(inputJSON)
+			request := httptest.NewRequest(http.MethodPost, "/", body).
+				WithContext(context.WithValue(context.Background(), middleware.LoginContextKey{}, "vasya"))
+			keys := []string{"login:vasya", "ip:192.0.2.1"}
+
+			mockRepo.EXPECT().LockedUntil(request.Context(), keys).Return(tt.lockedUntil, nil)
+			if tt.responseCode != http.StatusTooManyRequests {
+				mockRepo.EXPECT().GetPasswordHash(request.Context(), "vasya").Return(&bcryptHash, nil)
+			}
+			if tt.responseCode == http.StatusForbidden {
+				mockRepo.EXPECT().RegisterAttempt(request.Context(), keys[0], gomock.Any()).Return(1, nil)
+				mockRepo.EXPECT().RegisterAttempt(request.Context(), keys[1], gomock.Any()).Return(1, nil)
+			}
+			if tt.responseCode == http.StatusOK {
+				mockRepo.EXPECT().ResetAttempts(request.Context(), keys[:1]).Return(nil)
+				mockRepo.EXPECT().ChangePassword(request.Context(), "vasya", gomock.Any()).
+					DoAndReturn(func(_ context.Context, _ string, password storage.PasswordHash) error {
+						isValid, err := hasher.NewBcrypt(bcrypt.MinCost).Compare(password, tt.input.NewPassword)
+						assert.NoError(t, err)
+						assert.True(t, isValid)
+						return nil
+					})
+				mockRepo.EXPECT().SaveRefreshToken(request.Context(), "vasya", gomock.Any()).Return(nil)
+				mockRepo.EXPECT().GetUserRole(request.Context(), "vasya").Return(storage.RoleUser, nil)
+			}
+
+			w := httptest.NewRecorder()
+			h.ChangePassword()(w, request)
+			res := w.Result()
+			res.Body.Close()
+			assert.Equal(t, tt.responseCode, res.StatusCode)
+		})
+	}
+}
+
+func TestHandler_RequestPasswordReset(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	mockNotifier := mock_service.NewMockNotifier(ctrl)
+	s := service.NewService(mockRepo, hasher.NewBcrypt(bcrypt.MinCost), mockNotifier, service.Config{
+		ResetTokenExp: time.Hour,
+		ResetLimit:    service.PasswordResetLimit{LoginMaxRequests: 3, IPMaxRequests: 20, Window: time.Hour},
+	})
+	h := NewHandler(s, newTestAuthenticator(t))
+
+	tests := []struct {
+		name         string
+		login        string
+		saveErr      error
+		requests     int
+		lockedUntil  time.Time
+		responseCode int
+	}{
+		{
+			name:         "positive test #1",
+			login:        "vasya",
+			requests:     1,
+			responseCode: http.StatusAccepted,
+		},
+		{
+			name:         "unknown user is not disclosed",
+			login:        "nobody",
+			saveErr:      storage.ErrUserNotFound,
+			requests:     1,
+			responseCode: http.StatusAccepted,
+		},
+		{
+			name:         "last allowed request limits login",
+			login:        "vasya",
+			requests:     3,
+			responseCode: http.StatusAccepted,
+		},
+		{
+			name:         "limited login",
+			login:        "vasya",
+			lockedUntil:  time.Now().Add(30 * time.Minute),
+			responseCode: http.StatusTooManyRequests,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := httptest.NewRecorder().Body
+			body.WriteString(`{"login":"` + tt.login + `"}`)
+			request := httptest.NewRequest(http.MethodPost, "/", body)
+			keys := []string{"reset:login:" + tt.login, "reset:ip:192.0.2.1"}
+
+			mockRepo.EXPECT().LockedUntil(request.Context(), keys).Return(tt.lockedUntil, nil)
+			if tt.responseCode == http.StatusTooManyRequests {
+				w := httptest.NewRecorder()
+				h.RequestPasswordReset()(w, request)
+				assert.Equal(t, http.StatusTooManyRequests, w.Code)
+				assert.Equal(t, "1800", w.Header().Get("Retry-After"))
+				return
+			}
+			mockRepo.EXPECT().RegisterAttempt(request.Context(), keys[0], gomock.Any()).Return(tt.requests, nil)
+			mockRepo.EXPECT().RegisterAttempt(request.Context(), keys[1], gomock.Any()).Return(tt.requests, nil)
+			if tt.requests >= 3 {
+				mockRepo.EXPECT().LockKey(request.Context(), keys[0], gomock.Any()).Return(nil)
+			}
+
+			var tokenHash string
+			mockRepo.EXPECT().SavePasswordResetToken(request.Context(), tt.login, gomock.Any(), gomock.Any()).
+				DoAndReturn(func(_ context.Context, _, hash string, _ time.Time) error {
+					tokenHash = hash
+					return tt.saveErr
+				})
+			if tt.saveErr == nil {
+				mockNotifier.EXPECT().Notify(request.Context(), tt.login, gomock.Any(), gomock.Any()).
+					DoAndReturn(func(_ context.Context, _, _, message string) error {
+						assert.NotContains(t, message, tokenHash)
+						return nil
+					})
+			}
+
+			w := httptest.NewRecorder()
+			h.RequestPasswordReset()(w, request)
+			res := w.Result()
+			res.Body.Close()
+			assert.Equal(t, tt.responseCode, res.StatusCode)
+		})
+	}
+}
+
+func TestHandler_RegisterNewUserPolicy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := service.NewService(mockRepo, hasher.NewBcrypt(bcrypt.MinCost), notifier.NewLog(), service.Config{
+		RefreshTokenExp: time.Hour,
+		Credentials: service.CredentialsPolicy{
+			LoginMinLength:     3,
+			LoginMaxLength:     16,
+			LoginPattern:       regexp.MustCompile(`^[a-z0-9]+$`),
+			PasswordMinLength:  8,
+			PasswordMaxLength:  hasher.BcryptMaxPasswordBytes,
+			PasswordMinClasses: 2,
+			BannedPasswords:    map[string]struct{}{"password": {}},
+		},
+	})
+	h := NewHandler(s, newTestAuthenticator(t))
+
+	tests := []struct {
+		name         string
+		body         string
+		responseCode int
+		rules        []string
+	}{
+		{
+			name:         "positive test #1",
+			body:         `{"login":"vasya","password":"Secret123"}`,
+			responseCode: http.StatusOK,
+		},
+		{
+			name:         "empty credentials",
+			body:         `{}`,
+			responseCode: http.StatusBadRequest,
+			rules:        []string{"login:required", "password:required"},
+		},
+		{
+			name:         "every violated rule is listed",
+			body:         `{"login":"Va","password":"password"}`,
+			responseCode: http.StatusBadRequest,
+			rules:        []string{"login:min_length", "login:charset", "password:complexity", "password:banned"},
+		},
+		{
+			name:         "password longer than bcrypt accepts",
+			body:         `{"login":"vasya","password":"Secret1` + strings.Repeat("ы", 33) + `"}`,
+			responseCode: http.StatusBadRequest,
+			rules:        []string{"password:max_length"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := httptest.NewRecorder().Body
+			body.WriteString(tt.body)
+			request := httptest.NewRequest(http.MethodPost, "/", body)
+
+			if tt.responseCode == http.StatusOK {
+				mockRepo.EXPECT().SaveNewUser(request.Context(), "vasya", gomock.Any()).Return(nil)
+				mockRepo.EXPECT().SaveRefreshToken(request.Context(), "vasya", gomock.Any()).Return(nil)
+				mockRepo.EXPECT().GetUserRole(request.Context(), "vasya").Return(storage.RoleUser, nil)
+			}
+
+			w := httptest.NewRecorder()
+			h.RegisterNewUser()(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.responseCode, res.StatusCode)
+			if tt.responseCode != http.StatusBadRequest {
+				return
+			}
+			var response struct {
+				Violations []service.PolicyViolation `json:"violations"`
+			}
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(&response))
+			var rules []string
+			for _, violation := range response.Violations {
+				rules = append(rules, violation.Field+":"+violation.Rule)
+			}
+			assert.Equal(t, tt.rules, rules)
+		})
+	}
+}
+
+func TestHandler_RequireRole(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
+
+	tests := []struct {
+		name         string
+		role         string
+		responseCode int
+	}{
+		{
+			name:         "admin",
+			role:         storage.RoleAdmin,
+			responseCode: http.StatusOK,
+		},
+		{
+			name:         "user",
+			role:         storage.RoleUser,
+			responseCode: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := h.auth.SetAuthCookie(httptest.NewRequest(http.MethodPost, "/", nil), "vasya", tt.role, "", httptest.NewRecorder())
+			assert.NoError(t, err)
+
+			body := httptest.NewRecorder().Body
+			body.WriteString(`{"login":"petya","role":"admin"}`)
+			request := httptest.NewRequest(http.MethodPut, "/", body)
+			request.Header.Set("Authorization", "Bearer "+token)
+
+			if tt.responseCode == http.StatusOK {
+				mockRepo.EXPECT().SetUserRole(gomock.Any(), "petya", storage.RoleAdmin).Return(nil)
+			}
+
+			w := httptest.NewRecorder()
+			h.auth.Auth(middleware.RequireRole(h.SetUserRole(), storage.RoleAdmin))(w, request)
+			res := w.Result()
+			res.Body.Close()
+			assert.Equal(t, tt.responseCode, res.StatusCode)
+		})
+	}
+}
+
+func TestHandler_APIKeyAuth(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	keys, err := middleware.NewHMACKeySet("test", []byte("test secret"))
+	assert.NoError(t, err)
+	h := NewHandler(s, middleware.NewAuthenticator(keys, time.Hour, nil, s, nil))
+
+	var keyHash string
+	mockRepo.EXPECT().SaveAPIKey(gomock.Any(), "vasya", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _, hash string, apiKey *storage.APIKey) error {
+			keyHash = hash
+			apiKey.ID = 1
+			return nil
+		})
+	body := httptest.NewRecorder().Body
+	body.WriteString(`{"name":"ci","scopes":["balance:read"]}`)
+	request := httptest.NewRequest(http.MethodPost, "/", body)
+	request = request.WithContext(context.WithValue(request.Context(), middleware.LoginContextKey{}, "vasya"))
+	w := httptest.NewRecorder()
+	h.CreateAPIKey()(w, request)
+	res := w.Result()
+	var created struct {
+		ID     int      `json:"id"`
+		Key    string   `json:"key"`
+		Prefix string   `json:"prefix"`
+		Scopes []string `json:"scopes"`
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&created))
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, []string{storage.ScopeBalanceRead}, created.Scopes)
+	assert.Regexp(t, regexp.MustCompile(`^gm_`), created.Key)
+	assert.Equal(t, created.Key[:len(created.Prefix)], created.Prefix)
+	assert.NotEqual(t, created.Key, keyHash)
+
+	tests := []struct {
+		name         string
+		key          string
+		handler      http.HandlerFunc
+		responseCode int
+	}{
+		{
+			name:         "scope granted",
+			key:          created.Key,
+			handler:      h.auth.Auth(h.GetUserBalance(), storage.ScopeBalanceRead),
+			responseCode: http.StatusOK,
+		},
+		{
+			name:         "scope missing",
+			key:          created.Key,
+			handler:      h.auth.Auth(h.WithdrawPoints(), storage.ScopeBalanceWrite),
+			responseCode: http.StatusForbidden,
+		},
+		{
+			name:         "endpoint without scopes",
+			key:          created.Key,
+			handler:      h.auth.Auth(h.GetAPIKeys()),
+			responseCode: http.StatusForbidden,
+		},
+		{
+			name:         "unknown key",
+			key:          "gm_unknown",
+			handler:      h.auth.Auth(h.GetUserBalance(), storage.ScopeBalanceRead),
+			responseCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.key == created.Key {
+				mockRepo.EXPECT().UseAPIKey(gomock.Any(), keyHash, gomock.Any(), gomock.Any()).Return("vasya", []string{storage.ScopeBalanceRead}, nil)
+			} else {
+				mockRepo.EXPECT().UseAPIKey(gomock.Any(), gomock.Not(keyHash), gomock.Any(), gomock.Any()).Return("", nil, storage.ErrAPIKeyNotFound)
+			}
+			if tt.responseCode == http.StatusOK {
+				mockRepo.EXPECT().GetUserBalance(gomock.Any(), "vasya").Return(&storage.UserBalance{}, nil)
+			}
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.Header.Set("X-API-Key", tt.key)
+			w := httptest.NewRecorder()
+			tt.handler(w, request)
+			res := w.Result()
+			res.Body.Close()
+			assert.Equal(t, tt.responseCode, res.StatusCode)
+		})
+	}
+}
+
+func TestHandler_LoginTOTP(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
+
+	secret, err := totp.GenerateSecret()
+	assert.NoError(t, err)
+	bcryptHash, err := hasher.NewBcrypt(bcrypt.MinCost).Hash("123")
+	assert.NoError(t, err)
+	enabled := &storage.TOTP{Secret: secret, Enabled: true}
+	keys := []string{"login:vasiliy", "ip:192.0.2.1"}
+
+	body := httptest.NewRecorder().Body
+	body.WriteString(`{"login":"vasiliy","password":"123"}`)
+	request := httptest.NewRequest(http.MethodPost, "/", body)
+	mockRepo.EXPECT().LockedUntil(request.Context(), keys).Return(time.Time{}, nil)
+	mockRepo.EXPECT().GetPasswordHash(request.Context(), "vasiliy").Return(&bcryptHash, nil)
+	mockRepo.EXPECT().ResetAttempts(request.Context(), keys[:1]).Return(nil)
+	mockRepo.EXPECT().GetTOTP(request.Context(), "vasiliy").Return(enabled, nil)
+	w := httptest.NewRecorder()
+	h.LoginUser()(w, request)
+	res := w.Result()
+	var challenge mfaChallengeResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&challenge))
+	res.Body.Close()
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	assert.True(t, challenge.MFARequired)
+	assert.Empty(t, res.Cookies())
+
+	// токен первого шага не даёт доступа к API
+	request = httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Authorization", "Bearer "+challenge.MFAToken)
+	w = httptest.NewRecorder()
+	h.auth.Auth(h.GetUserBalance())(w, request)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	assert.NoError(t, err)
+	tests := []struct {
+		name         string
+		code         string
+		responseCode int
+	}{
+		{
+			name:         "valid code",
+			code:         code,
+			responseCode: http.StatusOK,
+		},
+		{
+			name:         "reused code",
+			code:         code,
+			responseCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := httptest.NewRecorder().Body
+			body.WriteString(`{"mfa_token":"` + challenge.MFAToken + `","code":"` + tt.code + `"}`)
+			request := httptest.NewRequest(http.MethodPost, "/", body)
+			keys := []string{"otp:vasiliy", "ip:192.0.2.1"}
+
+			mockRepo.EXPECT().LockedUntil(request.Context(), keys).Return(time.Time{}, nil)
+			mockRepo.EXPECT().GetTOTP(request.Context(), "vasiliy").Return(enabled, nil)
+			if tt.responseCode == http.StatusOK {
+				mockRepo.EXPECT().UseTOTPStep(request.Context(), "vasiliy", gomock.Any()).Return(nil)
+				mockRepo.EXPECT().ResetAttempts(request.Context(), keys[:1]).Return(nil)
+				mockRepo.EXPECT().SaveRefreshToken(request.Context(), "vasiliy", gomock.Any()).Return(nil)
+				mockRepo.EXPECT().GetUserRole(request.Context(), "vasiliy").Return(storage.RoleUser, nil)
+			} else {
+				mockRepo.EXPECT().UseTOTPStep(request.Context(), "vasiliy", gomock.Any()).Return(storage.ErrTOTPCodeUsed)
+				mockRepo.EXPECT().RegisterAttempt(request.Context(), keys[0], gomock.Any()).Return(1, nil)
+				mockRepo.EXPECT().RegisterAttempt(request.Context(), keys[1], gomock.Any()).Return(1, nil)
+			}
+
+			w := httptest.NewRecorder()
+			h.LoginTOTP()(w, request)
+			res := w.Result()
+			res.Body.Close()
+			assert.Equal(t, tt.responseCode, res.StatusCode)
+		})
+	}
+}
+
+// expectMemoryAttempts подменяет счётчики попыток репозитория счётчиками в памяти,
+// чтобы проверять блокировки на последовательности запросов
+func expectMemoryAttempts(mockRepo *mock_service.MockRepository) {
+	failures := make(map[string]int)
+	lockedUntil := make(map[string]time.Time)
+	mockRepo.EXPECT().LockedUntil(gomock.Any(), gomock.Any()).AnyTimes().
+		DoAndReturn(func(_ context.Context, keys []string) (time.Time, error) {
+			var result time.Time
+			for _, key := range keys {
+				if lockedUntil[key].After(result) {
+					result = lockedUntil[key]
+				}
+			}
+			return result, nil
+		})
+	mockRepo.EXPECT().RegisterAttempt(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().
+		DoAndReturn(func(_ context.Context, key string, _ time.Time) (int, error) {
+			failures[key]++
+			return failures[key], nil
+		})
+	mockRepo.EXPECT().LockKey(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().
+		DoAndReturn(func(_ context.Context, key string, until time.Time) error {
+			lockedUntil[key] = until
+			return nil
+		})
+	mockRepo.EXPECT().ResetAttempts(gomock.Any(), gomock.Any()).AnyTimes().
+		DoAndReturn(func(_ context.Context, keys []string) error {
+			for _, key := range keys {
+				delete(failures, key)
+				delete(lockedUntil, key)
+			}
+			return nil
+		})
+}
+
+func TestHandler_LoginTOTPLockout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
+
+	secret, err := totp.GenerateSecret()
+	assert.NoError(t, err)
+	bcryptHash, err := hasher.NewBcrypt(bcrypt.MinCost).Hash("123")
+	assert.NoError(t, err)
+	expectMemoryAttempts(mockRepo)
+	mockRepo.EXPECT().GetPasswordHash(gomock.Any(), "vasiliy").Return(&bcryptHash, nil).AnyTimes()
+	mockRepo.EXPECT().GetTOTP(gomock.Any(), "vasiliy").Return(&storage.TOTP{Secret: secret, Enabled: true}, nil).AnyTimes()
+	mockRepo.EXPECT().UseRecoveryCode(gomock.Any(), "vasiliy", gomock.Any()).Return(storage.ErrRecoveryCodeInvalid).AnyTimes()
+
+	// верный пароль перед каждой попыткой не сбрасывает счётчик неверных кодов
+	for i := 0; i < 4; i++ {
+		body := httptest.NewRecorder().Body
+		body.WriteString(`{"login":"vasiliy","password":"123"}`)
+		w := httptest.NewRecorder()
+		h.LoginUser()(w, httptest.NewRequest(http.MethodPost, "/", body))
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		var challenge mfaChallengeResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&challenge))
+
+		body = httptest.NewRecorder().Body
+		body.WriteString(`{"mfa_token":"` + challenge.MFAToken + `","code":"00000-00000"}`)
+		w = httptest.NewRecorder()
+		h.LoginTOTP()(w, httptest.NewRequest(http.MethodPost, "/", body))
+		if i < 3 {
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		} else {
+			assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		}
+	}
+}
+
+func TestHandler_WithdrawPointsStepUp(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
+
+	secret, err := totp.GenerateSecret()
+	assert.NoError(t, err)
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		balance      float64
+		totp         *storage.TOTP
+		code         string
+		responseCode int
+	}{
+		{
+			name:         "out of balance is checked before code",
+			balance:      100,
+			code:         "000000",
+			responseCode: http.StatusPaymentRequired,
+		},
+		{
+			name:         "totp not enrolled",
+			responseCode: http.StatusForbidden,
+		},
+		{
+			name:         "code missing",
+			totp:         &storage.TOTP{Secret: secret, Enabled: true},
+			responseCode: http.StatusForbidden,
+		},
+		{
+			name:         "valid code",
+			totp:         &storage.TOTP{Secret: secret, Enabled: true},
+			code:         code,
+			responseCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := httptest.NewRecorder().Body
+			body.WriteString(`{"order":"378282246310005","sum":1500}`)
+			request := httptest.NewRequest(http.MethodPost, "/", body).
+				WithContext(context.WithValue(context.Background(), middleware.LoginContextKey{}, "vasya"))
+			request.Header.Set("X-OTP-Code", tt.code)
+
+			balance := tt.balance
+			if balance == 0 {
+				balance = 2000
+			}
+			mockRepo.EXPECT().GetUserBalance(request.Context(), "vasya").Return(&storage.UserBalance{Current: balance}, nil)
+			switch {
+			case tt.responseCode == http.StatusPaymentRequired:
+				// код не проверяется и не тратится
+			case tt.totp == nil:
+				mockRepo.EXPECT().GetTOTP(request.Context(), "vasya").Return(nil, storage.ErrTOTPNotFound)
+			default:
+				mockRepo.EXPECT().GetTOTP(request.Context(), "vasya").Return(tt.totp, nil)
+			}
+			if tt.responseCode == http.StatusOK {
+				// неверные коды подтверждения не блокируют вход
+				mockRepo.EXPECT().LockedUntil(request.Context(), []string{"stepup:vasya"}).Return(time.Time{}, nil)
+				mockRepo.EXPECT().GetTOTP(request.Context(), "vasya").Return(tt.totp, nil)
+				mockRepo.EXPECT().UseTOTPStep(request.Context(), "vasya", gomock.Any()).Return(nil)
+				mockRepo.EXPECT().ResetAttempts(request.Context(), []string{"stepup:vasya"}).Return(nil)
+				mockRepo.EXPECT().WithdrawPoints(request.Context(), "vasya", storage.OrderNumber("378282246310005"), 1500.0).Return(nil)
+			}
+
+			w := httptest.NewRecorder()
+			h.WithdrawPoints()(w, request)
+			res := w.Result()
+			res.Body.Close()
+			assert.Equal(t, tt.responseCode, res.StatusCode)
+		})
+	}
+}
+
+func TestHandler_IdempotentWithdraw(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
+	withdraw := middleware.NewIdempotency(s).Handle(h.WithdrawPoints())
+
+	newRequest := func(body string) *http.Request {
+		request := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", bytes.NewBufferString(body)).
+			WithContext(context.WithValue(context.Background(), middleware.LoginContextKey{}, "vasya"))
+		request.Header.Set(middleware.IdempotencyKeyHeader, "key-1")
+		return request
+	}
+	body := `{"order": "378282246310005", "sum": 100}`
+
+	var fingerprint string
+	mockRepo.EXPECT().StartIdempotentRequest(gomock.Any(), "vasya", "key-1", gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _, _, requestFingerprint string, _, _ time.Time) (*storage.IdempotentResponse, error) {
+			fingerprint = requestFingerprint
+			return nil, nil
+		})
+	mockRepo.EXPECT().WithdrawPoints(gomock.Any(), "vasya", storage.OrderNumber("378282246310005"), 100.0).Return(nil)
+	var saved storage.IdempotentResponse
+	mockRepo.EXPECT().SaveIdempotentResponse(gomock.Any(), "vasya", "key-1", gomock.Any()).
+		DoAndReturn(func(_ context.Context, _, _ string, response storage.IdempotentResponse) error {
+			saved = response
+			return nil
+		})
+	w := httptest.NewRecorder()
+	withdraw(w, newRequest(body))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusOK, saved.StatusCode)
+
+	// повтор получает сохранённый ответ, списание не выполняется
+	mockRepo.EXPECT().StartIdempotentRequest(gomock.Any(), "vasya", "key-1", gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _, _, requestFingerprint string, _, _ time.Time) (*storage.IdempotentResponse, error) {
+			assert.Equal(t, fingerprint, requestFingerprint)
+			return &saved, nil
+		})
+	w = httptest.NewRecorder()
+	withdraw(w, newRequest(body))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+
+	mockRepo.EXPECT().StartIdempotentRequest(gomock.Any(), "vasya", "key-1", gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _, _, requestFingerprint string, _, _ time.Time) (*storage.IdempotentResponse, error) {
+			assert.NotEqual(t, fingerprint, requestFingerprint)
+			return nil, storage.ErrIdempotencyKeyMismatch
+		})
+	w = httptest.NewRecorder()
+	withdraw(w, newRequest(`{"order": "378282246310005", "sum": 200}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// ошибка сервера освобождает ключ
+	mockRepo.EXPECT().StartIdempotentRequest(gomock.Any(), "vasya", "key-1", gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, nil)
+	mockRepo.EXPECT().WithdrawPoints(gomock.Any(), "vasya", storage.OrderNumber("378282246310005"), 100.0).Return(errors.New("connection reset"))
+	mockRepo.EXPECT().DeleteIdempotencyKey(gomock.Any(), "vasya", "key-1").Return(nil)
+	w = httptest.NewRecorder()
+	withdraw(w, newRequest(body))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestHandler_Sessions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	keys, err := middleware.NewHMACKeySet("test", []byte("test secret"))
+	assert.NoError(t, err)
+	h := NewHandler(s, middleware.NewAuthenticator(keys, time.Hour, nil, nil, s))
+
+	loginRequest := httptest.NewRequest(http.MethodPost, "/", nil)
+	loginRequest.Header.Set("User-Agent", "test-agent")
+	mockRepo.EXPECT().SaveSession(loginRequest.Context(), "vasya", gomock.Any()).
+		DoAndReturn(func(_ context.Context, _ string, session storage.Session) error {
+			assert.Equal(t, "s1", session.ID)
+			assert.Equal(t, "test-agent", session.UserAgent)
+			assert.Equal(t, "192.0.2.1", session.IP)
+			return nil
+		})
+	token, err := h.auth.SetAuthCookie(loginRequest, "vasya", storage.RoleUser, "s1", httptest.NewRecorder())
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		active       bool
+		responseCode int
+	}{
+		{
+			name:         "active session",
+			active:       true,
+			responseCode: http.StatusOK,
+		},
+		{
+			name:         "revoked session",
+			responseCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.Header.Set("Authorization", "Bearer "+token)
+
+			mockRepo.EXPECT().TouchSession(request.Context(), "s1", "vasya", gomock.Any(), gomock.Any()).
+				DoAndReturn(func(_ context.Context, _, _ string, lastSeenAt, touchBefore time.Time) (bool, error) {
+					// активность пишется не чаще раза в минуту
+					assert.Equal(t, time.Minute, lastSeenAt.Sub(touchBefore))
+					return tt.active, nil
+				})
+			if tt.responseCode == http.StatusOK {
+				mockRepo.EXPECT().GetSessions(gomock.Any(), "vasya").Return([]storage.Session{{ID: "s1"}, {ID: "s2"}}, nil)
+			}
+
+			w := httptest.NewRecorder()
+			h.auth.Auth(h.GetSessions())(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.responseCode, res.StatusCode)
+			if tt.responseCode == http.StatusOK {
+				var sessions []storage.Session
+				assert.NoError(t, json.NewDecoder(res.Body).Decode(&sessions))
+				assert.Len(t, sessions, 2)
+				assert.True(t, sessions[0].Current)
+				assert.False(t, sessions[1].Current)
+			}
+		})
+	}
+}
+
+func TestHandler_ExportUserData(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
+
+	export := &storage.UserExport{
+		Profile:         storage.UserProfile{Login: "vasya", Role: storage.RoleUser},
+		Orders:          []storage.ExportOrder{{Number: "378282246310005"}},
+		HistoryStatuses: []storage.ExportStatus{{Order: "378282246310005", Status: "NEW"}},
+		OrdersPoints:    []storage.ExportPointsMovement{{Order: "378282246310005", FlowIn: true, Points: 100}},
+	}
+
+	tests := []struct {
+		name        string
+		url         string
+		contentType string
+	}{
+		{
+			name:        "json",
+			url:         "/api/user/export",
+			contentType: "application/json",
+		},
+		{
+			name:        "zip",
+			url:         "/api/user/export?format=zip",
+			contentType: "application/zip",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.url, nil).
+				WithContext(context.WithValue(context.Background(), middleware.LoginContextKey{}, "vasya"))
+			mockRepo.EXPECT().ExportUserData(request.Context(), "vasya").Return(export, nil)
+
+			w := httptest.NewRecorder()
+			h.ExportUserData()(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.Equal(t, tt.contentType, res.Header.Get("content-type"))
+
+			if tt.contentType == "application/json" {
+				var got storage.UserExport
+				assert.NoError(t, json.NewDecoder(res.Body).Decode(&got))
+				assert.Equal(t, export.Profile, got.Profile)
+				assert.Equal(t, export.OrdersPoints, got.OrdersPoints)
+				return
+			}
+			archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+			assert.NoError(t, err)
+			var names []string
+			for _, file := range archive.File {
+				names = append(names, file.Name)
+			}
+			assert.Equal(t, []string{"profile.json", "orders.json", "history_statuses.json", "orders_points.json"}, names)
+		})
+	}
+}
+
+func TestHandler_DeleteUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
+
+	bcryptHash, err := hasher.NewBcrypt(bcrypt.MinCost).Hash("secret")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		password     string
+		lockedUntil  time.Time
+		responseCode int
+	}{
+		{
+			name:         "wrong password",
+			password:     "wrong",
+			responseCode: http.StatusForbidden,
+		},
+		{
+			name:         "locked login",
+			password:     "secret",
+			lockedUntil:  time.Now().Add(time.Minute),
+			responseCode: http.StatusTooManyRequests,
+		},
+		{
+			name:         "deleted",
+			password:     "secret",
+			responseCode: http.StatusNoContent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := httptest.NewRecorder().Body
+			body.WriteString(`{"password":"` + tt.password + `"}`)
+			request := httptest.NewRequest(http.MethodDelete, "/", body).
+				WithContext(context.WithValue(context.Background(), middleware.LoginContextKey{}, "vasya"))
+			keys := []string{"login:vasya", "ip:192.0.2.1"}
+
+			mockRepo.EXPECT().LockedUntil(request.Context(), keys).Return(tt.lockedUntil, nil)
+			if tt.responseCode != http.StatusTooManyRequests {
+				mockRepo.EXPECT().GetPasswordHash(request.Context(), "vasya").Return(&bcryptHash, nil)
+			}
+			if tt.responseCode == http.StatusForbidden {
+				mockRepo.EXPECT().RegisterAttempt(request.Context(), keys[0], gomock.Any()).Return(1, nil)
+				mockRepo.EXPECT().RegisterAttempt(request.Context(), keys[1], gomock.Any()).Return(1, nil)
+			}
+			if tt.responseCode == http.StatusNoContent {
+				mockRepo.EXPECT().ResetAttempts(request.Context(), keys[:1]).Return(nil)
+				mockRepo.EXPECT().AnonymizeUser(request.Context(), "vasya", gomock.Not("vasya")).Return(nil)
+			}
+
+			w := httptest.NewRecorder()
+			h.DeleteUser()(w, request)
+			res := w.Result()
+			res.Body.Close()
+			assert.Equal(t, tt.responseCode, res.StatusCode)
+		})
+	}
+}
+
+func TestHandler_DeleteUserWithoutPassword(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+	s := newTestService(mockRepo)
+	h := NewHandler(s, newTestAuthenticator(t))
+
+	tests := []struct {
+		name              string
+		otpCode           string
+		reauthenticatedAt time.Time
+		reauthErr         error
+		responseCode      int
+	}{
+		{
+			name:         "no linked identity",
+			reauthErr:    storage.ErrIdentityNotFound,
+			responseCode: http.StatusForbidden,
+		},
+		{
+			name:         "no reauthentication",
+			responseCode: http.StatusForbidden,
+		},
+		{
+			name:              "stale reauthentication",
+			reauthenticatedAt: time.Now().Add(-time.Hour),
+			responseCode:      http.StatusForbidden,
+		},
+		{
+			name:              "fresh reauthentication",
+			reauthenticatedAt: time.Now().Add(-time.Minute),
+			responseCode:      http.StatusNoContent,
+		},
+		{
+			name:         "recovery code",
+			otpCode:      "abcde-12345",
+			responseCode: http.StatusNoContent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodDelete, "/", bytes.NewBufferString(`{}`)).
+				WithContext(context.WithValue(context.Background(), middleware.LoginContextKey{}, "vasya"))
+			if tt.otpCode != "" {
+				request.Header.Set(otpHeader, tt.otpCode)
+			}
+
+			mockRepo.EXPECT().TakeReauthentication(request.Context(), "vasya").Return(tt.reauthenticatedAt, tt.reauthErr)
+			if tt.otpCode != "" {
+				mockRepo.EXPECT().LockedUntil(request.Context(), []string{"stepup:vasya"}).Return(time.Time{}, nil)
+				mockRepo.EXPECT().GetTOTP(request.Context(), "vasya").Return(&storage.TOTP{Enabled: true}, nil)
+				mockRepo.EXPECT().UseRecoveryCode(request.Context(), "vasya", gomock.Any()).Return(nil)
+				mockRepo.EXPECT().ResetAttempts(request.Context(), []string{"stepup:vasya"}).Return(nil)
+			}
+			if tt.responseCode == http.StatusNoContent {
+				mockRepo.EXPECT().AnonymizeUser(request.Context(), "vasya", gomock.Not("vasya")).Return(nil)
+			}
+
+			w := httptest.NewRecorder()
+			h.DeleteUser()(w, request)
+			assert.Equal(t, tt.responseCode, w.Code)
+		})
+	}
+}
+
+func TestHandler_OIDCLogin(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRepo := mock_service.NewMockRepository(ctrl)
+
+	idp, err := oidctest.NewServer("gophermart")
+	assert.NoError(t, err)
+	defer idp.Close()
+	idp.Subject = "42"
+	idp.PreferredUsername = "vasya"
+	provider, err := oidc.NewProvider(context.Background(), oidc.Config{
+		Issuer:      idp.URL,
+		ClientID:    "gophermart",
+		RedirectURL: "http://localhost/api/user/oidc/callback",
+	})
+	assert.NoError(t, err)
+	s := service.NewService(mockRepo, hasher.NewBcrypt(bcrypt.MinCost), notifier.NewLog(), service.Config{
+		RefreshTokenExp:  time.Hour,
+		IdentityProvider: provider,
+	})
+	h := NewHandler(s, newTestAuthenticator(t))
+
+	var savedState storage.OIDCState
+	mockRepo.EXPECT().SaveOIDCState(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _ string, state storage.OIDCState) error {
+			savedState = state
+			return nil
+		})
+	w := httptest.NewRecorder()
+	h.OIDCLogin()(w, httptest.NewRequest(http.MethodGet, "/api/user/oidc/login", nil))
+	res := w.Result()
+	res.Body.Close()
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+	stateCookies := res.Cookies()
+	assert.Len(t, stateCookies, 1)
+
+	// провайдер сразу возвращает пользователя на callback с кодом
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	idpRes, err := client.Get(res.Header.Get("Location"))
+	assert.NoError(t, err)
+	idpRes.Body.Close()
+	callbackURL := idpRes.Header.Get("Location")
+
+	t.Run("state mismatch", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.OIDCCallback()(w, httptest.NewRequest(http.MethodGet, callbackURL, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("new user", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, callbackURL, nil)
+		request.AddCookie(stateCookies[0])
+
+		mockRepo.EXPECT().TakeOIDCState(request.Context(), gomock.Any()).Return(&savedState, nil)
+		mockRepo.EXPECT().GetLoginByIdentity(request.Context(), idp.URL, "42").Return("", storage.ErrUserNotFound)
+		mockRepo.EXPECT().SaveNewUserWithIdentity(request.Context(), "vasya", gomock.Any(), idp.URL, "42").Return(nil)
+		mockRepo.EXPECT().GetTOTP(request.Context(), "vasya").Return(nil, storage.ErrTOTPNotFound)
+		mockRepo.EXPECT().SaveRefreshToken(request.Context(), "vasya", gomock.Any()).Return(nil)
+		mockRepo.EXPECT().GetUserRole(request.Context(), "vasya").Return(storage.RoleUser, nil)
+
+		w := httptest.NewRecorder()
+		h.OIDCCallback()(w, request)
+		res := w.Result()
+		var tokens tokenResponse
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&tokens))
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.NotEmpty(t, tokens.AccessToken)
+	})
+
+	t.Run("reauth", func(t *testing.T) {
+		for identityLogin, responseCode := range map[string]int{"vasya": http.StatusOK, "petya": http.StatusForbidden} {
+			idpRes, err := client.Get(res.Header.Get("Location"))
+			assert.NoError(t, err)
+			idpRes.Body.Close()
+			request := httptest.NewRequest(http.MethodGet, idpRes.Header.Get("Location"), nil)
+			request.AddCookie(stateCookies[0])
+			reauthState := savedState
+			reauthState.LinkLogin = "vasya"
+			reauthState.Reauth = true
+
+			mockRepo.EXPECT().TakeOIDCState(request.Context(), gomock.Any()).Return(&reauthState, nil)
+			mockRepo.EXPECT().GetLoginByIdentity(request.Context(), idp.URL, "42").Return(identityLogin, nil)
+			if responseCode == http.StatusOK {
+				mockRepo.EXPECT().SaveReauthentication(request.Context(), idp.URL, "42", gomock.Any()).Return(nil)
+			}
+
+			w := httptest.NewRecorder()
+			h.OIDCCallback()(w, request)
+			assert.Equal(t, responseCode, w.Code, identityLogin)
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nasik90/gophermart/internal/app/service"
+)
+
+// nextCursorHeader - курсор следующей страницы, дублирует ссылку rel="next" в заголовке Link
+const nextCursorHeader = "X-Next-Cursor"
+
+// listParamsFromRequest читает параметры списка из query:
+// status (через запятую или повторением), from и to в RFC 3339, sort (desc или asc), limit и cursor.
+func listParamsFromRequest(req *http.Request) (service.ListParams, error) {
+	query := req.URL.Query()
+	params := service.ListParams{
+		Sort:   query.Get("sort"),
+		Cursor: query.Get("cursor"),
+	}
+	for _, value := range query["status"] {
+		for _, status := range strings.Split(value, ",") {
+			if status = strings.TrimSpace(status); status != "" {
+				params.Statuses = append(params.Statuses, strings.ToUpper(status))
+			}
+		}
+	}
+	var err error
+	if from := query.Get("from"); from != "" {
+		if params.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return params, fmt.Errorf("from: %w", err)
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		if params.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return params, fmt.Errorf("to: %w", err)
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if params.Limit, err = strconv.Atoi(limit); err != nil {
+			return params, fmt.Errorf("limit: %w", err)
+		}
+	}
+	return params, nil
+}
+
+// writeNextPage добавляет в ответ ссылку на следующую страницу с теми же параметрами
+func writeNextPage(req *http.Request, nextCursor string, res http.ResponseWriter) {
+	if nextCursor == "" {
+		return
+	}
+	next := *req.URL
+	query := next.Query()
+	query.Set("cursor", nextCursor)
+	next.RawQuery = query.Encode()
+	res.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+	res.Header().Set(nextCursorHeader, nextCursor)
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/nasik90/gophermart/internal/app/logger"
+	middleware "github.com/nasik90/gophermart/internal/app/middlewares"
+	"github.com/nasik90/gophermart/internal/app/oidc"
+	"github.com/nasik90/gophermart/internal/app/service"
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	oidcStateCookieName = "gophermart_oidc_state"
+	oidcStateCookiePath = "/api/user/oidc"
+	oidcStateCookieAge  = 600
+)
+
+// OIDCLogin перенаправляет пользователя на вход к внешнему провайдеру.
+func (h *Handler) OIDCLogin() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		h.startOIDC(res, req, "")
+	}
+}
+
+// OIDCLink перенаправляет вошедшего пользователя к провайдеру, чтобы привязать внешнюю учётную запись.
+func (h *Handler) OIDCLink() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		h.startOIDC(res, req, middleware.LoginFromContext(req.Context()))
+	}
+}
+
+// OIDCReauth перенаправляет вошедшего пользователя к провайдеру, чтобы повторно подтвердить вход
+// перед удалением учётной записи без пароля.
+func (h *Handler) OIDCReauth() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		authURL, state, err := h.service.StartOIDCReauth(req.Context(), middleware.LoginFromContext(req.Context()))
+		h.redirectToProvider(res, req, authURL, state, err)
+	}
+}
+
+func (h *Handler) startOIDC(res http.ResponseWriter, req *http.Request, linkLogin string) {
+	authURL, state, err := h.service.StartOIDCLogin(req.Context(), linkLogin)
+	h.redirectToProvider(res, req, authURL, state, err)
+}
+
+func (h *Handler) redirectToProvider(res http.ResponseWriter, req *http.Request, authURL, state string, err error) {
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, service.ErrOIDCDisabled) {
+			status = http.StatusNotFound
+		}
+		http.Error(res, err.Error(), status)
+		return
+	}
+	// state дополнительно хранится в cookie, чтобы завершить вход мог только тот браузер, который его начал
+	http.SetCookie(res, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     oidcStateCookiePath,
+		MaxAge:   oidcStateCookieAge,
+		HttpOnly: true,
+		Secure:   h.auth.CookieOptions().Secure,
+		// Strict не подходит: cookie должна прийти при возврате с сайта провайдера
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(res, req, authURL, http.StatusFound)
+}
+
+// OIDCCallback принимает пользователя, вернувшегося от провайдера, и выдаёт ему пару токенов.
+func (h *Handler) OIDCCallback() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		query := req.URL.Query()
+		if providerError := query.Get("error"); providerError != "" {
+			http.Error(res, providerError, http.StatusUnauthorized)
+			return
+		}
+		state := query.Get("state")
+		stateCookie, err := req.Cookie(oidcStateCookieName)
+		if err != nil || state == "" || stateCookie.Value != state {
+			http.Error(res, "oidc state mismatch", http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(res, &http.Cookie{Name: oidcStateCookieName, Path: oidcStateCookiePath, MaxAge: -1})
+
+		login, linked, err := h.service.FinishOIDCLogin(ctx, state, query.Get("code"))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, storage.ErrOIDCStateInvalid) || errors.Is(err, oidc.ErrInvalidIDToken) {
+				status = http.StatusUnauthorized
+			} else if errors.Is(err, storage.ErrIdentityLinked) {
+				status = http.StatusConflict
+			} else if errors.Is(err, service.ErrReauthIdentityMismatch) {
+				status = http.StatusForbidden
+			} else if errors.Is(err, service.ErrOIDCDisabled) {
+				status = http.StatusNotFound
+			} else {
+				logger.Log.Error("finish oidc login", zap.String("error", err.Error()))
+			}
+			http.Error(res, err.Error(), status)
+			return
+		}
+		if linked {
+			res.Header().Set("content-type", "text/plain")
+			res.WriteHeader(http.StatusOK)
+			return
+		}
+		totpEnabled, err := h.service.TOTPEnabled(ctx, login)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if totpEnabled {
+			h.writeMFAChallenge(login, res)
+			return
+		}
+		h.writeTokens(req, login, res)
+	}
+}
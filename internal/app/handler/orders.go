@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+
+	"github.com/nasik90/gophermart/internal/app/logger"
+	middleware "github.com/nasik90/gophermart/internal/app/middlewares"
+	"github.com/nasik90/gophermart/internal/app/service"
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"go.uber.org/zap"
+)
+
+// maxOrderBatchBody - ограничение размера тела пакетной загрузки заказов
+const maxOrderBatchBody = 1 << 20
+
+// LoadOrders загружает пакет заказов. Тело - JSON-массив номеров или текст с номером на каждой строке.
+// В ответе для каждого номера указан результат загрузки.
+func (h *Handler) LoadOrders() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		numbers, err := readOrderNumbers(res, req)
+		var maxBytesErr *http.MaxBytesError
+		if errors.Is(err, service.ErrOrderBatchTooLarge) || errors.As(err, &maxBytesErr) {
+			http.Error(res, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		login := middleware.LoginFromContext(ctx)
+		result, err := h.service.LoadOrders(ctx, numbers, login)
+		if err != nil {
+			switch {
+			case errors.Is(err, service.ErrEmptyOrderBatch):
+				http.Error(res, err.Error(), http.StatusBadRequest)
+			case errors.Is(err, service.ErrOrderBatchTooLarge):
+				http.Error(res, err.Error(), http.StatusRequestEntityTooLarge)
+			default:
+				logger.Log.Error("load order batch", zap.String("error", err.Error()))
+				http.Error(res, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		resJSON, err := json.Marshal(result)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.Header().Set("content-type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		res.Write(resJSON)
+	}
+}
+
+// readOrderNumbers читает номера из тела запроса. Пакет больше service.MaxOrderBatchSize
+// отклоняется при чтении, не дожидаясь конца тела.
+func readOrderNumbers(res http.ResponseWriter, req *http.Request) ([]string, error) {
+	body := http.MaxBytesReader(res, req.Body, maxOrderBatchBody)
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		decoder := json.NewDecoder(body)
+		decoder.UseNumber()
+		if token, err := decoder.Token(); err != nil {
+			return nil, err
+		} else if token != json.Delim('[') {
+			return nil, fmt.Errorf("expected JSON array, got %v", token)
+		}
+		var numbers []string
+		for decoder.More() {
+			if len(numbers) == service.MaxOrderBatchSize {
+				return nil, service.ErrOrderBatchTooLarge
+			}
+			var item interface{}
+			if err := decoder.Decode(&item); err != nil {
+				return nil, err
+			}
+			switch value := item.(type) {
+			case string:
+				numbers = append(numbers, strings.TrimSpace(value))
+			case json.Number:
+				numbers = append(numbers, value.String())
+			default:
+				// неверный номер попадёт в ответ с результатом invalid_format
+				numbers = append(numbers, fmt.Sprint(value))
+			}
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		return numbers, nil
+	}
+
+	var numbers []string
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		if number := strings.TrimSpace(scanner.Text()); number != "" {
+			if len(numbers) == service.MaxOrderBatchSize {
+				return nil, service.ErrOrderBatchTooLarge
+			}
+			numbers = append(numbers, number)
+		}
+	}
+	return numbers, scanner.Err()
+}
+
+// GetOrder возвращает заказ пользователя с текущим статусом, начислением и историей статусов
+func (h *Handler) GetOrder() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		login := middleware.LoginFromContext(ctx)
+		order, err := h.service.GetOrder(ctx, login, chi.URLParam(req, "number"))
+		if err != nil {
+			switch {
+			case errors.Is(err, storage.ErrOrderNotFound):
+				http.Error(res, err.Error(), http.StatusNotFound)
+			case errors.Is(err, service.ErrOrderAccessDenied):
+				http.Error(res, err.Error(), http.StatusForbidden)
+			default:
+				logger.Log.Error("get order", zap.String("error", err.Error()))
+				http.Error(res, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		resJSON, err := json.Marshal(order)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.Header().Set("content-type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		res.Write(resJSON)
+	}
+}
+
+// GetStuckOrders возвращает администратору заказы, которые система начислений так и не обработала
+func (h *Handler) GetStuckOrders() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		params, err := listParamsFromRequest(req)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		orders, nextCursor, err := h.service.GetStuckOrders(ctx, params)
+		if errors.Is(err, service.ErrInvalidListParams) {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logger.Log.Error("get stuck orders", zap.String("error", err.Error()))
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(orders) == 0 {
+			res.WriteHeader(http.StatusNoContent)
+			return
+		}
+		resJSON, err := json.Marshal(orders)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeNextPage(req, nextCursor, res)
+		res.Header().Set("content-type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		res.Write(resJSON)
+	}
+}
+
+// RequeueOrder возвращает заказ из статуса STUCK в очередь опроса системы начислений
+func (h *Handler) RequeueOrder() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		if err := h.service.RequeueOrder(ctx, chi.URLParam(req, "number")); err != nil {
+			switch {
+			case errors.Is(err, storage.ErrOrderNotFound):
+				http.Error(res, err.Error(), http.StatusNotFound)
+			case errors.Is(err, storage.ErrOrderNotStuck):
+				http.Error(res, err.Error(), http.StatusConflict)
+			default:
+				logger.Log.Error("requeue order", zap.String("error", err.Error()))
+				http.Error(res, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		res.Header().Set("content-type", "text/plain")
+		res.WriteHeader(http.StatusAccepted)
+	}
+}
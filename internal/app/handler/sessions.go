@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/nasik90/gophermart/internal/app/logger"
+	middleware "github.com/nasik90/gophermart/internal/app/middlewares"
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"go.uber.org/zap"
+)
+
+// GetSessions возвращает действующие сессии пользователя, текущая помечена current.
+func (h *Handler) GetSessions() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		login := middleware.LoginFromContext(ctx)
+		sessions, err := h.service.GetSessions(ctx, login)
+		if err != nil {
+			logger.Log.Error("get sessions", zap.String("error", err.Error()))
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(sessions) == 0 {
+			res.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if claims := middleware.ClaimsFromContext(ctx); claims != nil {
+			for i := range sessions {
+				sessions[i].Current = sessions[i].ID == claims.SessionID
+			}
+		}
+		resJSON, err := json.Marshal(sessions)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.Header().Set("content-type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		res.Write(resJSON)
+	}
+}
+
+// RevokeSession завершает сессию, например на потерянном устройстве.
+func (h *Handler) RevokeSession() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		login := middleware.LoginFromContext(ctx)
+		if err := h.service.RevokeSession(ctx, login, chi.URLParam(req, "id")); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, storage.ErrSessionNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(res, err.Error(), status)
+			return
+		}
+		res.WriteHeader(http.StatusNoContent)
+	}
+}
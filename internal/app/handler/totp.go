@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	middleware "github.com/nasik90/gophermart/internal/app/middlewares"
+	"github.com/nasik90/gophermart/internal/app/service"
+	"github.com/nasik90/gophermart/internal/app/storage"
+)
+
+// otpHeader - заголовок с кодом второго фактора для операций, требующих подтверждения
+const otpHeader = "X-OTP-Code"
+
+type mfaChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// writeMFAChallenge отвечает 202 с токеном для второго шага входа вместо пары токенов.
+func (h *Handler) writeMFAChallenge(login string, res http.ResponseWriter) {
+	token, exp, err := h.auth.BuildMFAToken(login)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resJSON, err := json.Marshal(mfaChallengeResponse{MFARequired: true, MFAToken: token, ExpiresIn: int(exp.Seconds())})
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("content-type", "application/json")
+	res.WriteHeader(http.StatusAccepted)
+	res.Write(resJSON)
+}
+
+// LoginTOTP - второй шаг входа: обменивает токен первого шага и код второго фактора на пару токенов.
+func (h *Handler) LoginTOTP() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		var input struct {
+			MFAToken string `json:"mfa_token"`
+			Code     string `json:"code"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		login, err := h.auth.ParseMFAToken(input.MFAToken)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		err = h.service.VerifyLoginOTP(ctx, login, input.Code, middleware.ClientIP(req))
+		if writeLoginLocked(res, err) {
+			return
+		}
+		if errors.Is(err, service.ErrInvalidOTP) {
+			http.Error(res, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.writeTokens(req, login, res)
+	}
+}
+
+// EnrollTOTP выдаёт секрет, otpauth-ссылку и коды восстановления.
+func (h *Handler) EnrollTOTP() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		login := middleware.LoginFromContext(ctx)
+		enrollment, err := h.service.EnrollTOTP(ctx, login)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, service.ErrTOTPAlreadyEnabled) {
+				status = http.StatusConflict
+			}
+			http.Error(res, err.Error(), status)
+			return
+		}
+		resJSON, err := json.Marshal(enrollment)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.Header().Set("content-type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		res.Write(resJSON)
+	}
+}
+
+// ConfirmTOTP включает второй фактор после ввода первого кода из приложения.
+func (h *Handler) ConfirmTOTP() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		code, ok := decodeOTPCode(res, req)
+		if !ok {
+			return
+		}
+		login := middleware.LoginFromContext(ctx)
+		if err := h.service.ConfirmTOTP(ctx, login, code); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, service.ErrInvalidOTP) {
+				status = http.StatusForbidden
+			} else if errors.Is(err, storage.ErrTOTPNotFound) || errors.Is(err, service.ErrTOTPAlreadyEnabled) {
+				status = http.StatusConflict
+			}
+			http.Error(res, err.Error(), status)
+			return
+		}
+		res.Header().Set("content-type", "text/plain")
+		res.WriteHeader(http.StatusOK)
+	}
+}
+
+// DisableTOTP отключает второй фактор по коду из приложения или коду восстановления.
+func (h *Handler) DisableTOTP() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		code, ok := decodeOTPCode(res, req)
+		if !ok {
+			return
+		}
+		login := middleware.LoginFromContext(ctx)
+		err := h.service.DisableTOTP(ctx, login, code)
+		if writeLoginLocked(res, err) {
+			return
+		}
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, service.ErrInvalidOTP) {
+				status = http.StatusForbidden
+			}
+			http.Error(res, err.Error(), status)
+			return
+		}
+		res.Header().Set("content-type", "text/plain")
+		res.WriteHeader(http.StatusOK)
+	}
+}
+
+func decodeOTPCode(res http.ResponseWriter, req *http.Request) (string, bool) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	if input.Code == "" {
+		http.Error(res, "code is required", http.StatusBadRequest)
+		return "", false
+	}
+	return input.Code, true
+}
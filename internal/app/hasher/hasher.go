@@ -0,0 +1,152 @@
+package hasher
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// AlgorithmPlain - пароль хранится в открытом виде (записи, созданные до введения хеширования)
+	AlgorithmPlain    = "plain"
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+)
+
+// BcryptMaxPasswordBytes - bcrypt не принимает пароли длиннее 72 байт
+const BcryptMaxPasswordBytes = 72
+
+var (
+	ErrUnknownAlgorithm = errors.New("unknown password hash algorithm")
+	ErrInvalidParams    = errors.New("invalid password hash params")
+)
+
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+func DefaultArgon2Params() Argon2Params {
+	return Argon2Params{Time: 1, Memory: 64 * 1024, Threads: 4, KeyLen: 32, SaltLen: 16}
+}
+
+// Hasher хеширует новые пароли выбранным алгоритмом и умеет проверять пароли,
+// захешированные любым из поддерживаемых алгоритмов.
+type Hasher struct {
+	algorithm  string
+	bcryptCost int
+	argon2     Argon2Params
+}
+
+func New(algorithm string, bcryptCost int, argon2Params Argon2Params) (*Hasher, error) {
+	switch algorithm {
+	case AlgorithmBcrypt:
+		if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost %d: %w", bcryptCost, ErrInvalidParams)
+		}
+	case AlgorithmArgon2id:
+		if argon2Params.Time == 0 || argon2Params.Memory == 0 || argon2Params.Threads == 0 ||
+			argon2Params.KeyLen == 0 || argon2Params.SaltLen == 0 {
+			return nil, fmt.Errorf("argon2id: %w", ErrInvalidParams)
+		}
+	default:
+		return nil, fmt.Errorf("%s: %w", algorithm, ErrUnknownAlgorithm)
+	}
+	return &Hasher{algorithm: algorithm, bcryptCost: bcryptCost, argon2: argon2Params}, nil
+}
+
+func NewBcrypt(cost int) *Hasher {
+	return &Hasher{algorithm: AlgorithmBcrypt, bcryptCost: cost}
+}
+
+func NewArgon2id(params Argon2Params) *Hasher {
+	return &Hasher{algorithm: AlgorithmArgon2id, argon2: params}
+}
+
+func (h *Hasher) Hash(password string) (storage.PasswordHash, error) {
+	result := storage.PasswordHash{Algorithm: h.algorithm, Params: h.params()}
+	switch h.algorithm {
+	case AlgorithmBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost)
+		if err != nil {
+			return result, err
+		}
+		result.Hash = string(hash)
+	case AlgorithmArgon2id:
+		salt := make([]byte, h.argon2.SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return result, err
+		}
+		key := argon2.IDKey([]byte(password), salt, h.argon2.Time, h.argon2.Memory, h.argon2.Threads, h.argon2.KeyLen)
+		result.Hash = base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key)
+	default:
+		return result, ErrUnknownAlgorithm
+	}
+	return result, nil
+}
+
+func (h *Hasher) Compare(hash storage.PasswordHash, password string) (bool, error) {
+	switch hash.Algorithm {
+	case AlgorithmPlain:
+		return subtle.ConstantTimeCompare([]byte(hash.Hash), []byte(password)) == 1, nil
+	case AlgorithmBcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(hash.Hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case AlgorithmArgon2id:
+		params, err := parseArgon2Params(hash.Params)
+		if err != nil {
+			return false, err
+		}
+		saltString, keyString, ok := strings.Cut(hash.Hash, "$")
+		if !ok {
+			return false, ErrInvalidParams
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(saltString)
+		if err != nil {
+			return false, err
+		}
+		key, err := base64.RawStdEncoding.DecodeString(keyString)
+		if err != nil {
+			return false, err
+		}
+		otherKey := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+	}
+	return false, fmt.Errorf("%s: %w", hash.Algorithm, ErrUnknownAlgorithm)
+}
+
+// NeedsRehash возвращает true, если хеш получен не текущим алгоритмом или с другими параметрами.
+func (h *Hasher) NeedsRehash(hash storage.PasswordHash) bool {
+	return hash.Algorithm != h.algorithm || hash.Params != h.params()
+}
+
+func (h *Hasher) params() string {
+	switch h.algorithm {
+	case AlgorithmBcrypt:
+		return fmt.Sprintf("cost=%d", h.bcryptCost)
+	case AlgorithmArgon2id:
+		return fmt.Sprintf("t=%d,m=%d,p=%d", h.argon2.Time, h.argon2.Memory, h.argon2.Threads)
+	}
+	return ""
+}
+
+func parseArgon2Params(params string) (Argon2Params, error) {
+	var result Argon2Params
+	if _, err := fmt.Sscanf(params, "t=%d,m=%d,p=%d", &result.Time, &result.Memory, &result.Threads); err != nil {
+		return result, errors.Join(ErrInvalidParams, err)
+	}
+	return result, nil
+}
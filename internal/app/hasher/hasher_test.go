@@ -0,0 +1,53 @@
+package hasher
+
+import (
+	"testing"
+
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHasher_HashAndCompare(t *testing.T) {
+	argon2Params := Argon2Params{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16}
+	tests := []struct {
+		name   string
+		hasher *Hasher
+	}{
+		{name: "bcrypt", hasher: NewBcrypt(bcrypt.MinCost)},
+		{name: "argon2id", hasher: NewArgon2id(argon2Params)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := tt.hasher.Hash("secret")
+			assert.NoError(t, err)
+			assert.NotEqual(t, "secret", hash.Hash)
+			assert.False(t, tt.hasher.NeedsRehash(hash))
+
+			isValid, err := tt.hasher.Compare(hash, "secret")
+			assert.NoError(t, err)
+			assert.True(t, isValid)
+
+			isValid, err = tt.hasher.Compare(hash, "wrong")
+			assert.NoError(t, err)
+			assert.False(t, isValid)
+		})
+	}
+}
+
+func TestHasher_NeedsRehash(t *testing.T) {
+	h := NewBcrypt(bcrypt.MinCost)
+	plain := storage.PasswordHash{Hash: "secret", Algorithm: AlgorithmPlain}
+
+	isValid, err := h.Compare(plain, "secret")
+	assert.NoError(t, err)
+	assert.True(t, isValid)
+	assert.True(t, h.NeedsRehash(plain))
+
+	oldCost, err := NewBcrypt(bcrypt.MinCost + 1).Hash("secret")
+	assert.NoError(t, err)
+	assert.True(t, h.NeedsRehash(oldCost))
+
+	_, err = h.Compare(storage.PasswordHash{Algorithm: "md5"}, "secret")
+	assert.ErrorIs(t, err, ErrUnknownAlgorithm)
+}
@@ -2,100 +2,358 @@ package middleware
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/nasik90/gophermart/internal/app/logger"
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"go.uber.org/zap"
 )
 
 const (
-	tokenExp   = time.Hour * 3000
-	secretKey  = "supersecretkey"
-	cookieName = "gophermart_auth"
+	AuthSourceCookie = "cookie"
+	AuthSourceBearer = "bearer"
+	AuthSourceAPIKey = "api_key"
 )
 
+const (
+	bearerPrefix      = "Bearer "
+	cookieName        = "gophermart_auth"
+	refreshCookieName = "gophermart_refresh"
+	refreshCookiePath = "/api/user"
+	apiKeyHeader      = "X-API-Key"
+	// PurposeMFA - назначение токена, выдаваемого после пароля и до ввода кода второго фактора
+	PurposeMFA  = "mfa"
+	mfaTokenExp = 5 * time.Minute
+)
+
+var ErrWrongTokenPurpose = errors.New("token is not valid for this purpose")
+
 type Claims struct {
 	jwt.RegisteredClaims
 	UserID string
+	Role   string
+	// SessionID - сессия, в которой выпущен токен
+	SessionID string `json:"sid,omitempty"`
+	// Purpose задан у токенов промежуточных шагов, по ним нельзя обращаться к API
+	Purpose string `json:",omitempty"`
 }
 
 type LoginContextKey struct{}
 
-func SetAuthCookie(login string, res http.ResponseWriter) error {
-	JWT, err := buildJWTString(login)
+type ClaimsContextKey struct{}
+
+// AuthSourceContextKey - ключ контекста, по которому хранится способ передачи токена: cookie или заголовок.
+type AuthSourceContextKey struct{}
+
+// RevocationChecker сообщает, отозван ли access-токен: по jti или вместе со всеми
+// токенами пользователя, выпущенными до issuedAt (например, после смены пароля).
+type RevocationChecker interface {
+	TokenIsRevoked(ctx context.Context, jti, login string, issuedAt time.Time) (bool, error)
+}
+
+// ScopesContextKey - ключ контекста, по которому хранятся разрешения API-ключа.
+type ScopesContextKey struct{}
+
+// APIKeyChecker возвращает владельца API-ключа и разрешения ключа.
+type APIKeyChecker interface {
+	AuthenticateAPIKey(ctx context.Context, key string) (string, []string, error)
+}
+
+// SessionStore сохраняет сведения о сессиях и сообщает, не завершена ли сессия.
+type SessionStore interface {
+	SaveSession(ctx context.Context, login string, session storage.Session) error
+	SessionIsActive(ctx context.Context, id, login string) (bool, error)
+}
+
+type Authenticator struct {
+	keys     *KeySet
+	tokenExp time.Duration
+	revoked  RevocationChecker
+	apiKeys  APIKeyChecker
+	sessions SessionStore
+	cookies  CookieOptions
+}
+
+func NewAuthenticator(keys *KeySet, tokenExp time.Duration, revoked RevocationChecker, apiKeys APIKeyChecker, sessions SessionStore) *Authenticator {
+	return &Authenticator{
+		keys:     keys,
+		tokenExp: tokenExp,
+		revoked:  revoked,
+		apiKeys:  apiKeys,
+		sessions: sessions,
+		cookies:  DefaultCookieOptions(),
+	}
+}
+
+// SetAuthCookie выпускает access-токен сессии sessionID, отдаёт его в cookie и заголовке Authorization
+// и возвращает его для передачи в теле ответа. Клиент, получивший токен, запоминается в сессии.
+func (a *Authenticator) SetAuthCookie(req *http.Request, login, role, sessionID string, res http.ResponseWriter) (string, error) {
+	if a.sessions != nil && sessionID != "" {
+		err := a.sessions.SaveSession(req.Context(), login, storage.Session{
+			ID:        sessionID,
+			UserAgent: req.UserAgent(),
+			IP:        ClientIP(req),
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	JWT, err := a.buildJWTString(login, role, sessionID)
 	if err != nil {
-		return err
+		return "", err
 	}
-	var authCookieOut http.Cookie
-	authCookieOut.Name = cookieName
-	authCookieOut.Value = JWT
-	http.SetCookie(res, &authCookieOut)
-	return nil
+	csrfToken, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(res, a.newCookie(cookieName, JWT, "", a.tokenExp))
+	// cookie с CSRF-токеном должна читаться скриптом клиента, поэтому без HttpOnly
+	csrfCookie := a.newCookie(csrfCookieName, csrfToken, "", a.tokenExp)
+	csrfCookie.HttpOnly = false
+	http.SetCookie(res, csrfCookie)
+	res.Header().Set("Authorization", bearerPrefix+JWT)
+	return JWT, nil
+}
+
+func (a *Authenticator) TokenExp() time.Duration {
+	return a.tokenExp
+}
+
+// SetRefreshCookie отдаёт refresh-токен в cookie, которая отправляется только на эндпоинты /api/user.
+func (a *Authenticator) SetRefreshCookie(token string, res http.ResponseWriter) {
+	refreshCookie := a.newCookie(refreshCookieName, token, refreshCookiePath, a.cookies.RefreshTokenExp)
+	// refresh-токен никогда не должен быть доступен скриптам
+	refreshCookie.HttpOnly = true
+	http.SetCookie(res, refreshCookie)
+}
+
+// ClearAuthCookies удаляет у клиента cookie с access-, refresh- и CSRF-токенами.
+func (a *Authenticator) ClearAuthCookies(res http.ResponseWriter) {
+	http.SetCookie(res, a.expiredCookie(cookieName, ""))
+	http.SetCookie(res, a.expiredCookie(csrfCookieName, ""))
+	http.SetCookie(res, a.expiredCookie(refreshCookieName, refreshCookiePath))
+}
+
+func RefreshTokenFromRequest(req *http.Request) string {
+	refreshCookie, err := req.Cookie(refreshCookieName)
+	if err != nil {
+		return ""
+	}
+	return refreshCookie.Value
 }
 
-// BuildJWTString создаёт токен и возвращает его в виде строки.
-func buildJWTString(login string) (string, error) {
-	// создаём новый токен с алгоритмом подписи HS256 и утверждениями — Claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+// BuildMFAToken выпускает короткоживущий токен, который подтверждает, что пароль уже проверен,
+// и обменивается на access-токен после ввода кода второго фактора.
+func (a *Authenticator) BuildMFAToken(login string) (string, time.Duration, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", 0, err
+	}
+	now := time.Now()
+	token, err := a.keys.sign(Claims{
 		RegisteredClaims: jwt.RegisteredClaims{
-			// когда создан токен
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(tokenExp)),
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(mfaTokenExp)),
 		},
-		UserID: login,
+		UserID:  login,
+		Purpose: PurposeMFA,
 	})
+	return token, mfaTokenExp, err
+}
 
-	// создаём строку токена
-	tokenString, err := token.SignedString([]byte(secretKey))
+// ParseMFAToken проверяет токен, выпущенный BuildMFAToken, и возвращает логин.
+func (a *Authenticator) ParseMFAToken(tokenString string) (string, error) {
+	claims, err := a.getClaims(tokenString)
 	if err != nil {
 		return "", err
 	}
+	if claims.Purpose != PurposeMFA || claims.UserID == "" {
+		return "", ErrWrongTokenPurpose
+	}
+	return claims.UserID, nil
+}
 
-	// возвращаем строку токена
-	return tokenString, nil
+// BuildJWTString создаёт токен, подписанный текущим ключом, и возвращает его в виде строки.
+func (a *Authenticator) buildJWTString(login, role, sessionID string) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return a.keys.sign(Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       jti,
+			IssuedAt: jwt.NewNumericDate(now),
+			// когда истекает токен
+			ExpiresAt: jwt.NewNumericDate(now.Add(a.tokenExp)),
+		},
+		UserID:    login,
+		Role:      role,
+		SessionID: sessionID,
+	})
 }
 
-func Auth(h http.HandlerFunc) http.HandlerFunc {
+// Auth пропускает запросы с действующим access-токеном. Запросы с API-ключом
+// пропускаются, только если у ключа есть все разрешения scopes; если scopes
+// не указаны, эндпоинт недоступен по API-ключу.
+func (a *Authenticator) Auth(h http.HandlerFunc, scopes ...string) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
-		var login = ""
-		authCookieIn, err := req.Cookie(cookieName)
+		if key := req.Header.Get(apiKeyHeader); key != "" && !strings.HasPrefix(req.Header.Get("Authorization"), bearerPrefix) {
+			a.authAPIKey(h, key, scopes, res, req)
+			return
+		}
+		tokenString, source, err := tokenFromRequest(req)
+		var claims *Claims
 		if err == nil {
-			login, err = getLogin(authCookieIn.Value)
+			claims, err = a.getClaims(tokenString)
 		}
 		if err != nil {
 			res.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		if login == "" {
+		if claims.UserID == "" || claims.Purpose != "" {
 			res.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		ctx := context.WithValue(req.Context(), LoginContextKey{}, login)
+		if a.revoked != nil {
+			var issuedAt time.Time
+			if claims.IssuedAt != nil {
+				issuedAt = claims.IssuedAt.Time
+			}
+			isRevoked, err := a.revoked.TokenIsRevoked(req.Context(), claims.ID, claims.UserID, issuedAt)
+			if err != nil {
+				logger.Log.Error("check token revocation", zap.String("error", err.Error()))
+				res.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if isRevoked {
+				res.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		if a.sessions != nil && claims.SessionID != "" {
+			isActive, err := a.sessions.SessionIsActive(req.Context(), claims.SessionID, claims.UserID)
+			if err != nil {
+				logger.Log.Error("check session", zap.String("error", err.Error()))
+				res.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !isActive {
+				res.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		ctx := context.WithValue(req.Context(), LoginContextKey{}, claims.UserID)
+		ctx = context.WithValue(ctx, ClaimsContextKey{}, claims)
+		ctx = context.WithValue(ctx, AuthSourceContextKey{}, source)
 		req = req.WithContext(ctx)
 		h.ServeHTTP(res, req)
 	}
 }
 
-func getLogin(tokenString string) (string, error) {
-	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims,
-		func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+func (a *Authenticator) authAPIKey(h http.HandlerFunc, key string, scopes []string, res http.ResponseWriter, req *http.Request) {
+	if a.apiKeys == nil {
+		res.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	login, keyScopes, err := a.apiKeys.AuthenticateAPIKey(req.Context(), key)
+	if errors.Is(err, storage.ErrAPIKeyNotFound) {
+		res.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logger.Log.Error("check api key", zap.String("error", err.Error()))
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(scopes) == 0 || !hasScopes(keyScopes, scopes) {
+		res.WriteHeader(http.StatusForbidden)
+		return
+	}
+	ctx := context.WithValue(req.Context(), LoginContextKey{}, login)
+	ctx = context.WithValue(ctx, ClaimsContextKey{}, &Claims{UserID: login})
+	ctx = context.WithValue(ctx, AuthSourceContextKey{}, AuthSourceAPIKey)
+	ctx = context.WithValue(ctx, ScopesContextKey{}, keyScopes)
+	req = req.WithContext(ctx)
+	h.ServeHTTP(res, req)
+}
+
+func hasScopes(granted, required []string) bool {
+	for _, scope := range required {
+		found := false
+		for _, g := range granted {
+			if g == scope {
+				found = true
+				break
 			}
-			return []byte(secretKey), nil
-		})
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenFromRequest достаёт токен из заголовка Authorization: Bearer, а если его нет - из cookie.
+// Заголовок имеет приоритет: при невалидном Bearer-токене cookie не проверяется.
+func tokenFromRequest(req *http.Request) (string, string, error) {
+	if authorization := req.Header.Get("Authorization"); strings.HasPrefix(authorization, bearerPrefix) {
+		return strings.TrimSpace(strings.TrimPrefix(authorization, bearerPrefix)), AuthSourceBearer, nil
+	}
+	authCookieIn, err := req.Cookie(cookieName)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	return authCookieIn.Value, AuthSourceCookie, nil
+}
+
+// getClaims проверяет токен ключом, указанным в заголовке kid, поэтому токены,
+// выпущенные до ротации, остаются действительными, пока ключ есть в наборе.
+func (a *Authenticator) getClaims(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, a.keys.keyFunc)
+	if err != nil {
+		return nil, err
 	}
 
 	if !token.Valid {
-		return "", fmt.Errorf("token is not valid")
+		return nil, fmt.Errorf("token is not valid")
 	}
 
-	return claims.UserID, nil
+	return claims, nil
+}
+
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 func LoginFromContext(ctx context.Context) string {
 	return ctx.Value(LoginContextKey{}).(string)
 }
+
+func AuthSourceFromContext(ctx context.Context) string {
+	source, _ := ctx.Value(AuthSourceContextKey{}).(string)
+	return source
+}
+
+func ClaimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(ClaimsContextKey{}).(*Claims)
+	return claims
+}
+
+func ScopesFromContext(ctx context.Context) []string {
+	scopes, _ := ctx.Value(ScopesContextKey{}).([]string)
+	return scopes
+}
@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticator_KeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	secret := base64.StdEncoding.EncodeToString([]byte("old secret"))
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+	keyPath := filepath.Join(dir, "ed25519.pem")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	writeKeys := func(current string) string {
+		path := filepath.Join(dir, current+".json")
+		content := fmt.Sprintf(`{"current": %q, "keys": [
+			{"kid": "old", "alg": "HS256", "secret": %q},
+			{"kid": "new", "alg": "EdDSA", "private_key_file": %q}]}`, current, secret, keyPath)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	oldKeys, err := LoadKeySet(writeKeys("old"))
+	require.NoError(t, err)
+	oldToken, err := NewAuthenticator(oldKeys, time.Hour, nil, nil, nil).buildJWTString("vasya", "user", "")
+	require.NoError(t, err)
+
+	newKeys, err := LoadKeySet(writeKeys("new"))
+	require.NoError(t, err)
+	auth := NewAuthenticator(newKeys, time.Hour, nil, nil, nil)
+	newToken, err := auth.buildJWTString("petya", "admin", "")
+	require.NoError(t, err)
+
+	claims, err := auth.getClaims(oldToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "vasya", claims.UserID)
+
+	claims, err = auth.getClaims(newToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "petya", claims.UserID)
+	assert.Equal(t, "admin", claims.Role)
+
+	otherKeys, err := NewHMACKeySet("old", []byte("another secret"))
+	require.NoError(t, err)
+	_, err = NewAuthenticator(otherKeys, time.Hour, nil, nil, nil).getClaims(newToken)
+	assert.ErrorIs(t, err, ErrUnknownKeyID)
+}
+
+func TestAuthenticator_CookieOptions(t *testing.T) {
+	keys, err := NewHMACKeySet("test", []byte("test secret"))
+	require.NoError(t, err)
+	auth := NewAuthenticator(keys, time.Hour, nil, nil, nil)
+	assert.Error(t, auth.SetCookieOptions(CookieOptions{SameSite: http.SameSiteNoneMode}))
+	require.NoError(t, auth.SetCookieOptions(CookieOptions{
+		Path:            "/",
+		HttpOnly:        true,
+		Secure:          true,
+		SameSite:        http.SameSiteStrictMode,
+		Persistent:      true,
+		RefreshTokenExp: 24 * time.Hour,
+	}))
+
+	w := httptest.NewRecorder()
+	_, err = auth.SetAuthCookie(httptest.NewRequest(http.MethodPost, "/", nil), "vasya", "user", "", w)
+	require.NoError(t, err)
+	auth.SetRefreshCookie("refresh", w)
+	cookies := make(map[string]*http.Cookie)
+	for _, cookie := range w.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+
+	authCookie := cookies[cookieName]
+	require.NotNil(t, authCookie)
+	assert.True(t, authCookie.HttpOnly)
+	assert.True(t, authCookie.Secure)
+	assert.Equal(t, http.SameSiteStrictMode, authCookie.SameSite)
+	assert.Equal(t, "/", authCookie.Path)
+	assert.Equal(t, 3600, authCookie.MaxAge)
+
+	csrfCookie := cookies[csrfCookieName]
+	require.NotNil(t, csrfCookie)
+	assert.False(t, csrfCookie.HttpOnly)
+	assert.NotEmpty(t, csrfCookie.Value)
+
+	refreshCookie := cookies[refreshCookieName]
+	require.NotNil(t, refreshCookie)
+	assert.Equal(t, refreshCookiePath, refreshCookie.Path)
+	assert.Equal(t, 24*3600, refreshCookie.MaxAge)
+}
+
+func TestCSRF(t *testing.T) {
+	keys, err := NewHMACKeySet("test", []byte("test secret"))
+	require.NoError(t, err)
+	auth := NewAuthenticator(keys, time.Hour, nil, nil, nil)
+	w := httptest.NewRecorder()
+	token, err := auth.SetAuthCookie(httptest.NewRequest(http.MethodPost, "/", nil), "vasya", "user", "", w)
+	require.NoError(t, err)
+	cookies := w.Result().Cookies()
+	var csrfToken string
+	for _, cookie := range cookies {
+		if cookie.Name == csrfCookieName {
+			csrfToken = cookie.Value
+		}
+	}
+
+	ok := func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusOK)
+	}
+	tests := []struct {
+		name         string
+		method       string
+		bearer       bool
+		csrfHeader   string
+		responseCode int
+	}{
+		{name: "cookie without csrf header", method: http.MethodPost, responseCode: http.StatusForbidden},
+		{name: "cookie with wrong csrf header", method: http.MethodPost, csrfHeader: "wrong", responseCode: http.StatusForbidden},
+		{name: "cookie with csrf header", method: http.MethodPost, csrfHeader: csrfToken, responseCode: http.StatusOK},
+		{name: "cookie safe method", method: http.MethodGet, responseCode: http.StatusOK},
+		{name: "bearer without csrf header", method: http.MethodPost, bearer: true, responseCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, "/", nil)
+			if tt.bearer {
+				request.Header.Set("Authorization", bearerPrefix+token)
+			} else {
+				for _, cookie := range cookies {
+					request.AddCookie(cookie)
+				}
+			}
+			if tt.csrfHeader != "" {
+				request.Header.Set(CSRFHeader, tt.csrfHeader)
+			}
+			w := httptest.NewRecorder()
+			auth.Auth(CSRF(ok))(w, request)
+			assert.Equal(t, tt.responseCode, w.Code)
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := NewTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	require.NoError(t, err)
+	_, err = NewTrustedProxies([]string{"proxy.local"})
+	assert.Error(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		clientIP   string
+	}{
+		{name: "direct client", remoteAddr: "203.0.113.5:1234", forwarded: "198.51.100.1", clientIP: "203.0.113.5"},
+		{name: "trusted proxy", remoteAddr: "192.0.2.1:1234", forwarded: "198.51.100.1", clientIP: "198.51.100.1"},
+		{name: "proxy chain", remoteAddr: "10.0.0.2:1234", forwarded: "198.51.100.7, 198.51.100.1, 10.0.0.3", clientIP: "198.51.100.1"},
+		{name: "trusted proxy without header", remoteAddr: "10.0.0.2:1234", clientIP: "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/", nil)
+			request.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				request.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			var clientIP string
+			proxies.Handle(func(res http.ResponseWriter, req *http.Request) {
+				clientIP = ClientIP(req)
+			})(httptest.NewRecorder(), request)
+			assert.Equal(t, tt.clientIP, clientIP)
+		})
+	}
+}
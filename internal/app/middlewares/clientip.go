@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIPContextKey - ключ контекста, по которому хранится адрес клиента, определённый TrustedProxies.
+type ClientIPContextKey struct{}
+
+// TrustedProxies определяет адрес клиента по X-Forwarded-For, если запрос пришёл от доверенного прокси.
+// Без доверенных прокси адресом клиента считается адрес соединения, и за обратным прокси
+// все клиенты получают один адрес: блокировку входа по IP в этом случае нужно отключить.
+type TrustedProxies struct {
+	networks []*net.IPNet
+}
+
+// NewTrustedProxies разбирает список доверенных прокси: адреса или подсети в нотации CIDR.
+func NewTrustedProxies(proxies []string) (*TrustedProxies, error) {
+	t := &TrustedProxies{}
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q: invalid address", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			t.networks = append(t.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", proxy, err)
+		}
+		t.networks = append(t.networks, network)
+	}
+	return t, nil
+}
+
+// Handle сохраняет в контексте адрес клиента. X-Forwarded-For читается справа налево,
+// пока адреса принадлежат доверенным прокси: первый недоверенный адрес и есть клиент.
+func (t *TrustedProxies) Handle(h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		ip := remoteIP(req)
+		if t.trusted(ip) {
+			forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+			for i := len(forwarded) - 1; i >= 0 && t.trusted(ip); i-- {
+				hop := strings.TrimSpace(forwarded[i])
+				if net.ParseIP(hop) == nil {
+					break
+				}
+				ip = hop
+			}
+		}
+		h(res, req.WithContext(context.WithValue(req.Context(), ClientIPContextKey{}, ip)))
+	}
+}
+
+func (t *TrustedProxies) trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range t.networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP возвращает адрес клиента, определённый TrustedProxies, а без него - адрес соединения.
+// Заголовки прокси без настроенных доверенных прокси не учитываются, чтобы клиент не мог подменить адрес.
+func ClientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(ClientIPContextKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(req)
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
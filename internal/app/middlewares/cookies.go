@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CookieOptions - атрибуты cookie с токенами.
+type CookieOptions struct {
+	Path     string
+	Domain   string
+	HttpOnly bool
+	Secure   bool
+	SameSite http.SameSite
+	// Persistent - задавать Expires и Max-Age по сроку жизни токена, иначе cookie живёт до закрытия браузера
+	Persistent bool
+	// RefreshTokenExp - срок жизни cookie с refresh-токеном при Persistent
+	RefreshTokenExp time.Duration
+}
+
+func DefaultCookieOptions() CookieOptions {
+	return CookieOptions{
+		Path:       "/",
+		HttpOnly:   true,
+		SameSite:   http.SameSiteLaxMode,
+		Persistent: true,
+	}
+}
+
+// ParseSameSite разбирает значение атрибута SameSite: lax, strict, none или default.
+func ParseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	case "", "default":
+		return http.SameSiteDefaultMode, nil
+	}
+	return 0, fmt.Errorf("unknown SameSite value %q", value)
+}
+
+// SetCookieOptions задаёт атрибуты cookie. Браузеры не принимают SameSite=None без Secure.
+func (a *Authenticator) SetCookieOptions(options CookieOptions) error {
+	if options.SameSite == http.SameSiteNoneMode && !options.Secure {
+		return fmt.Errorf("SameSite=None requires Secure cookies")
+	}
+	a.cookies = options
+	return nil
+}
+
+func (a *Authenticator) CookieOptions() CookieOptions {
+	return a.cookies
+}
+
+// newCookie создаёт cookie с настроенными атрибутами. Если path пустой, используется настроенный путь.
+// Cookie получает срок жизни exp, только если включён Persistent и exp задан.
+func (a *Authenticator) newCookie(name, value, path string, exp time.Duration) *http.Cookie {
+	if path == "" {
+		path = a.cookies.Path
+	}
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   a.cookies.Domain,
+		HttpOnly: a.cookies.HttpOnly,
+		Secure:   a.cookies.Secure,
+		SameSite: a.cookies.SameSite,
+	}
+	if a.cookies.Persistent && exp > 0 {
+		cookie.Expires = time.Now().Add(exp)
+		cookie.MaxAge = int(exp.Seconds())
+	}
+	return cookie
+}
+
+// expiredCookie создаёт cookie, которая удаляет у клиента cookie name.
+func (a *Authenticator) expiredCookie(name, path string) *http.Cookie {
+	cookie := a.newCookie(name, "", path, 0)
+	cookie.MaxAge = -1
+	return cookie
+}
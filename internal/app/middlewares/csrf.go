@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+const (
+	csrfCookieName = "gophermart_csrf"
+	CSRFHeader     = "X-CSRF-Token"
+)
+
+// CSRF защищает изменяющие запросы по схеме double-submit: значение cookie gophermart_csrf,
+// выданной вместе с access-токеном, нужно повторить в заголовке X-CSRF-Token.
+// Проверка нужна только при аутентификации по cookie: Bearer-токен и API-ключ
+// браузер сам к запросу не добавит. Должен вызываться внутри Auth.
+func CSRF(h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if AuthSourceFromContext(req.Context()) != AuthSourceCookie || isSafeMethod(req.Method) {
+			h.ServeHTTP(res, req)
+			return
+		}
+		csrfCookie, err := req.Cookie(csrfCookieName)
+		token := req.Header.Get(CSRFHeader)
+		if err != nil || csrfCookie.Value == "" || token == "" ||
+			subtle.ConstantTimeCompare([]byte(csrfCookie.Value), []byte(token)) != 1 {
+			http.Error(res, "csrf token mismatch", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(res, req)
+	}
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/nasik90/gophermart/internal/app/logger"
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	idempotentReplayedHeader  = "Idempotent-Replayed"
+	idempotencyKeyMaxLength   = 255
+	idempotentRequestMaxBytes = 1 << 20
+)
+
+// IdempotencyStore хранит ключи идемпотентности и ответы на запросы с ними
+type IdempotencyStore interface {
+	StartIdempotentRequest(ctx context.Context, login, key, fingerprint string) (*storage.IdempotentResponse, error)
+	FinishIdempotentRequest(ctx context.Context, login, key string, response storage.IdempotentResponse) error
+	ReleaseIdempotencyKey(ctx context.Context, login, key string) error
+}
+
+type Idempotency struct {
+	store IdempotencyStore
+}
+
+func NewIdempotency(store IdempotencyStore) *Idempotency {
+	return &Idempotency{store: store}
+}
+
+// Handle выполняет запрос с заголовком Idempotency-Key не больше одного раза: повтор с тем же
+// ключом и телом получает сохранённый ответ, с другим телом - 422. Ответы, после которых запрос
+// имеет смысл повторить с тем же ключом (см. releasesKey), не сохраняются.
+// Должен вызываться внутри Auth, ключи у каждого пользователя свои.
+func (i *Idempotency) Handle(h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			h.ServeHTTP(res, req)
+			return
+		}
+		if len(key) > idempotencyKeyMaxLength {
+			http.Error(res, "idempotency key is too long", http.StatusBadRequest)
+			return
+		}
+		// тело читается целиком до выполнения запроса, поэтому его размер ограничен
+		body, err := io.ReadAll(http.MaxBytesReader(res, req.Body, idempotentRequestMaxBytes))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(res, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := req.Context()
+		login := LoginFromContext(ctx)
+		response, err := i.store.StartIdempotentRequest(ctx, login, key, requestFingerprint(req, body))
+		switch {
+		case errors.Is(err, storage.ErrIdempotencyKeyMismatch):
+			http.Error(res, err.Error(), http.StatusUnprocessableEntity)
+			return
+		case errors.Is(err, storage.ErrIdempotencyKeyInProgress):
+			http.Error(res, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			logger.Log.Error("start idempotent request", zap.String("error", err.Error()))
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		case response != nil:
+			if response.ContentType != "" {
+				res.Header().Set("content-type", response.ContentType)
+			}
+			res.Header().Set(idempotentReplayedHeader, "true")
+			res.WriteHeader(response.StatusCode)
+			res.Write(response.Body)
+			return
+		}
+
+		// ответ уже отправлен клиенту, поэтому запрос может быть отменён
+		ctx = context.WithoutCancel(ctx)
+		defer func() {
+			// паника в обработчике не должна оставлять ключ занятым до истечения аренды
+			if p := recover(); p != nil {
+				if err := i.store.ReleaseIdempotencyKey(ctx, login, key); err != nil {
+					logger.Log.Error("release idempotency key", zap.String("error", err.Error()))
+				}
+				panic(p)
+			}
+		}()
+		rw := &recordingWriter{ResponseWriter: res, statusCode: http.StatusOK}
+		h.ServeHTTP(rw, req)
+
+		if releasesKey(rw.statusCode) {
+			err = i.store.ReleaseIdempotencyKey(ctx, login, key)
+		} else {
+			err = i.store.FinishIdempotentRequest(ctx, login, key, storage.IdempotentResponse{
+				StatusCode:  rw.statusCode,
+				ContentType: rw.Header().Get("content-type"),
+				Body:        rw.body.Bytes(),
+			})
+		}
+		if err != nil {
+			logger.Log.Error("finish idempotent request", zap.String("error", err.Error()))
+		}
+	}
+}
+
+// releasesKey сообщает, что ответ не окончательный и ключ нужно освободить: ошибки сервера,
+// а также отказы, которые снимаются без изменения тела запроса - подтверждение кодом
+// второго фактора в заголовке, блокировка входа, ограничение частоты и конфликт.
+func releasesKey(statusCode int) bool {
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict, http.StatusTooManyRequests:
+		return true
+	}
+	return statusCode >= http.StatusInternalServerError
+}
+
+// requestFingerprint - отпечаток запроса: ключ можно повторить только с тем же методом, путём и телом
+func requestFingerprint(req *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// recordingWriter передаёт ответ клиенту и запоминает его для сохранения
+type recordingWriter struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.statusCode = statusCode
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
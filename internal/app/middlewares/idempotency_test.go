@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryIdempotencyStore - хранилище ключей в памяти для тестов
+type memoryIdempotencyStore struct {
+	responses map[string]*storage.IdempotentResponse
+	released  []string
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{responses: make(map[string]*storage.IdempotentResponse)}
+}
+
+func (m *memoryIdempotencyStore) StartIdempotentRequest(ctx context.Context, login, key, fingerprint string) (*storage.IdempotentResponse, error) {
+	return m.responses[key], nil
+}
+
+func (m *memoryIdempotencyStore) FinishIdempotentRequest(ctx context.Context, login, key string, response storage.IdempotentResponse) error {
+	m.responses[key] = &response
+	return nil
+}
+
+func (m *memoryIdempotencyStore) ReleaseIdempotencyKey(ctx context.Context, login, key string) error {
+	m.released = append(m.released, key)
+	return nil
+}
+
+func newIdempotentRequest(key, body string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(body)).
+		WithContext(context.WithValue(context.Background(), LoginContextKey{}, "vasya"))
+	request.Header.Set(IdempotencyKeyHeader, key)
+	return request
+}
+
+func TestIdempotency_ReleasesKey(t *testing.T) {
+	store := newMemoryIdempotencyStore()
+	idempotency := NewIdempotency(store)
+	statusCode := http.StatusForbidden
+	calls := 0
+	handler := idempotency.Handle(func(res http.ResponseWriter, req *http.Request) {
+		calls++
+		res.WriteHeader(statusCode)
+	})
+
+	// отказ без кода второго фактора не сохраняется: повтор с кодом выполняет запрос
+	w := httptest.NewRecorder()
+	handler(w, newIdempotentRequest("key-1", `{"sum":1500}`))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, []string{"key-1"}, store.released)
+
+	statusCode = http.StatusOK
+	w = httptest.NewRecorder()
+	handler(w, newIdempotentRequest("key-1", `{"sum":1500}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 2, calls)
+
+	// окончательный ответ повторяется без выполнения
+	w = httptest.NewRecorder()
+	handler(w, newIdempotentRequest("key-1", `{"sum":1500}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get(idempotentReplayedHeader))
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotency_PanicReleasesKey(t *testing.T) {
+	store := newMemoryIdempotencyStore()
+	handler := NewIdempotency(store).Handle(func(res http.ResponseWriter, req *http.Request) {
+		panic("handler failed")
+	})
+	assert.Panics(t, func() {
+		handler(httptest.NewRecorder(), newIdempotentRequest("key-1", `{"sum":100}`))
+	})
+	assert.Equal(t, []string{"key-1"}, store.released)
+}
+
+func TestIdempotency_BodyTooLarge(t *testing.T) {
+	store := newMemoryIdempotencyStore()
+	handler := NewIdempotency(store).Handle(func(res http.ResponseWriter, req *http.Request) {
+		t.Fatal("handler must not run with a truncated body")
+	})
+	w := httptest.NewRecorder()
+	handler(w, newIdempotentRequest("key-1", strings.Repeat("1", idempotentRequestMaxBytes+1)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Empty(t, store.responses)
+}
@@ -0,0 +1,180 @@
+package middleware
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	ErrUnknownKeyID      = errors.New("unknown signing key id")
+	ErrNoSigningKey      = errors.New("signing key is not configured")
+	ErrUnsupportedKeyAlg = errors.New("unsupported signing key algorithm")
+)
+
+// SigningKey - ключ подписи JWT. Ключ без приватной части используется только для проверки
+// токенов, выпущенных до ротации.
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// KeySet - набор ключей, которыми проверяются токены. Новые токены подписываются текущим ключом.
+type KeySet struct {
+	current *SigningKey
+	keys    map[string]*SigningKey
+}
+
+type keyFileEntry struct {
+	KID string `json:"kid"`
+	Alg string `json:"alg"`
+	// Secret - секрет для HS256 в base64
+	Secret         string `json:"secret,omitempty"`
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+	PublicKeyFile  string `json:"public_key_file,omitempty"`
+}
+
+type keyFile struct {
+	Current string         `json:"current"`
+	Keys    []keyFileEntry `json:"keys"`
+}
+
+// LoadKeySet читает набор ключей из JSON-файла вида
+// {"current": "k2", "keys": [{"kid": "k1", "alg": "HS256", "secret": "..."}, {"kid": "k2", "alg": "RS256", "private_key_file": "k2.pem"}]}.
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	keySet := &KeySet{keys: make(map[string]*SigningKey)}
+	for _, entry := range file.Keys {
+		key, err := parseKeyFileEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", entry.KID, err)
+		}
+		keySet.keys[key.ID] = key
+	}
+	current, ok := keySet.keys[file.Current]
+	if !ok {
+		return nil, fmt.Errorf("current key %q: %w", file.Current, ErrUnknownKeyID)
+	}
+	if current.signKey == nil {
+		return nil, fmt.Errorf("current key %q: %w", file.Current, ErrNoSigningKey)
+	}
+	keySet.current = current
+	return keySet, nil
+}
+
+func parseKeyFileEntry(entry keyFileEntry) (*SigningKey, error) {
+	if entry.KID == "" {
+		return nil, errors.New("empty kid")
+	}
+	key := &SigningKey{ID: entry.KID}
+	switch entry.Alg {
+	case jwt.SigningMethodHS256.Alg():
+		secret, err := base64.StdEncoding.DecodeString(entry.Secret)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) == 0 {
+			return nil, errors.New("empty secret")
+		}
+		key.Method = jwt.SigningMethodHS256
+		key.signKey, key.verifyKey = secret, secret
+	case jwt.SigningMethodRS256.Alg():
+		key.Method = jwt.SigningMethodRS256
+		if entry.PrivateKeyFile != "" {
+			pem, err := os.ReadFile(entry.PrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey, key.verifyKey = privateKey, &privateKey.PublicKey
+		} else {
+			pem, err := os.ReadFile(entry.PublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			if key.verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(pem); err != nil {
+				return nil, err
+			}
+		}
+	case jwt.SigningMethodEdDSA.Alg():
+		key.Method = jwt.SigningMethodEdDSA
+		if entry.PrivateKeyFile != "" {
+			pem, err := os.ReadFile(entry.PrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			privateKey, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = privateKey
+			key.verifyKey = privateKey.(ed25519.PrivateKey).Public()
+		} else {
+			pem, err := os.ReadFile(entry.PublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			if key.verifyKey, err = jwt.ParseEdPublicKeyFromPEM(pem); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%s: %w", entry.Alg, ErrUnsupportedKeyAlg)
+	}
+	return key, nil
+}
+
+// NewHMACKeySet создаёт набор из одного ключа HS256.
+func NewHMACKeySet(kid string, secret []byte) (*KeySet, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	key := &SigningKey{ID: kid, Method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+	return &KeySet{current: key, keys: map[string]*SigningKey{kid: key}}, nil
+}
+
+// NewRandomKeySet создаёт ключ HS256 со случайным секретом.
+// Токены, подписанные таким ключом, становятся недействительными после перезапуска.
+func NewRandomKeySet() (*KeySet, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return NewHMACKeySet("random", secret)
+}
+
+func (k *KeySet) keyFunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%q: %w", kid, ErrUnknownKeyID)
+	}
+	if t.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	}
+	return key.verifyKey, nil
+}
+
+func (k *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.current.Method, claims)
+	token.Header["kid"] = k.current.ID
+	return token.SignedString(k.current.signKey)
+}
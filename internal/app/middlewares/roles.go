@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+)
+
+// RequireRole пропускает запрос, только если у пользователя одна из перечисленных ролей.
+// Должен вызываться внутри Auth, роль берётся из токена.
+func RequireRole(h http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		role := RoleFromContext(req.Context())
+		for _, allowed := range roles {
+			if role == allowed {
+				h.ServeHTTP(res, req)
+				return
+			}
+		}
+		res.WriteHeader(http.StatusForbidden)
+	}
+}
+
+func RoleFromContext(ctx context.Context) string {
+	claims := ClaimsFromContext(ctx)
+	if claims == nil {
+		return ""
+	}
+	return claims.Role
+}
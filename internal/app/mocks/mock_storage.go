@@ -7,6 +7,7 @@ package mock_service
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	storage "github.com/nasik90/gophermart/internal/app/storage"
@@ -35,33 +36,239 @@ func (m *MockRepository) EXPECT() *MockRepositoryMockRecorder {
 	return m.recorder
 }
 
+// AccessTokenIsRevoked mocks base method.
+func (m *MockRepository) AccessTokenIsRevoked(ctx context.Context, jti, login string, issuedAt time.Time) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AccessTokenIsRevoked", ctx, jti, login, issuedAt)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AccessTokenIsRevoked indicates an expected call of AccessTokenIsRevoked.
+func (mr *MockRepositoryMockRecorder) AccessTokenIsRevoked(ctx, jti, login, issuedAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AccessTokenIsRevoked", reflect.TypeOf((*MockRepository)(nil).AccessTokenIsRevoked), ctx, jti, login, issuedAt)
+}
+
 // AccruePoints mocks base method.
-func (m *MockRepository) AccruePoints(ctx context.Context, OrderID int, points float64) error {
+func (m *MockRepository) AccruePoints(ctx context.Context, OrderID storage.OrderNumber, instanceID string, points float64) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AccruePoints", ctx, OrderID, points)
+	ret := m.ctrl.Call(m, "AccruePoints", ctx, OrderID, instanceID, points)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // AccruePoints indicates an expected call of AccruePoints.
-func (mr *MockRepositoryMockRecorder) AccruePoints(ctx, OrderID, points interface{}) *gomock.Call {
+func (mr *MockRepositoryMockRecorder) AccruePoints(ctx, OrderID, instanceID, points interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AccruePoints", reflect.TypeOf((*MockRepository)(nil).AccruePoints), ctx, OrderID, instanceID, points)
+}
+
+// AnonymizeUser mocks base method.
+func (m *MockRepository) AnonymizeUser(ctx context.Context, login, anonymousLogin string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AnonymizeUser", ctx, login, anonymousLogin)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AnonymizeUser indicates an expected call of AnonymizeUser.
+func (mr *MockRepositoryMockRecorder) AnonymizeUser(ctx, login, anonymousLogin interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AnonymizeUser", reflect.TypeOf((*MockRepository)(nil).AnonymizeUser), ctx, login, anonymousLogin)
+}
+
+// ChangePassword mocks base method.
+func (m *MockRepository) ChangePassword(ctx context.Context, login string, password storage.PasswordHash) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ChangePassword", ctx, login, password)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ChangePassword indicates an expected call of ChangePassword.
+func (mr *MockRepositoryMockRecorder) ChangePassword(ctx, login, password interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChangePassword", reflect.TypeOf((*MockRepository)(nil).ChangePassword), ctx, login, password)
+}
+
+// ClaimOrders mocks base method.
+func (m *MockRepository) ClaimOrders(ctx context.Context, instanceID string, limit int, leaseUntil time.Time) ([]storage.ClaimedOrder, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimOrders", ctx, instanceID, limit, leaseUntil)
+	ret0, _ := ret[0].([]storage.ClaimedOrder)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimOrders indicates an expected call of ClaimOrders.
+func (mr *MockRepositoryMockRecorder) ClaimOrders(ctx, instanceID, limit, leaseUntil interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimOrders", reflect.TypeOf((*MockRepository)(nil).ClaimOrders), ctx, instanceID, limit, leaseUntil)
+}
+
+// DeleteIdempotencyKey mocks base method.
+func (m *MockRepository) DeleteIdempotencyKey(ctx context.Context, login, key string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteIdempotencyKey", ctx, login, key)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteIdempotencyKey indicates an expected call of DeleteIdempotencyKey.
+func (mr *MockRepositoryMockRecorder) DeleteIdempotencyKey(ctx, login, key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteIdempotencyKey", reflect.TypeOf((*MockRepository)(nil).DeleteIdempotencyKey), ctx, login, key)
+}
+
+// DeleteTOTP mocks base method.
+func (m *MockRepository) DeleteTOTP(ctx context.Context, login string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteTOTP", ctx, login)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteTOTP indicates an expected call of DeleteTOTP.
+func (mr *MockRepositoryMockRecorder) DeleteTOTP(ctx, login interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteTOTP", reflect.TypeOf((*MockRepository)(nil).DeleteTOTP), ctx, login)
+}
+
+// ExportUserData mocks base method.
+func (m *MockRepository) ExportUserData(ctx context.Context, login string) (*storage.UserExport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExportUserData", ctx, login)
+	ret0, _ := ret[0].(*storage.UserExport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ExportUserData indicates an expected call of ExportUserData.
+func (mr *MockRepositoryMockRecorder) ExportUserData(ctx, login interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AccruePoints", reflect.TypeOf((*MockRepository)(nil).AccruePoints), ctx, OrderID, points)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExportUserData", reflect.TypeOf((*MockRepository)(nil).ExportUserData), ctx, login)
+}
+
+// GetAPIKeys mocks base method.
+func (m *MockRepository) GetAPIKeys(ctx context.Context, login string) ([]storage.APIKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAPIKeys", ctx, login)
+	ret0, _ := ret[0].([]storage.APIKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAPIKeys indicates an expected call of GetAPIKeys.
+func (mr *MockRepositoryMockRecorder) GetAPIKeys(ctx, login interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAPIKeys", reflect.TypeOf((*MockRepository)(nil).GetAPIKeys), ctx, login)
+}
+
+// GetLoginByIdentity mocks base method.
+func (m *MockRepository) GetLoginByIdentity(ctx context.Context, issuer, subject string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLoginByIdentity", ctx, issuer, subject)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLoginByIdentity indicates an expected call of GetLoginByIdentity.
+func (mr *MockRepositoryMockRecorder) GetLoginByIdentity(ctx, issuer, subject interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLoginByIdentity", reflect.TypeOf((*MockRepository)(nil).GetLoginByIdentity), ctx, issuer, subject)
+}
+
+// GetOrder mocks base method.
+func (m *MockRepository) GetOrder(ctx context.Context, orderID storage.OrderNumber) (*storage.OrderDetails, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOrder", ctx, orderID)
+	ret0, _ := ret[0].(*storage.OrderDetails)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetOrder indicates an expected call of GetOrder.
+func (mr *MockRepositoryMockRecorder) GetOrder(ctx, orderID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrder", reflect.TypeOf((*MockRepository)(nil).GetOrder), ctx, orderID)
 }
 
 // GetOrderList mocks base method.
-func (m *MockRepository) GetOrderList(ctx context.Context, login string) (*[]storage.OrderData, error) {
+func (m *MockRepository) GetOrderList(ctx context.Context, login string, filter storage.ListFilter) (*[]storage.OrderData, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetOrderList", ctx, login)
+	ret := m.ctrl.Call(m, "GetOrderList", ctx, login, filter)
 	ret0, _ := ret[0].(*[]storage.OrderData)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetOrderList indicates an expected call of GetOrderList.
-func (mr *MockRepositoryMockRecorder) GetOrderList(ctx, login interface{}) *gomock.Call {
+func (mr *MockRepositoryMockRecorder) GetOrderList(ctx, login, filter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrderList", reflect.TypeOf((*MockRepository)(nil).GetOrderList), ctx, login, filter)
+}
+
+// GetPasswordHash mocks base method.
+func (m *MockRepository) GetPasswordHash(ctx context.Context, login string) (*storage.PasswordHash, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetPasswordHash", ctx, login)
+	ret0, _ := ret[0].(*storage.PasswordHash)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetPasswordHash indicates an expected call of GetPasswordHash.
+func (mr *MockRepositoryMockRecorder) GetPasswordHash(ctx, login interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPasswordHash", reflect.TypeOf((*MockRepository)(nil).GetPasswordHash), ctx, login)
+}
+
+// GetSessions mocks base method.
+func (m *MockRepository) GetSessions(ctx context.Context, login string) ([]storage.Session, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSessions", ctx, login)
+	ret0, _ := ret[0].([]storage.Session)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSessions indicates an expected call of GetSessions.
+func (mr *MockRepositoryMockRecorder) GetSessions(ctx, login interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSessions", reflect.TypeOf((*MockRepository)(nil).GetSessions), ctx, login)
+}
+
+// GetStuckOrders mocks base method.
+func (m *MockRepository) GetStuckOrders(ctx context.Context, filter storage.ListFilter) ([]storage.StuckOrder, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetStuckOrders", ctx, filter)
+	ret0, _ := ret[0].([]storage.StuckOrder)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetStuckOrders indicates an expected call of GetStuckOrders.
+func (mr *MockRepositoryMockRecorder) GetStuckOrders(ctx, filter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetStuckOrders", reflect.TypeOf((*MockRepository)(nil).GetStuckOrders), ctx, filter)
+}
+
+// GetTOTP mocks base method.
+func (m *MockRepository) GetTOTP(ctx context.Context, login string) (*storage.TOTP, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetTOTP", ctx, login)
+	ret0, _ := ret[0].(*storage.TOTP)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetTOTP indicates an expected call of GetTOTP.
+func (mr *MockRepositoryMockRecorder) GetTOTP(ctx, login interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrderList", reflect.TypeOf((*MockRepository)(nil).GetOrderList), ctx, login)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTOTP", reflect.TypeOf((*MockRepository)(nil).GetTOTP), ctx, login)
 }
 
 // GetUserBalance mocks base method.
@@ -79,38 +286,281 @@ func (mr *MockRepositoryMockRecorder) GetUserBalance(ctx, login interface{}) *go
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserBalance", reflect.TypeOf((*MockRepository)(nil).GetUserBalance), ctx, login)
 }
 
+// GetUserRole mocks base method.
+func (m *MockRepository) GetUserRole(ctx context.Context, login string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserRole", ctx, login)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserRole indicates an expected call of GetUserRole.
+func (mr *MockRepositoryMockRecorder) GetUserRole(ctx, login interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserRole", reflect.TypeOf((*MockRepository)(nil).GetUserRole), ctx, login)
+}
+
 // GetWithdrawals mocks base method.
-func (m *MockRepository) GetWithdrawals(ctx context.Context, login string) (*[]storage.Withdrawals, error) {
+func (m *MockRepository) GetWithdrawals(ctx context.Context, login string, filter storage.ListFilter) (*[]storage.Withdrawals, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetWithdrawals", ctx, login)
+	ret := m.ctrl.Call(m, "GetWithdrawals", ctx, login, filter)
 	ret0, _ := ret[0].(*[]storage.Withdrawals)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetWithdrawals indicates an expected call of GetWithdrawals.
-func (mr *MockRepositoryMockRecorder) GetWithdrawals(ctx, login interface{}) *gomock.Call {
+func (mr *MockRepositoryMockRecorder) GetWithdrawals(ctx, login, filter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWithdrawals", reflect.TypeOf((*MockRepository)(nil).GetWithdrawals), ctx, login, filter)
+}
+
+// LinkIdentity mocks base method.
+func (m *MockRepository) LinkIdentity(ctx context.Context, login, issuer, subject string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LinkIdentity", ctx, login, issuer, subject)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// LinkIdentity indicates an expected call of LinkIdentity.
+func (mr *MockRepositoryMockRecorder) LinkIdentity(ctx, login, issuer, subject interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LinkIdentity", reflect.TypeOf((*MockRepository)(nil).LinkIdentity), ctx, login, issuer, subject)
+}
+
+// LockKey mocks base method.
+func (m *MockRepository) LockKey(ctx context.Context, key string, lockedUntil time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LockKey", ctx, key, lockedUntil)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// LockKey indicates an expected call of LockKey.
+func (mr *MockRepositoryMockRecorder) LockKey(ctx, key, lockedUntil interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LockKey", reflect.TypeOf((*MockRepository)(nil).LockKey), ctx, key, lockedUntil)
+}
+
+// LockedUntil mocks base method.
+func (m *MockRepository) LockedUntil(ctx context.Context, keys []string) (time.Time, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LockedUntil", ctx, keys)
+	ret0, _ := ret[0].(time.Time)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LockedUntil indicates an expected call of LockedUntil.
+func (mr *MockRepositoryMockRecorder) LockedUntil(ctx, keys interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LockedUntil", reflect.TypeOf((*MockRepository)(nil).LockedUntil), ctx, keys)
+}
+
+// MarkOrderStuck mocks base method.
+func (m *MockRepository) MarkOrderStuck(ctx context.Context, orderID storage.OrderNumber, instanceID, reason string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkOrderStuck", ctx, orderID, instanceID, reason)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MarkOrderStuck indicates an expected call of MarkOrderStuck.
+func (mr *MockRepositoryMockRecorder) MarkOrderStuck(ctx, orderID, instanceID, reason interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkOrderStuck", reflect.TypeOf((*MockRepository)(nil).MarkOrderStuck), ctx, orderID, instanceID, reason)
+}
+
+// RegisterAttempt mocks base method.
+func (m *MockRepository) RegisterAttempt(ctx context.Context, key string, resetBefore time.Time) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RegisterAttempt", ctx, key, resetBefore)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RegisterAttempt indicates an expected call of RegisterAttempt.
+func (mr *MockRepositoryMockRecorder) RegisterAttempt(ctx, key, resetBefore interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RegisterAttempt", reflect.TypeOf((*MockRepository)(nil).RegisterAttempt), ctx, key, resetBefore)
+}
+
+// ReleaseOrder mocks base method.
+func (m *MockRepository) ReleaseOrder(ctx context.Context, orderID storage.OrderNumber, instanceID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseOrder", ctx, orderID, instanceID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseOrder indicates an expected call of ReleaseOrder.
+func (mr *MockRepositoryMockRecorder) ReleaseOrder(ctx, orderID, instanceID interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWithdrawals", reflect.TypeOf((*MockRepository)(nil).GetWithdrawals), ctx, login)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseOrder", reflect.TypeOf((*MockRepository)(nil).ReleaseOrder), ctx, orderID, instanceID)
 }
 
-// NewAndProcessingOrders mocks base method.
-func (m *MockRepository) NewAndProcessingOrders(ctx context.Context) ([]int, error) {
+// RequeueOrder mocks base method.
+func (m *MockRepository) RequeueOrder(ctx context.Context, orderID storage.OrderNumber) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "NewAndProcessingOrders", ctx)
-	ret0, _ := ret[0].([]int)
+	ret := m.ctrl.Call(m, "RequeueOrder", ctx, orderID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RequeueOrder indicates an expected call of RequeueOrder.
+func (mr *MockRepositoryMockRecorder) RequeueOrder(ctx, orderID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RequeueOrder", reflect.TypeOf((*MockRepository)(nil).RequeueOrder), ctx, orderID)
+}
+
+// RescheduleOrder mocks base method.
+func (m *MockRepository) RescheduleOrder(ctx context.Context, orderID storage.OrderNumber, instanceID string, nextAttemptAt time.Time, failure bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RescheduleOrder", ctx, orderID, instanceID, nextAttemptAt, failure)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RescheduleOrder indicates an expected call of RescheduleOrder.
+func (mr *MockRepositoryMockRecorder) RescheduleOrder(ctx, orderID, instanceID, nextAttemptAt, failure interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RescheduleOrder", reflect.TypeOf((*MockRepository)(nil).RescheduleOrder), ctx, orderID, instanceID, nextAttemptAt, failure)
+}
+
+// ResetAttempts mocks base method.
+func (m *MockRepository) ResetAttempts(ctx context.Context, keys []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResetAttempts", ctx, keys)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ResetAttempts indicates an expected call of ResetAttempts.
+func (mr *MockRepositoryMockRecorder) ResetAttempts(ctx, keys interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetAttempts", reflect.TypeOf((*MockRepository)(nil).ResetAttempts), ctx, keys)
+}
+
+// ResetPassword mocks base method.
+func (m *MockRepository) ResetPassword(ctx context.Context, tokenHash string, password storage.PasswordHash) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResetPassword", ctx, tokenHash, password)
+	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// NewAndProcessingOrders indicates an expected call of NewAndProcessingOrders.
-func (mr *MockRepositoryMockRecorder) NewAndProcessingOrders(ctx interface{}) *gomock.Call {
+// ResetPassword indicates an expected call of ResetPassword.
+func (mr *MockRepositoryMockRecorder) ResetPassword(ctx, tokenHash, password interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetPassword", reflect.TypeOf((*MockRepository)(nil).ResetPassword), ctx, tokenHash, password)
+}
+
+// RevokeAPIKey mocks base method.
+func (m *MockRepository) RevokeAPIKey(ctx context.Context, login string, id int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeAPIKey", ctx, login, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeAPIKey indicates an expected call of RevokeAPIKey.
+func (mr *MockRepositoryMockRecorder) RevokeAPIKey(ctx, login, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeAPIKey", reflect.TypeOf((*MockRepository)(nil).RevokeAPIKey), ctx, login, id)
+}
+
+// RevokeAccessToken mocks base method.
+func (m *MockRepository) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeAccessToken", ctx, jti, expiresAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeAccessToken indicates an expected call of RevokeAccessToken.
+func (mr *MockRepositoryMockRecorder) RevokeAccessToken(ctx, jti, expiresAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeAccessToken", reflect.TypeOf((*MockRepository)(nil).RevokeAccessToken), ctx, jti, expiresAt)
+}
+
+// RevokeRefreshTokenFamily mocks base method.
+func (m *MockRepository) RevokeRefreshTokenFamily(ctx context.Context, tokenHash string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeRefreshTokenFamily", ctx, tokenHash)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeRefreshTokenFamily indicates an expected call of RevokeRefreshTokenFamily.
+func (mr *MockRepositoryMockRecorder) RevokeRefreshTokenFamily(ctx, tokenHash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeRefreshTokenFamily", reflect.TypeOf((*MockRepository)(nil).RevokeRefreshTokenFamily), ctx, tokenHash)
+}
+
+// RevokeSession mocks base method.
+func (m *MockRepository) RevokeSession(ctx context.Context, login, id string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeSession", ctx, login, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeSession indicates an expected call of RevokeSession.
+func (mr *MockRepositoryMockRecorder) RevokeSession(ctx, login, id interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewAndProcessingOrders", reflect.TypeOf((*MockRepository)(nil).NewAndProcessingOrders), ctx)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeSession", reflect.TypeOf((*MockRepository)(nil).RevokeSession), ctx, login, id)
+}
+
+// RotateRefreshToken mocks base method.
+func (m *MockRepository) RotateRefreshToken(ctx context.Context, oldHash string, newToken storage.RefreshToken) (string, string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RotateRefreshToken", ctx, oldHash, newToken)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// RotateRefreshToken indicates an expected call of RotateRefreshToken.
+func (mr *MockRepositoryMockRecorder) RotateRefreshToken(ctx, oldHash, newToken interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RotateRefreshToken", reflect.TypeOf((*MockRepository)(nil).RotateRefreshToken), ctx, oldHash, newToken)
+}
+
+// SaveAPIKey mocks base method.
+func (m *MockRepository) SaveAPIKey(ctx context.Context, login, keyHash string, apiKey *storage.APIKey) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveAPIKey", ctx, login, keyHash, apiKey)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveAPIKey indicates an expected call of SaveAPIKey.
+func (mr *MockRepositoryMockRecorder) SaveAPIKey(ctx, login, keyHash, apiKey interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveAPIKey", reflect.TypeOf((*MockRepository)(nil).SaveAPIKey), ctx, login, keyHash, apiKey)
+}
+
+// SaveIdempotentResponse mocks base method.
+func (m *MockRepository) SaveIdempotentResponse(ctx context.Context, login, key string, response storage.IdempotentResponse) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveIdempotentResponse", ctx, login, key, response)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveIdempotentResponse indicates an expected call of SaveIdempotentResponse.
+func (mr *MockRepositoryMockRecorder) SaveIdempotentResponse(ctx, login, key, response interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveIdempotentResponse", reflect.TypeOf((*MockRepository)(nil).SaveIdempotentResponse), ctx, login, key, response)
 }
 
 // SaveNewOrder mocks base method.
-func (m *MockRepository) SaveNewOrder(ctx context.Context, orderNumber int, login string) error {
+func (m *MockRepository) SaveNewOrder(ctx context.Context, orderNumber storage.OrderNumber, login string) error {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "SaveNewOrder", ctx, orderNumber, login)
 	ret0, _ := ret[0].(error)
@@ -123,8 +573,23 @@ func (mr *MockRepositoryMockRecorder) SaveNewOrder(ctx, orderNumber, login inter
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveNewOrder", reflect.TypeOf((*MockRepository)(nil).SaveNewOrder), ctx, orderNumber, login)
 }
 
+// SaveNewOrders mocks base method.
+func (m *MockRepository) SaveNewOrders(ctx context.Context, ids []storage.OrderNumber, login string) ([]storage.OrderBatchItem, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveNewOrders", ctx, ids, login)
+	ret0, _ := ret[0].([]storage.OrderBatchItem)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SaveNewOrders indicates an expected call of SaveNewOrders.
+func (mr *MockRepositoryMockRecorder) SaveNewOrders(ctx, ids, login interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveNewOrders", reflect.TypeOf((*MockRepository)(nil).SaveNewOrders), ctx, ids, login)
+}
+
 // SaveNewUser mocks base method.
-func (m *MockRepository) SaveNewUser(ctx context.Context, user, password string) error {
+func (m *MockRepository) SaveNewUser(ctx context.Context, user string, password storage.PasswordHash) error {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "SaveNewUser", ctx, user, password)
 	ret0, _ := ret[0].(error)
@@ -137,37 +602,252 @@ func (mr *MockRepositoryMockRecorder) SaveNewUser(ctx, user, password interface{
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveNewUser", reflect.TypeOf((*MockRepository)(nil).SaveNewUser), ctx, user, password)
 }
 
+// SaveNewUserWithIdentity mocks base method.
+func (m *MockRepository) SaveNewUserWithIdentity(ctx context.Context, login string, password storage.PasswordHash, issuer, subject string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveNewUserWithIdentity", ctx, login, password, issuer, subject)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveNewUserWithIdentity indicates an expected call of SaveNewUserWithIdentity.
+func (mr *MockRepositoryMockRecorder) SaveNewUserWithIdentity(ctx, login, password, issuer, subject interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveNewUserWithIdentity", reflect.TypeOf((*MockRepository)(nil).SaveNewUserWithIdentity), ctx, login, password, issuer, subject)
+}
+
+// SaveOIDCState mocks base method.
+func (m *MockRepository) SaveOIDCState(ctx context.Context, stateHash string, state storage.OIDCState) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveOIDCState", ctx, stateHash, state)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveOIDCState indicates an expected call of SaveOIDCState.
+func (mr *MockRepositoryMockRecorder) SaveOIDCState(ctx, stateHash, state interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveOIDCState", reflect.TypeOf((*MockRepository)(nil).SaveOIDCState), ctx, stateHash, state)
+}
+
+// SavePasswordResetToken mocks base method.
+func (m *MockRepository) SavePasswordResetToken(ctx context.Context, login, tokenHash string, expiresAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SavePasswordResetToken", ctx, login, tokenHash, expiresAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SavePasswordResetToken indicates an expected call of SavePasswordResetToken.
+func (mr *MockRepositoryMockRecorder) SavePasswordResetToken(ctx, login, tokenHash, expiresAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SavePasswordResetToken", reflect.TypeOf((*MockRepository)(nil).SavePasswordResetToken), ctx, login, tokenHash, expiresAt)
+}
+
+// SaveReauthentication mocks base method.
+func (m *MockRepository) SaveReauthentication(ctx context.Context, issuer, subject string, reauthenticatedAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveReauthentication", ctx, issuer, subject, reauthenticatedAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveReauthentication indicates an expected call of SaveReauthentication.
+func (mr *MockRepositoryMockRecorder) SaveReauthentication(ctx, issuer, subject, reauthenticatedAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveReauthentication", reflect.TypeOf((*MockRepository)(nil).SaveReauthentication), ctx, issuer, subject, reauthenticatedAt)
+}
+
+// SaveRefreshToken mocks base method.
+func (m *MockRepository) SaveRefreshToken(ctx context.Context, login string, token storage.RefreshToken) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveRefreshToken", ctx, login, token)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveRefreshToken indicates an expected call of SaveRefreshToken.
+func (mr *MockRepositoryMockRecorder) SaveRefreshToken(ctx, login, token interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveRefreshToken", reflect.TypeOf((*MockRepository)(nil).SaveRefreshToken), ctx, login, token)
+}
+
+// SaveSession mocks base method.
+func (m *MockRepository) SaveSession(ctx context.Context, login string, session storage.Session) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveSession", ctx, login, session)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveSession indicates an expected call of SaveSession.
+func (mr *MockRepositoryMockRecorder) SaveSession(ctx, login, session interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveSession", reflect.TypeOf((*MockRepository)(nil).SaveSession), ctx, login, session)
+}
+
 // SaveStatus mocks base method.
-func (m *MockRepository) SaveStatus(ctx context.Context, orderID, statusID int) error {
+func (m *MockRepository) SaveStatus(ctx context.Context, orderID storage.OrderNumber, instanceID string, statusID int) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "SaveStatus", ctx, orderID, statusID)
+	ret := m.ctrl.Call(m, "SaveStatus", ctx, orderID, instanceID, statusID)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // SaveStatus indicates an expected call of SaveStatus.
-func (mr *MockRepositoryMockRecorder) SaveStatus(ctx, orderID, statusID interface{}) *gomock.Call {
+func (mr *MockRepositoryMockRecorder) SaveStatus(ctx, orderID, instanceID, statusID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveStatus", reflect.TypeOf((*MockRepository)(nil).SaveStatus), ctx, orderID, instanceID, statusID)
+}
+
+// SaveTOTP mocks base method.
+func (m *MockRepository) SaveTOTP(ctx context.Context, login, secret string, recoveryCodeHashes []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveTOTP", ctx, login, secret, recoveryCodeHashes)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveTOTP indicates an expected call of SaveTOTP.
+func (mr *MockRepositoryMockRecorder) SaveTOTP(ctx, login, secret, recoveryCodeHashes interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveTOTP", reflect.TypeOf((*MockRepository)(nil).SaveTOTP), ctx, login, secret, recoveryCodeHashes)
+}
+
+// SetUserRole mocks base method.
+func (m *MockRepository) SetUserRole(ctx context.Context, login, role string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetUserRole", ctx, login, role)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetUserRole indicates an expected call of SetUserRole.
+func (mr *MockRepositoryMockRecorder) SetUserRole(ctx, login, role interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUserRole", reflect.TypeOf((*MockRepository)(nil).SetUserRole), ctx, login, role)
+}
+
+// StartIdempotentRequest mocks base method.
+func (m *MockRepository) StartIdempotentRequest(ctx context.Context, login, key, fingerprint string, lockedUntil, expiresAt time.Time) (*storage.IdempotentResponse, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StartIdempotentRequest", ctx, login, key, fingerprint, lockedUntil, expiresAt)
+	ret0, _ := ret[0].(*storage.IdempotentResponse)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// StartIdempotentRequest indicates an expected call of StartIdempotentRequest.
+func (mr *MockRepositoryMockRecorder) StartIdempotentRequest(ctx, login, key, fingerprint, lockedUntil, expiresAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StartIdempotentRequest", reflect.TypeOf((*MockRepository)(nil).StartIdempotentRequest), ctx, login, key, fingerprint, lockedUntil, expiresAt)
+}
+
+// TakeOIDCState mocks base method.
+func (m *MockRepository) TakeOIDCState(ctx context.Context, stateHash string) (*storage.OIDCState, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TakeOIDCState", ctx, stateHash)
+	ret0, _ := ret[0].(*storage.OIDCState)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TakeOIDCState indicates an expected call of TakeOIDCState.
+func (mr *MockRepositoryMockRecorder) TakeOIDCState(ctx, stateHash interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveStatus", reflect.TypeOf((*MockRepository)(nil).SaveStatus), ctx, orderID, statusID)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TakeOIDCState", reflect.TypeOf((*MockRepository)(nil).TakeOIDCState), ctx, stateHash)
 }
 
-// UserIsValid mocks base method.
-func (m *MockRepository) UserIsValid(ctx context.Context, login, password string) (bool, error) {
+// TakeReauthentication mocks base method.
+func (m *MockRepository) TakeReauthentication(ctx context.Context, login string) (time.Time, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UserIsValid", ctx, login, password)
+	ret := m.ctrl.Call(m, "TakeReauthentication", ctx, login)
+	ret0, _ := ret[0].(time.Time)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TakeReauthentication indicates an expected call of TakeReauthentication.
+func (mr *MockRepositoryMockRecorder) TakeReauthentication(ctx, login interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TakeReauthentication", reflect.TypeOf((*MockRepository)(nil).TakeReauthentication), ctx, login)
+}
+
+// TouchSession mocks base method.
+func (m *MockRepository) TouchSession(ctx context.Context, id, login string, lastSeenAt, touchBefore time.Time) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TouchSession", ctx, id, login, lastSeenAt, touchBefore)
 	ret0, _ := ret[0].(bool)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// UserIsValid indicates an expected call of UserIsValid.
-func (mr *MockRepositoryMockRecorder) UserIsValid(ctx, login, password interface{}) *gomock.Call {
+// TouchSession indicates an expected call of TouchSession.
+func (mr *MockRepositoryMockRecorder) TouchSession(ctx, id, login, lastSeenAt, touchBefore interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TouchSession", reflect.TypeOf((*MockRepository)(nil).TouchSession), ctx, id, login, lastSeenAt, touchBefore)
+}
+
+// UpdatePasswordHash mocks base method.
+func (m *MockRepository) UpdatePasswordHash(ctx context.Context, login string, password storage.PasswordHash) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdatePasswordHash", ctx, login, password)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdatePasswordHash indicates an expected call of UpdatePasswordHash.
+func (mr *MockRepositoryMockRecorder) UpdatePasswordHash(ctx, login, password interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdatePasswordHash", reflect.TypeOf((*MockRepository)(nil).UpdatePasswordHash), ctx, login, password)
+}
+
+// UseAPIKey mocks base method.
+func (m *MockRepository) UseAPIKey(ctx context.Context, keyHash string, usedAt, touchBefore time.Time) (string, []string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UseAPIKey", ctx, keyHash, usedAt, touchBefore)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].([]string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// UseAPIKey indicates an expected call of UseAPIKey.
+func (mr *MockRepositoryMockRecorder) UseAPIKey(ctx, keyHash, usedAt, touchBefore interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseAPIKey", reflect.TypeOf((*MockRepository)(nil).UseAPIKey), ctx, keyHash, usedAt, touchBefore)
+}
+
+// UseRecoveryCode mocks base method.
+func (m *MockRepository) UseRecoveryCode(ctx context.Context, login, codeHash string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UseRecoveryCode", ctx, login, codeHash)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UseRecoveryCode indicates an expected call of UseRecoveryCode.
+func (mr *MockRepositoryMockRecorder) UseRecoveryCode(ctx, login, codeHash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseRecoveryCode", reflect.TypeOf((*MockRepository)(nil).UseRecoveryCode), ctx, login, codeHash)
+}
+
+// UseTOTPStep mocks base method.
+func (m *MockRepository) UseTOTPStep(ctx context.Context, login string, step int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UseTOTPStep", ctx, login, step)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UseTOTPStep indicates an expected call of UseTOTPStep.
+func (mr *MockRepositoryMockRecorder) UseTOTPStep(ctx, login, step interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UserIsValid", reflect.TypeOf((*MockRepository)(nil).UserIsValid), ctx, login, password)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseTOTPStep", reflect.TypeOf((*MockRepository)(nil).UseTOTPStep), ctx, login, step)
 }
 
 // WithdrawPoints mocks base method.
-func (m *MockRepository) WithdrawPoints(ctx context.Context, login string, OrderID int, points float64) error {
+func (m *MockRepository) WithdrawPoints(ctx context.Context, login string, OrderID storage.OrderNumber, points float64) error {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "WithdrawPoints", ctx, login, OrderID, points)
 	ret0, _ := ret[0].(error)
@@ -179,3 +859,144 @@ func (mr *MockRepositoryMockRecorder) WithdrawPoints(ctx, login, OrderID, points
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WithdrawPoints", reflect.TypeOf((*MockRepository)(nil).WithdrawPoints), ctx, login, OrderID, points)
 }
+
+// MockPasswordHasher is a mock of PasswordHasher interface.
+type MockPasswordHasher struct {
+	ctrl     *gomock.Controller
+	recorder *MockPasswordHasherMockRecorder
+}
+
+// MockPasswordHasherMockRecorder is the mock recorder for MockPasswordHasher.
+type MockPasswordHasherMockRecorder struct {
+	mock *MockPasswordHasher
+}
+
+// NewMockPasswordHasher creates a new mock instance.
+func NewMockPasswordHasher(ctrl *gomock.Controller) *MockPasswordHasher {
+	mock := &MockPasswordHasher{ctrl: ctrl}
+	mock.recorder = &MockPasswordHasherMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockPasswordHasher) EXPECT() *MockPasswordHasherMockRecorder {
+	return m.recorder
+}
+
+// Compare mocks base method.
+func (m *MockPasswordHasher) Compare(hash storage.PasswordHash, password string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Compare", hash, password)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Compare indicates an expected call of Compare.
+func (mr *MockPasswordHasherMockRecorder) Compare(hash, password interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Compare", reflect.TypeOf((*MockPasswordHasher)(nil).Compare), hash, password)
+}
+
+// Hash mocks base method.
+func (m *MockPasswordHasher) Hash(password string) (storage.PasswordHash, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Hash", password)
+	ret0, _ := ret[0].(storage.PasswordHash)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Hash indicates an expected call of Hash.
+func (mr *MockPasswordHasherMockRecorder) Hash(password interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Hash", reflect.TypeOf((*MockPasswordHasher)(nil).Hash), password)
+}
+
+// NeedsRehash mocks base method.
+func (m *MockPasswordHasher) NeedsRehash(hash storage.PasswordHash) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NeedsRehash", hash)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// NeedsRehash indicates an expected call of NeedsRehash.
+func (mr *MockPasswordHasherMockRecorder) NeedsRehash(hash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NeedsRehash", reflect.TypeOf((*MockPasswordHasher)(nil).NeedsRehash), hash)
+}
+
+// MockOrderValidator is a mock of OrderValidator interface.
+type MockOrderValidator struct {
+	ctrl     *gomock.Controller
+	recorder *MockOrderValidatorMockRecorder
+}
+
+// MockOrderValidatorMockRecorder is the mock recorder for MockOrderValidator.
+type MockOrderValidatorMockRecorder struct {
+	mock *MockOrderValidator
+}
+
+// NewMockOrderValidator creates a new mock instance.
+func NewMockOrderValidator(ctrl *gomock.Controller) *MockOrderValidator {
+	mock := &MockOrderValidator{ctrl: ctrl}
+	mock.recorder = &MockOrderValidatorMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockOrderValidator) EXPECT() *MockOrderValidatorMockRecorder {
+	return m.recorder
+}
+
+// Validate mocks base method.
+func (m *MockOrderValidator) Validate(number string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Validate", number)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Validate indicates an expected call of Validate.
+func (mr *MockOrderValidatorMockRecorder) Validate(number interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Validate", reflect.TypeOf((*MockOrderValidator)(nil).Validate), number)
+}
+
+// MockNotifier is a mock of Notifier interface.
+type MockNotifier struct {
+	ctrl     *gomock.Controller
+	recorder *MockNotifierMockRecorder
+}
+
+// MockNotifierMockRecorder is the mock recorder for MockNotifier.
+type MockNotifierMockRecorder struct {
+	mock *MockNotifier
+}
+
+// NewMockNotifier creates a new mock instance.
+func NewMockNotifier(ctrl *gomock.Controller) *MockNotifier {
+	mock := &MockNotifier{ctrl: ctrl}
+	mock.recorder = &MockNotifierMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockNotifier) EXPECT() *MockNotifierMockRecorder {
+	return m.recorder
+}
+
+// Notify mocks base method.
+func (m *MockNotifier) Notify(ctx context.Context, login, subject, message string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Notify", ctx, login, subject, message)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Notify indicates an expected call of Notify.
+func (mr *MockNotifierMockRecorder) Notify(ctx, login, subject, message interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Notify", reflect.TypeOf((*MockNotifier)(nil).Notify), ctx, login, subject, message)
+}
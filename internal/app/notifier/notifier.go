@@ -0,0 +1,54 @@
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nasik90/gophermart/internal/app/logger"
+	"go.uber.org/zap"
+)
+
+// Log пишет уведомления в лог. Подходит только для локальной отладки:
+// в лог попадают токены сброса пароля.
+type Log struct{}
+
+func NewLog() *Log {
+	return &Log{}
+}
+
+func (n *Log) Notify(ctx context.Context, login, subject, message string) error {
+	logger.Log.Info("notification",
+		zap.String("login", login),
+		zap.String("subject", subject),
+		zap.String("message", message),
+	)
+	return nil
+}
+
+// File дописывает уведомления в файл, по одному на строку.
+type File struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+func (n *File) Notify(ctx context.Context, login, subject, message string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	file, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(file, "%s\t%s\t%s\t%s\n", time.Now().Format(time.RFC3339), login, subject, message); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
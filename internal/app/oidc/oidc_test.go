@@ -0,0 +1,80 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/nasik90/gophermart/internal/app/oidc/oidctest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvider_AuthorizationCodeFlow(t *testing.T) {
+	idp, err := oidctest.NewServer("gophermart")
+	require.NoError(t, err)
+	defer idp.Close()
+	idp.Subject = "42"
+	idp.PreferredUsername = "vasya"
+
+	ctx := context.Background()
+	provider, err := NewProvider(ctx, Config{
+		Issuer:      idp.URL,
+		ClientID:    "gophermart",
+		RedirectURL: "http://localhost/api/user/oidc/callback",
+		Scopes:      []string{"openid", "profile"},
+	})
+	require.NoError(t, err)
+
+	verifier, err := NewCodeVerifier()
+	require.NoError(t, err)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(provider.AuthCodeURL("state1", "nonce1", verifier))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "state1", callback.Query().Get("state"))
+	code := callback.Query().Get("code")
+
+	_, err = provider.Exchange(ctx, code, "wrong verifier", "nonce1")
+	assert.Error(t, err)
+
+	resp, err = client.Get(provider.AuthCodeURL("state1", "nonce1", verifier))
+	require.NoError(t, err)
+	resp.Body.Close()
+	callback, err = url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	identity, err := provider.Exchange(ctx, callback.Query().Get("code"), verifier, "nonce1")
+	require.NoError(t, err)
+	assert.Equal(t, &Identity{Issuer: idp.URL, Subject: "42", PreferredUsername: "vasya"}, identity)
+}
+
+func TestProvider_VerifyIDToken(t *testing.T) {
+	idp, err := oidctest.NewServer("gophermart")
+	require.NoError(t, err)
+	defer idp.Close()
+
+	ctx := context.Background()
+	provider, err := NewProvider(ctx, Config{Issuer: idp.URL, ClientID: "gophermart"})
+	require.NoError(t, err)
+
+	token, err := idp.IDToken("42", "", "nonce1")
+	require.NoError(t, err)
+	_, err = provider.VerifyIDToken(ctx, token, "nonce1")
+	assert.NoError(t, err)
+	_, err = provider.VerifyIDToken(ctx, token, "other nonce")
+	assert.ErrorIs(t, err, ErrInvalidIDToken)
+
+	otherClient, err := NewProvider(ctx, Config{Issuer: idp.URL, ClientID: "other"})
+	require.NoError(t, err)
+	_, err = otherClient.VerifyIDToken(ctx, token, "nonce1")
+	assert.ErrorIs(t, err, ErrInvalidIDToken)
+
+	_, err = NewProvider(ctx, Config{Issuer: idp.URL + "/", ClientID: "gophermart"})
+	assert.ErrorIs(t, err, ErrIssuerMismatch)
+}
@@ -0,0 +1,210 @@
+package ordervalidator
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Названия правил, они же используются в строке настройки
+const (
+	RuleLuhn   = "luhn"
+	RuleRegex  = "regex"
+	RuleLength = "length"
+	RulePrefix = "prefix"
+)
+
+var ErrUnknownRule = errors.New("unknown order validation rule")
+
+// Error - номер заказа не прошёл проверку. Rule - название нарушенного правила.
+type Error struct {
+	Rule   string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return e.Rule + ": " + e.Reason
+}
+
+// Validator проверяет номер заказа и возвращает *Error с названием нарушенного правила.
+type Validator interface {
+	Validate(number string) error
+}
+
+// Chain - цепочка правил, номер должен пройти их все по порядку.
+type Chain []Validator
+
+func (c Chain) Validate(number string) error {
+	for _, v := range c {
+		if err := v.Validate(number); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type luhn struct{}
+
+// Luhn проверяет контрольную цифру по алгоритму Луна. Номера не только из цифр пропускаются,
+// их формат задаётся другими правилами.
+func Luhn() Validator {
+	return luhn{}
+}
+
+func (luhn) Validate(number string) error {
+	if !isDigits(number) {
+		return nil
+	}
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		digit := int(number[i] - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	if sum%10 != 0 {
+		return &Error{Rule: RuleLuhn, Reason: "check digit mismatch"}
+	}
+	return nil
+}
+
+func isDigits(number string) bool {
+	if number == "" {
+		return false
+	}
+	for i := 0; i < len(number); i++ {
+		if number[i] < '0' || number[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+type regex struct {
+	pattern *regexp.Regexp
+}
+
+// Regex требует, чтобы номер соответствовал регулярному выражению.
+func Regex(pattern string) (Validator, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return regex{pattern: re}, nil
+}
+
+func (r regex) Validate(number string) error {
+	if !r.pattern.MatchString(number) {
+		return &Error{Rule: RuleRegex, Reason: "does not match " + r.pattern.String()}
+	}
+	return nil
+}
+
+type length struct {
+	minLen, maxLen int
+}
+
+// Length ограничивает длину номера в символах. Нулевая граница не проверяется.
+func Length(minLen, maxLen int) Validator {
+	return length{minLen: minLen, maxLen: maxLen}
+}
+
+func (l length) Validate(number string) error {
+	n := len([]rune(number))
+	if l.minLen > 0 && n < l.minLen {
+		return &Error{Rule: RuleLength, Reason: fmt.Sprintf("shorter than %d", l.minLen)}
+	}
+	if l.maxLen > 0 && n > l.maxLen {
+		return &Error{Rule: RuleLength, Reason: fmt.Sprintf("longer than %d", l.maxLen)}
+	}
+	return nil
+}
+
+type prefix struct {
+	prefixes []string
+}
+
+// Prefix требует, чтобы номер начинался с одного из префиксов.
+func Prefix(prefixes ...string) Validator {
+	return prefix{prefixes: prefixes}
+}
+
+func (p prefix) Validate(number string) error {
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(number, prefix) {
+			return nil
+		}
+	}
+	return &Error{Rule: RulePrefix, Reason: "must start with one of " + strings.Join(p.prefixes, ", ")}
+}
+
+// Parse собирает цепочку из строки настройки вида "regex=^[0-9]+$;length=1-64;prefix=12,34;luhn".
+// Правила разделяются точкой с запятой и применяются в указанном порядке.
+// У length можно задать только одну границу: "length=-32" или "length=8-".
+func Parse(spec string) (Chain, error) {
+	var chain Chain
+	for _, rule := range strings.Split(spec, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		name, arg, _ := strings.Cut(rule, "=")
+		v, err := parseRule(strings.TrimSpace(name), arg)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule, err)
+		}
+		chain = append(chain, v)
+	}
+	return chain, nil
+}
+
+func parseRule(name, arg string) (Validator, error) {
+	switch name {
+	case RuleLuhn:
+		return Luhn(), nil
+	case RuleRegex:
+		return Regex(arg)
+	case RuleLength:
+		minArg, maxArg, ok := strings.Cut(arg, "-")
+		if !ok {
+			return nil, errors.New("expected min-max")
+		}
+		var minLen, maxLen int
+		var err error
+		if minArg != "" {
+			if minLen, err = strconv.Atoi(minArg); err != nil {
+				return nil, err
+			}
+		}
+		if maxArg != "" {
+			if maxLen, err = strconv.Atoi(maxArg); err != nil {
+				return nil, err
+			}
+		}
+		if maxLen > 0 && minLen > maxLen {
+			return nil, errors.New("min is greater than max")
+		}
+		return Length(minLen, maxLen), nil
+	case RulePrefix:
+		var prefixes []string
+		for _, prefix := range strings.Split(arg, ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		if len(prefixes) == 0 {
+			return nil, errors.New("no prefixes")
+		}
+		return Prefix(prefixes...), nil
+	default:
+		return nil, ErrUnknownRule
+	}
+}
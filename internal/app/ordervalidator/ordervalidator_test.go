@@ -0,0 +1,46 @@
+package ordervalidator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	chain, err := Parse(`regex=^[0-9A-Z]+$; length=4-24; prefix=37,41,AB; luhn`)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		number string
+		rule   string
+	}{
+		{name: "valid numeric", number: "378282246310005"},
+		{name: "valid longer than int64", number: "411111111111111111117"},
+		{name: "non-numeric skips luhn", number: "AB12345"},
+		{name: "bad characters", number: "37-8282", rule: RuleRegex},
+		{name: "too short", number: "37", rule: RuleLength},
+		{name: "too long", number: "3782822463100053782822463", rule: RuleLength},
+		{name: "wrong prefix", number: "5555555555554444", rule: RulePrefix},
+		{name: "bad check digit", number: "378282246310006", rule: RuleLuhn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := chain.Validate(tt.number)
+			if tt.rule == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var validationErr *Error
+			require.ErrorAs(t, err, &validationErr)
+			assert.Equal(t, tt.rule, validationErr.Rule)
+			assert.Contains(t, err.Error(), tt.rule)
+		})
+	}
+
+	for _, spec := range []string{"checksum", "regex=[", "length=10", "length=10-2", "prefix="} {
+		_, err := Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
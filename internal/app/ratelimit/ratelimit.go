@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// MinRate - ниже этой скорости ограничитель не опускается после ответов 429
+	MinRate = 0.1
+	// RecoverAfter - через сколько времени без ответов 429 скорость удваивается до исходной
+	RecoverAfter = time.Minute
+)
+
+// TokenBucket - ограничитель частоты запросов, общий для нескольких воркеров.
+// После ответа 429 запросы приостанавливаются на Retry-After, а скорость снижается вдвое
+// и постепенно восстанавливается, если ответов 429 больше нет.
+type TokenBucket struct {
+	mu          sync.Mutex
+	maxRate     float64
+	rate        float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	throttledAt time.Time
+	now         func() time.Time
+}
+
+// New создаёт ограничитель на rate запросов в секунду с запасом burst. rate 0 - без ограничения.
+func New(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	b := &TokenBucket{maxRate: rate, rate: rate, burst: float64(burst), tokens: float64(burst), now: time.Now}
+	b.last = b.now()
+	return b
+}
+
+// Wait ждёт, пока можно будет отправить запрос, или отмены контекста.
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	for {
+		delay := b.reserve()
+		if delay <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve забирает токен и возвращает 0 или время, через которое нужно попробовать снова.
+func (b *TokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if now.Before(b.pausedUntil) {
+		return b.pausedUntil.Sub(now)
+	}
+	if b.maxRate <= 0 {
+		return 0
+	}
+	if !b.throttledAt.IsZero() && now.Sub(b.throttledAt) >= RecoverAfter {
+		b.rate = math.Min(b.maxRate, b.rate*2)
+		b.throttledAt = now
+		if b.rate == b.maxRate {
+			b.throttledAt = time.Time{}
+		}
+	}
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Throttle приостанавливает запросы всех воркеров на retryAfter и снижает скорость.
+func (b *TokenBucket) Throttle(retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if until := now.Add(retryAfter); until.After(b.pausedUntil) {
+		b.pausedUntil = until
+	}
+	if b.maxRate > 0 {
+		b.rate = math.Max(b.rate/2, math.Min(MinRate, b.maxRate))
+		b.throttledAt = now
+	}
+	// после паузы запросы идут с новой скоростью, без накопленного запаса
+	b.tokens = 0
+	b.last = b.pausedUntil
+}
+
+// Rate - текущая скорость в запросах в секунду
+func (b *TokenBucket) Rate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
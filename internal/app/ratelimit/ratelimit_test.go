@@ -0,0 +1,41 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	b := New(10, 2)
+	b.now = func() time.Time { return now }
+	b.last = now
+
+	assert.Zero(t, b.reserve())
+	assert.Zero(t, b.reserve())
+	assert.Equal(t, 100*time.Millisecond, b.reserve())
+
+	now = now.Add(100 * time.Millisecond)
+	assert.Zero(t, b.reserve())
+
+	b.Throttle(5 * time.Second)
+	assert.Equal(t, 5.0, b.Rate())
+	assert.Equal(t, 5*time.Second, b.reserve())
+
+	now = now.Add(5 * time.Second)
+	assert.Equal(t, 200*time.Millisecond, b.reserve())
+	now = now.Add(200 * time.Millisecond)
+	assert.Zero(t, b.reserve())
+
+	now = now.Add(RecoverAfter)
+	assert.Zero(t, b.reserve())
+	assert.Equal(t, 10.0, b.Rate())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.Throttle(time.Hour)
+	assert.ErrorIs(t, b.Wait(ctx), context.Canceled)
+}
@@ -8,18 +8,25 @@ import (
 	"github.com/nasik90/gophermart/internal/app/handler"
 	"github.com/nasik90/gophermart/internal/app/logger"
 	middleware "github.com/nasik90/gophermart/internal/app/middlewares"
+	"github.com/nasik90/gophermart/internal/app/storage"
 	"go.uber.org/zap"
 )
 
 type Server struct {
 	http.Server
-	handler *handler.Handler
+	handler     *handler.Handler
+	auth        *middleware.Authenticator
+	idempotency *middleware.Idempotency
+	proxies     *middleware.TrustedProxies
 }
 
-func NewServer(handler *handler.Handler, serverAddress string) *Server {
+func NewServer(handler *handler.Handler, auth *middleware.Authenticator, idempotency *middleware.Idempotency, proxies *middleware.TrustedProxies, serverAddress string) *Server {
 	s := &Server{}
 	s.Addr = serverAddress
 	s.handler = handler
+	s.auth = auth
+	s.idempotency = idempotency
+	s.proxies = proxies
 	return s
 }
 
@@ -32,15 +39,48 @@ func (s *Server) RunServer() error {
 	r.Route("/api", func(r chi.Router) {
 		r.Post("/user/register", s.handler.RegisterNewUser())
 		r.Post("/user/login", s.handler.LoginUser())
-		r.Post("/user/orders", middleware.Auth(s.handler.LoadOrder()))
-		r.Get("/user/orders", middleware.Auth(s.handler.GetOrderList()))
-		r.Get("/user/balance", middleware.Auth(s.handler.GetUserBalance()))
+		// второй шаг входа для пользователей с включённым TOTP
+		r.Post("/user/login/2fa", s.handler.LoginTOTP())
+		// вход через внешний OpenID Connect провайдер
+		r.Get("/user/oidc/login", s.handler.OIDCLogin())
+		r.Get("/user/oidc/callback", s.handler.OIDCCallback())
+		r.Get("/user/oidc/link", s.user(s.handler.OIDCLink()))
+		// повторное подтверждение входа у провайдера перед удалением учётной записи без пароля
+		r.Get("/user/oidc/reauth", s.user(s.handler.OIDCReauth()))
+		r.Post("/user/token/refresh", s.handler.RefreshToken())
+		r.Post("/user/logout", s.user(s.handler.Logout()))
+		r.Post("/user/password", s.user(s.handler.ChangePassword()))
+		r.Post("/user/password/reset/request", s.handler.RequestPasswordReset())
+		r.Post("/user/password/reset", s.handler.ResetPassword())
+		r.Get("/user/export", s.user(s.handler.ExportUserData()))
+		r.Delete("/user", s.user(s.handler.DeleteUser()))
+		r.Get("/user/sessions", s.user(s.handler.GetSessions()))
+		r.Delete("/user/sessions/{id}", s.user(s.handler.RevokeSession()))
+		r.Post("/user/2fa", s.user(s.handler.EnrollTOTP()))
+		r.Post("/user/2fa/confirm", s.user(s.handler.ConfirmTOTP()))
+		r.Post("/user/2fa/disable", s.user(s.handler.DisableTOTP()))
+		r.Post("/user/keys", s.user(s.handler.CreateAPIKey()))
+		r.Get("/user/keys", s.user(s.handler.GetAPIKeys()))
+		r.Delete("/user/keys/{id}", s.user(s.handler.RevokeAPIKey()))
+		// эндпоинты, для которых указаны разрешения, доступны и по API-ключу
+		// загрузку заказов и списание можно безопасно повторить с заголовком Idempotency-Key
+		r.Post("/user/orders", s.user(s.idempotency.Handle(s.handler.LoadOrder()), storage.ScopeOrdersWrite))
+		r.Post("/user/orders/batch", s.user(s.idempotency.Handle(s.handler.LoadOrders()), storage.ScopeOrdersWrite))
+		r.Get("/user/orders", s.user(s.handler.GetOrderList(), storage.ScopeOrdersRead))
+		r.Get("/user/orders/{number}", s.user(s.handler.GetOrder(), storage.ScopeOrdersRead))
+		r.Get("/user/balance", s.user(s.handler.GetUserBalance(), storage.ScopeBalanceRead))
 		// списание баллов
-		r.Post("/user/balance/withdraw", middleware.Auth(s.handler.WithdrawPoints()))
+		r.Post("/user/balance/withdraw", s.user(s.idempotency.Handle(s.handler.WithdrawPoints()), storage.ScopeBalanceWrite))
 		// список списаний
-		r.Get("/user/withdrawals", middleware.Auth(s.handler.GetWithdrawals()))
+		r.Get("/user/withdrawals", s.user(s.handler.GetWithdrawals(), storage.ScopeBalanceRead))
+
+		r.Post("/admin/user/unlock", s.admin(s.handler.UnlockLogin()))
+		r.Put("/admin/user/role", s.admin(s.handler.SetUserRole()))
+		// заказы, которые система начислений так и не обработала
+		r.Get("/admin/orders/stuck", s.admin(s.handler.GetStuckOrders()))
+		r.Post("/admin/orders/{number}/requeue", s.admin(s.handler.RequeueOrder()))
 	})
-	s.Handler = logger.RequestLogger((middleware.GzipMiddleware(r.ServeHTTP)))
+	s.Handler = logger.RequestLogger(s.proxies.Handle(middleware.GzipMiddleware(r.ServeHTTP)))
 	err := s.ListenAndServe()
 	if err != nil {
 		return err
@@ -49,6 +89,17 @@ func (s *Server) RunServer() error {
 	return nil
 }
 
+// user оборачивает эндпоинт, доступный вошедшим пользователям. Изменяющие запросы
+// с аутентификацией по cookie дополнительно проверяются на CSRF.
+func (s *Server) user(h http.HandlerFunc, scopes ...string) http.HandlerFunc {
+	return s.auth.Auth(middleware.CSRF(h), scopes...)
+}
+
+// admin оборачивает эндпоинт, доступный только администраторам.
+func (s *Server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return s.user(middleware.RequireRole(h, storage.RoleAdmin))
+}
+
 func (s *Server) StopServer() error {
 	return s.Shutdown(context.Background())
 }
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nasik90/gophermart/internal/app/storage"
+)
+
+const anonymousLoginPrefix = "deleted-"
+
+var ErrReauthRequired = errors.New("password, two-factor code or fresh oidc login is required")
+
+// ExportUserData возвращает все данные пользователя: профиль, заказы, историю статусов и движения баллов.
+func (s *Service) ExportUserData(ctx context.Context, login string) (*storage.UserExport, error) {
+	return s.repo.ExportUserData(ctx, login)
+}
+
+// DeleteUser удаляет учётную запись после проверки пароля. Логин обезличивается,
+// а заказы и движения баллов сохраняются для учёта. Неверный пароль учитывается в блокировке входа.
+// Пользователь с привязанной внешней учётной записью может не знать пароля: вместо него
+// принимается код второго фактора или недавнее повторное подтверждение входа у провайдера.
+func (s *Service) DeleteUser(ctx context.Context, login, password, otpCode, ip string) error {
+	if password != "" {
+		isValid, err := s.UserIsValid(ctx, login, password, ip)
+		if err != nil {
+			return err
+		}
+		if !isValid {
+			return ErrWrongPassword
+		}
+	} else if err := s.checkDeleteReauth(ctx, login, otpCode); err != nil {
+		return err
+	}
+	token, err := newRandomToken()
+	if err != nil {
+		return err
+	}
+	return s.repo.AnonymizeUser(ctx, login, anonymousLoginPrefix+hashToken(token)[:16])
+}
+
+// checkDeleteReauth подтверждает удаление без пароля для пользователя с привязанной внешней учётной записью.
+// Повторное подтверждение входа используется один раз, даже если удаление подтверждено кодом.
+func (s *Service) checkDeleteReauth(ctx context.Context, login, otpCode string) error {
+	reauthenticatedAt, err := s.repo.TakeReauthentication(ctx, login)
+	if errors.Is(err, storage.ErrIdentityNotFound) {
+		return ErrWrongPassword
+	}
+	if err != nil {
+		return err
+	}
+	if otpCode != "" {
+		return s.verifyOTP(ctx, login, otpCode, stepUpAttemptsKey(login), "")
+	}
+	if time.Since(reauthenticatedAt) > oidcReauthExp {
+		return ErrReauthRequired
+	}
+	return nil
+}
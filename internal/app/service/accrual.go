@@ -0,0 +1,280 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nasik90/gophermart/internal/app/accrual"
+	"github.com/nasik90/gophermart/internal/app/logger"
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultRetryAfter - пауза после ответа 429 без заголовка Retry-After
+	defaultRetryAfter       = 5 * time.Second
+	defaultAccrualBatchSize = 100
+	defaultAccrualLease     = time.Minute
+	defaultAccrualRetryBase = time.Second
+	defaultAccrualRetryMax  = 10 * time.Minute
+)
+
+// AccrualClient - система расчёта начислений.
+// Ошибки различаются через errors.Is и errors.As с ошибками пакета accrual.
+type AccrualClient interface {
+	GetOrder(ctx context.Context, orderID storage.OrderNumber) (*accrual.Order, error)
+}
+
+// pollResult - итог опроса системы начислений по заказу
+type pollResult int
+
+const (
+	// pollDone - заказ получил окончательный статус или не опрашивался из-за остановки и лимита
+	pollDone pollResult = iota
+	// pollPending - статус ещё не окончательный или система недоступна: опрос откладывается
+	pollPending
+	// pollFailed - система не знает заказ или ответила неразборчиво: опрос откладывается
+	// и засчитывается в неудачные, после которых заказ переводится в STUCK
+	pollFailed
+)
+
+type accrualJob struct {
+	order storage.ClaimedOrder
+	done  *sync.WaitGroup
+}
+
+// HandleOrderQueue опрашивает систему начислений по заказам в статусах NEW и PROCESSING.
+// Заказы берутся в аренду, поэтому несколько экземпляров сервиса не опрашивают один заказ.
+// Заказы раздаются пулу воркеров, запросы которых ограничены общим лимитером.
+// После сигнала stop новые заказы не раздаются, начатые запросы дорабатываются.
+// Без клиента системы начислений в Config заказы не опрашиваются.
+func (s *Service) HandleOrderQueue(stop <-chan bool) {
+	if s.accrualClient == nil {
+		logger.Log.Error("accrual client is not configured, orders are not polled")
+		return
+	}
+	ctx := context.Background()
+	// ожидание лимитера прерывается при остановке, запросы к системе и базе - нет
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan accrualJob)
+	var workers sync.WaitGroup
+	for i := 0; i < s.accrualWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				s.processOrder(ctx, waitCtx, job.order)
+				job.done.Done()
+			}
+		}()
+	}
+	defer func() {
+		cancel()
+		close(jobs)
+		workers.Wait()
+		logger.Log.Info("accrual workers stopped")
+	}()
+
+	forIter := 0
+	for {
+		orders, err := s.repo.ClaimOrders(ctx, s.instanceID, s.accrualBatchSize, time.Now().Add(s.accrualLease))
+		if err != nil {
+			logger.Log.Error("select orders for processing in accrual service", zap.String("error", err.Error()))
+			return
+		}
+		var batch sync.WaitGroup
+		for i, order := range orders {
+			batch.Add(1)
+			select {
+			case jobs <- accrualJob{order: order, done: &batch}:
+			case <-stop:
+				batch.Done()
+				// не розданные заказы сразу отдаём другим экземплярам
+				for _, order := range orders[i:] {
+					s.releaseOrder(ctx, order.Number)
+				}
+				return
+			}
+		}
+		// Следующая выборка после обработки текущей. Аренда при этом не продлевается: заказ,
+		// аренда которого истекла в ожидании воркера или лимитера, пропускается, а результат опроса
+		// записывается, только если аренду не забрал другой экземпляр.
+		batch.Wait()
+
+		// Если нет заказов для обработки, то сделаем паузу
+		// Пауза равна от 1 по нарастающей, максимум 3 секунды
+		pause := time.Duration(0)
+		if len(orders) == 0 {
+			forIter++
+			pause = time.Duration(forIter) * time.Second
+			if forIter == 3 {
+				forIter = 0
+			}
+		} else {
+			forIter = 0
+		}
+		select {
+		case <-time.After(pause):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// processOrder опрашивает систему начислений по заказу и решает, что делать с арендой:
+// отпустить, отложить следующий опрос или перевести заказ в STUCK.
+func (s *Service) processOrder(ctx, waitCtx context.Context, order storage.ClaimedOrder) {
+	if !time.Now().Before(order.LeaseUntil) {
+		// заказ уже мог забрать другой экземпляр, его опросит следующая выборка
+		logger.Log.Warn("order lease expired before poll", zap.String("order", string(order.Number)))
+		return
+	}
+	result, err := s.handleOrder(ctx, waitCtx, order)
+	if errors.Is(err, storage.ErrOrderLeaseLost) {
+		logger.Log.Warn("order lease lost, poll result discarded", zap.String("order", string(order.Number)))
+		return
+	}
+	if err != nil && !errors.Is(err, accrual.ErrOrderNotRegistered) {
+		logger.Log.Error("order handle via accrual", zap.String("order", string(order.Number)), zap.String("error", err.Error()))
+	}
+	switch {
+	case result == pollFailed && s.retriesExhausted(order):
+		s.markOrderStuck(ctx, order, err)
+	case result == pollFailed:
+		s.rescheduleOrder(ctx, order, true)
+	case result == pollPending:
+		s.rescheduleOrder(ctx, order, false)
+	default:
+		s.releaseOrder(ctx, order.Number)
+	}
+}
+
+func (s *Service) releaseOrder(ctx context.Context, orderID storage.OrderNumber) {
+	if err := s.repo.ReleaseOrder(ctx, orderID, s.instanceID); err != nil {
+		logger.Log.Error("release order lease", zap.String("order", string(orderID)), zap.String("error", err.Error()))
+	}
+}
+
+// rescheduleOrder откладывает следующий опрос заказа на паузу, растущую с числом попыток.
+// failure - опрос засчитывается в неудачные, после которых заказ переводится в STUCK.
+func (s *Service) rescheduleOrder(ctx context.Context, order storage.ClaimedOrder, failure bool) {
+	nextAttemptAt := time.Now().Add(s.retryDelay(order.Attempts + 1))
+	if err := s.repo.RescheduleOrder(ctx, order.Number, s.instanceID, nextAttemptAt, failure); err != nil {
+		logger.Log.Error("reschedule order", zap.String("order", string(order.Number)), zap.String("error", err.Error()))
+	}
+}
+
+// retriesExhausted сообщает, что заказ после очередного неудачного опроса пора перевести в STUCK:
+// неудачная попытка последняя или заказ опрашивается дольше accrualMaxAge
+func (s *Service) retriesExhausted(order storage.ClaimedOrder) bool {
+	if s.accrualMaxAttempts > 0 && order.Failures+1 >= s.accrualMaxAttempts {
+		return true
+	}
+	return s.accrualMaxAge > 0 && time.Since(order.PollingSince) >= s.accrualMaxAge
+}
+
+// markOrderStuck переводит заказ в STUCK, lastErr - ошибка последней попытки, если была
+func (s *Service) markOrderStuck(ctx context.Context, order storage.ClaimedOrder, lastErr error) {
+	reason := fmt.Sprintf("no final status after %d failed of %d attempts since %s",
+		order.Failures+1, order.Attempts+1, order.PollingSince.Format(time.RFC3339))
+	if lastErr != nil {
+		reason += ": " + lastErr.Error()
+	}
+	if err := s.repo.MarkOrderStuck(ctx, order.Number, s.instanceID, reason); err != nil {
+		logger.Log.Error("mark order stuck", zap.String("order", string(order.Number)), zap.String("error", err.Error()))
+		return
+	}
+	logger.Log.Warn("order is stuck", zap.String("order", string(order.Number)), zap.String("reason", reason))
+}
+
+// retryDelay - пауза перед попыткой attempt: экспоненциальный рост от accrualRetryBase
+// до accrualRetryMax со случайным разбросом в половину паузы, чтобы повторы не шли волной.
+func (s *Service) retryDelay(attempt int) time.Duration {
+	delay := s.accrualRetryMax
+	if attempt < 32 {
+		if d := s.accrualRetryBase << (attempt - 1); d > 0 && d < delay {
+			delay = d
+		}
+	}
+	half := delay / 2
+	return half + time.Duration(mathrand.Int64N(int64(half)+1))
+}
+
+// newInstanceID - идентификатор экземпляра из имени хоста, pid и случайной части,
+// уникальный и после перезапуска на том же хосте
+func newInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "gophermart"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// handleOrder запрашивает статус заказа в системе начислений и сохраняет результат
+func (s *Service) handleOrder(ctx, waitCtx context.Context, order storage.ClaimedOrder) (pollResult, error) {
+	orderID := order.Number
+	leaseCtx, cancel := context.WithDeadline(waitCtx, order.LeaseUntil)
+	defer cancel()
+	if err := s.accrualLimiter.Wait(leaseCtx); err != nil {
+		// остановка или истечение аренды: заказ опросит следующая выборка
+		return pollDone, nil
+	}
+	accrualData, err := s.accrualClient.GetOrder(ctx, orderID)
+	var rateLimitErr *accrual.RateLimitError
+	switch {
+	case errors.As(err, &rateLimitErr):
+		pause := defaultRetryAfter
+		if rateLimitErr.RetryAfter > 0 {
+			pause = rateLimitErr.RetryAfter
+		}
+		// заказ будет запрошен снова при следующей выборке
+		// попытка не засчитывается заказу: запросы приостановлены лимитером для всех
+		s.accrualLimiter.Throttle(pause)
+		logger.Log.Warn("accrual rate limited", zap.Duration("retry_after", pause), zap.Float64("rate", s.accrualLimiter.Rate()))
+		return pollDone, nil
+	case errors.Is(err, accrual.ErrNetwork), errors.Is(err, accrual.ErrServer):
+		// система недоступна для всех заказов: запросы замедляются лимитером,
+		// а заказу откладывается опрос без засчитывания неудачи
+		s.accrualLimiter.Throttle(defaultRetryAfter)
+		return pollPending, err
+	case errors.Is(err, accrual.ErrOrderNotRegistered), errors.Is(err, accrual.ErrDecode), errors.Is(err, accrual.ErrUnexpectedStatus):
+		return pollFailed, err
+	case err != nil:
+		return pollPending, err
+	}
+
+	switch accrualData.Status {
+	case accrual.StatusREGISTERED:
+		return pollPending, nil
+	case accrual.StatusINVALID:
+		if err := s.repo.SaveStatus(ctx, orderID, s.instanceID, storage.StatusINVALID); err != nil {
+			return pollPending, errors.Join(errors.New("status: "+accrual.StatusINVALID), err)
+		}
+	case accrual.StatusPROCESSING:
+		// повторный PROCESSING не пишется в историю статусов
+		if order.StatusID != storage.StatusPROCESSING {
+			if err := s.repo.SaveStatus(ctx, orderID, s.instanceID, storage.StatusPROCESSING); err != nil {
+				return pollPending, errors.Join(errors.New("status: "+accrual.StatusPROCESSING), err)
+			}
+		}
+		return pollPending, nil
+	case accrual.StatusPROCESSED:
+		if err := s.repo.AccruePoints(ctx, orderID, s.instanceID, accrualData.Accrual); err != nil {
+			return pollPending, errors.Join(errors.New("status: "+accrual.StatusPROCESSED), err)
+		}
+	default:
+		return pollFailed, fmt.Errorf("%w: unknown status %q", accrual.ErrDecode, accrualData.Status)
+	}
+	return pollDone, nil
+}
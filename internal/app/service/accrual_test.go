@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/nasik90/gophermart/internal/app/accrual"
+	mock_service "github.com/nasik90/gophermart/internal/app/mocks"
+	"github.com/nasik90/gophermart/internal/app/storage"
+)
+
+// accrualClientFunc позволяет задать ответ системы начислений функцией
+type accrualClientFunc func(ctx context.Context, orderID storage.OrderNumber) (*accrual.Order, error)
+
+func (f accrualClientFunc) GetOrder(ctx context.Context, orderID storage.OrderNumber) (*accrual.Order, error) {
+	return f(ctx, orderID)
+}
+
+func TestService_ProcessOrder(t *testing.T) {
+	const orderID = storage.OrderNumber("378282246310005")
+	tests := []struct {
+		name     string
+		failures int
+		expired  bool
+		order    *accrual.Order
+		err      error
+		expect   func(repo *mock_service.MockRepository)
+	}{
+		{
+			name:  "processed",
+			order: &accrual.Order{Status: accrual.StatusPROCESSED, Accrual: 500},
+			expect: func(repo *mock_service.MockRepository) {
+				repo.EXPECT().AccruePoints(gomock.Any(), orderID, "test", 500.0).Return(nil)
+				repo.EXPECT().ReleaseOrder(gomock.Any(), orderID, "test").Return(nil)
+			},
+		},
+		{
+			name:    "expired lease is not polled",
+			expired: true,
+			order:   &accrual.Order{Status: accrual.StatusPROCESSED, Accrual: 500},
+			expect:  func(repo *mock_service.MockRepository) {},
+		},
+		{
+			name:  "lost lease discards result",
+			order: &accrual.Order{Status: accrual.StatusPROCESSED, Accrual: 500},
+			expect: func(repo *mock_service.MockRepository) {
+				repo.EXPECT().AccruePoints(gomock.Any(), orderID, "test", 500.0).Return(storage.ErrOrderLeaseLost)
+			},
+		},
+		{
+			name:  "registered does not count as failure",
+			order: &accrual.Order{Status: accrual.StatusREGISTERED},
+			expect: func(repo *mock_service.MockRepository) {
+				repo.EXPECT().RescheduleOrder(gomock.Any(), orderID, "test", gomock.Any(), false).Return(nil)
+			},
+		},
+		{
+			name: "accrual system outage does not count as failure",
+			err:  fmt.Errorf("%w: connection refused", accrual.ErrNetwork),
+			expect: func(repo *mock_service.MockRepository) {
+				repo.EXPECT().RescheduleOrder(gomock.Any(), orderID, "test", gomock.Any(), false).Return(nil)
+			},
+		},
+		{
+			name: "accrual system error does not count as failure",
+			err:  &accrual.StatusError{StatusCode: 503},
+			expect: func(repo *mock_service.MockRepository) {
+				repo.EXPECT().RescheduleOrder(gomock.Any(), orderID, "test", gomock.Any(), false).Return(nil)
+			},
+		},
+		{
+			name:  "unknown status counts as failure",
+			order: &accrual.Order{Status: "LOST"},
+			expect: func(repo *mock_service.MockRepository) {
+				repo.EXPECT().RescheduleOrder(gomock.Any(), orderID, "test", gomock.Any(), true).Return(nil)
+			},
+		},
+		{
+			name: "not registered counts as failure",
+			err:  accrual.ErrOrderNotRegistered,
+			expect: func(repo *mock_service.MockRepository) {
+				repo.EXPECT().RescheduleOrder(gomock.Any(), orderID, "test", gomock.Any(), true).Return(nil)
+			},
+		},
+		{
+			name:     "last failure marks order stuck",
+			failures: 2,
+			err:      fmt.Errorf("%w: unexpected EOF", accrual.ErrDecode),
+			expect: func(repo *mock_service.MockRepository) {
+				repo.EXPECT().MarkOrderStuck(gomock.Any(), orderID, "test", gomock.Any()).Return(nil)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			repo := mock_service.NewMockRepository(ctrl)
+			s := NewService(repo, nil, nil, Config{
+				InstanceID:         "test",
+				AccrualMaxAttempts: 3,
+				AccrualClient: accrualClientFunc(func(context.Context, storage.OrderNumber) (*accrual.Order, error) {
+					return tt.order, tt.err
+				}),
+			})
+			tt.expect(repo)
+			leaseUntil := time.Now().Add(time.Minute)
+			if tt.expired {
+				leaseUntil = time.Now().Add(-time.Second)
+			}
+			ctx := context.Background()
+			s.processOrder(ctx, ctx, storage.ClaimedOrder{
+				Number:       orderID,
+				StatusID:     storage.StatusNEW,
+				Attempts:     10,
+				Failures:     tt.failures,
+				PollingSince: time.Now(),
+				LeaseUntil:   leaseUntil,
+			})
+		})
+	}
+}
+
+func TestService_HandleOrderQueueWithoutClient(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	// без клиента заказы не берутся в аренду
+	s := NewService(mock_service.NewMockRepository(ctrl), nil, nil, Config{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.HandleOrderQueue(make(chan bool))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("HandleOrderQueue does not return without accrual client")
+	}
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nasik90/gophermart/internal/app/storage"
+)
+
+const (
+	apiKeyPrefix     = "gm_"
+	apiKeyShownChars = 10
+	// apiKeyTouchInterval - время использования ключа обновляется не чаще этого интервала
+	apiKeyTouchInterval = time.Minute
+)
+
+var ErrUnknownScope = errors.New("unknown api key scope")
+
+// AllScopes - разрешения, которые получает ключ, если они не указаны при создании.
+var AllScopes = []string{
+	storage.ScopeOrdersRead,
+	storage.ScopeOrdersWrite,
+	storage.ScopeBalanceRead,
+	storage.ScopeBalanceWrite,
+}
+
+// CreateAPIKey создаёт API-ключ и возвращает его. В базе хранится только хеш,
+// поэтому получить ключ повторно нельзя.
+func (s *Service) CreateAPIKey(ctx context.Context, login, name string, scopes []string) (string, *storage.APIKey, error) {
+	if len(scopes) == 0 {
+		scopes = AllScopes
+	}
+	for _, scope := range scopes {
+		if !knownScope(scope) {
+			return "", nil, fmt.Errorf("%w: %s", ErrUnknownScope, scope)
+		}
+	}
+	token, err := newRandomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	key := apiKeyPrefix + token
+	apiKey := &storage.APIKey{
+		Name:      name,
+		Prefix:    key[:apiKeyShownChars],
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+	if err := s.repo.SaveAPIKey(ctx, login, hashToken(key), apiKey); err != nil {
+		return "", nil, err
+	}
+	return key, apiKey, nil
+}
+
+func (s *Service) GetAPIKeys(ctx context.Context, login string) ([]storage.APIKey, error) {
+	return s.repo.GetAPIKeys(ctx, login)
+}
+
+func (s *Service) RevokeAPIKey(ctx context.Context, login string, id int) error {
+	return s.repo.RevokeAPIKey(ctx, login, id)
+}
+
+// AuthenticateAPIKey возвращает логин владельца ключа и разрешения ключа.
+func (s *Service) AuthenticateAPIKey(ctx context.Context, key string) (string, []string, error) {
+	now := time.Now()
+	return s.repo.UseAPIKey(ctx, hashToken(key), now, now.Add(-apiKeyTouchInterval))
+}
+
+func knownScope(scope string) bool {
+	for _, known := range AllScopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/nasik90/gophermart/internal/app/storage"
+)
+
+const (
+	defaultIdempotencyKeyTTL = 24 * time.Hour
+	// idempotencyKeyLease - сколько ключ считается занятым запросом без ответа. Если сервис упал,
+	// не сохранив ответ, по истечении аренды запрос с ключом можно повторить.
+	idempotencyKeyLease = time.Minute
+)
+
+// StartIdempotentRequest занимает ключ идемпотентности. Если запрос с этим ключом уже выполнен,
+// возвращается его ответ, который нужно отдать клиенту вместо повторного выполнения.
+func (s *Service) StartIdempotentRequest(ctx context.Context, login, key, fingerprint string) (*storage.IdempotentResponse, error) {
+	ttl := s.idempotencyKeyTTL
+	if ttl <= 0 {
+		ttl = defaultIdempotencyKeyTTL
+	}
+	now := time.Now()
+	return s.repo.StartIdempotentRequest(ctx, login, key, fingerprint, now.Add(idempotencyKeyLease), now.Add(ttl))
+}
+
+// FinishIdempotentRequest сохраняет ответ на запрос, занявший ключ
+func (s *Service) FinishIdempotentRequest(ctx context.Context, login, key string, response storage.IdempotentResponse) error {
+	return s.repo.SaveIdempotentResponse(ctx, login, key, response)
+}
+
+// ReleaseIdempotencyKey освобождает ключ без сохранения ответа
+func (s *Service) ReleaseIdempotencyKey(ctx context.Context, login, key string) error {
+	return s.repo.DeleteIdempotencyKey(ctx, login, key)
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/nasik90/gophermart/internal/app/storage"
+)
+
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// Порядок сортировки списков, по умолчанию сначала новые
+const (
+	SortNewest = "desc"
+	SortOldest = "asc"
+)
+
+var ErrInvalidListParams = errors.New("invalid list parameters")
+
+// OrderStatuses - статусы, по которым можно отфильтровать список заказов
+var OrderStatuses = []string{"NEW", "PROCESSING", "INVALID", "PROCESSED", "STUCK"}
+
+// ListParams - параметры запроса списка. Cursor - значение, полученное с предыдущей страницей.
+type ListParams struct {
+	Statuses []string
+	From     time.Time
+	To       time.Time
+	Sort     string
+	Limit    int
+	Cursor   string
+}
+
+// GetOrderList возвращает страницу заказов пользователя и курсор следующей страницы.
+// Пустой курсор означает, что страница последняя.
+func (s *Service) GetOrderList(ctx context.Context, login string, params ListParams) (*[]storage.OrderData, string, error) {
+	for _, status := range params.Statuses {
+		if !slices.Contains(OrderStatuses, status) {
+			return nil, "", fmt.Errorf("%w: unknown status %s", ErrInvalidListParams, status)
+		}
+	}
+	filter, err := params.filter()
+	if err != nil {
+		return nil, "", err
+	}
+	orders, err := s.repo.GetOrderList(ctx, login, filter)
+	if err != nil || orders == nil || len(*orders) < filter.Limit {
+		return orders, "", err
+	}
+	page := (*orders)[:filter.Limit-1]
+	last := page[len(page)-1]
+	cursor, err := encodeCursor(storage.ListCursor{Time: last.UploadedAt, ID: storage.OrderNumber(last.Number)})
+	return &page, cursor, err
+}
+
+// GetWithdrawals возвращает страницу списаний пользователя и курсор следующей страницы
+func (s *Service) GetWithdrawals(ctx context.Context, login string, params ListParams) (*[]storage.Withdrawals, string, error) {
+	if len(params.Statuses) != 0 {
+		return nil, "", fmt.Errorf("%w: withdrawals have no status", ErrInvalidListParams)
+	}
+	filter, err := params.filter()
+	if err != nil {
+		return nil, "", err
+	}
+	withdrawals, err := s.repo.GetWithdrawals(ctx, login, filter)
+	if err != nil || withdrawals == nil || len(*withdrawals) < filter.Limit {
+		return withdrawals, "", err
+	}
+	page := (*withdrawals)[:filter.Limit-1]
+	last := page[len(page)-1]
+	cursor, err := encodeCursor(storage.ListCursor{Time: last.ProcessedAt, ID: storage.OrderNumber(last.Order)})
+	return &page, cursor, err
+}
+
+// filter переводит параметры запроса в фильтр хранилища. Из хранилища запрашивается
+// на одну запись больше страницы, чтобы узнать, есть ли следующая.
+func (p ListParams) filter() (storage.ListFilter, error) {
+	filter := storage.ListFilter{Statuses: p.Statuses, From: p.From, To: p.To}
+	switch p.Sort {
+	case "", SortNewest:
+	case SortOldest:
+		filter.Ascending = true
+	default:
+		return filter, fmt.Errorf("%w: unknown sort %s", ErrInvalidListParams, p.Sort)
+	}
+	if !p.From.IsZero() && !p.To.IsZero() && !p.From.Before(p.To) {
+		return filter, fmt.Errorf("%w: empty date range", ErrInvalidListParams)
+	}
+	limit := p.Limit
+	if limit == 0 {
+		limit = DefaultPageSize
+	}
+	if limit < 0 || limit > MaxPageSize {
+		return filter, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidListParams, MaxPageSize)
+	}
+	filter.Limit = limit + 1
+	if p.Cursor != "" {
+		cursor, err := decodeCursor(p.Cursor)
+		if err != nil {
+			return filter, err
+		}
+		filter.Cursor = cursor
+	}
+	return filter, nil
+}
+
+func encodeCursor(cursor storage.ListCursor) (string, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(value string) (*storage.ListCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidListParams)
+	}
+	var cursor storage.ListCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.Time.IsZero() {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidListParams)
+	}
+	return &cursor, nil
+}
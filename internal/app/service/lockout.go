@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrLoginLocked = errors.New("too many failed login attempts")
+
+// LoginLockedError возвращается, пока вход заблокирован после серии неудачных попыток.
+type LoginLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginLockedError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrLoginLocked, e.RetryAfter)
+}
+
+func (e *LoginLockedError) Unwrap() error {
+	return ErrLoginLocked
+}
+
+// LockoutPolicy задаёт блокировку входа после неудачных попыток.
+// Начиная с MaxFailures-й неудачной попытки вход блокируется на BaseDelay, каждая следующая
+// неудачная попытка удваивает блокировку, но не больше MaxDelay.
+// Счётчик сбрасывается, если неудачных попыток не было дольше ResetAfter.
+type LockoutPolicy struct {
+	LoginMaxFailures int
+	IPMaxFailures    int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	ResetAfter       time.Duration
+}
+
+func loginAttemptsKey(login string) string {
+	return "login:" + login
+}
+
+func ipAttemptsKey(ip string) string {
+	return "ip:" + ip
+}
+
+// otpAttemptsKey - неверные коды второго фактора считаются отдельно от паролей:
+// иначе верный пароль сбрасывал бы счётчик и коды можно было бы перебирать без блокировки
+func otpAttemptsKey(login string) string {
+	return "otp:" + login
+}
+
+// stepUpAttemptsKey - неверные коды при подтверждении операций уже вошедшим пользователем
+// считаются отдельно от входа: укравший токен доступа не должен блокировать владельцу вход
+func stepUpAttemptsKey(login string) string {
+	return "stepup:" + login
+}
+
+func (s *Service) checkLoginLock(ctx context.Context, login, ip string) error {
+	return s.checkLock(ctx, loginAttemptsKey(login), ip)
+}
+
+func (s *Service) checkLock(ctx context.Context, key, ip string) error {
+	keys := []string{key}
+	if ip != "" {
+		keys = append(keys, ipAttemptsKey(ip))
+	}
+	lockedUntil, err := s.repo.LockedUntil(ctx, keys)
+	if err != nil {
+		return err
+	}
+	if retryAfter := time.Until(lockedUntil); retryAfter > 0 {
+		return &LoginLockedError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+func (s *Service) registerLoginFailure(ctx context.Context, login, ip string) error {
+	return s.registerFailures(ctx, loginAttemptsKey(login), ip)
+}
+
+// registerFailures учитывает неудачную попытку по ключу учётной записи и по IP-адресу
+func (s *Service) registerFailures(ctx context.Context, key, ip string) error {
+	if err := s.registerFailure(ctx, key, s.lockout.LoginMaxFailures); err != nil {
+		return err
+	}
+	if ip == "" {
+		return nil
+	}
+	return s.registerFailure(ctx, ipAttemptsKey(ip), s.lockout.IPMaxFailures)
+}
+
+func (s *Service) registerFailure(ctx context.Context, key string, maxFailures int) error {
+	if maxFailures <= 0 {
+		return nil
+	}
+	failures, err := s.repo.RegisterAttempt(ctx, key, time.Now().Add(-s.lockout.ResetAfter))
+	if err != nil {
+		return err
+	}
+	if failures < maxFailures {
+		return nil
+	}
+	return s.repo.LockKey(ctx, key, time.Now().Add(s.lockout.delay(failures-maxFailures)))
+}
+
+func (p LockoutPolicy) delay(extraFailures int) time.Duration {
+	delay := p.BaseDelay
+	for i := 0; i < extraFailures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// UnlockLogin снимает блокировку входа для логина и/или IP-адреса.
+func (s *Service) UnlockLogin(ctx context.Context, login, ip string) error {
+	var keys []string
+	if login != "" {
+		keys = append(keys, loginAttemptsKey(login), otpAttemptsKey(login), stepUpAttemptsKey(login))
+	}
+	if ip != "" {
+		keys = append(keys, ipAttemptsKey(ip))
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return s.repo.ResetAttempts(ctx, keys)
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nasik90/gophermart/internal/app/logger"
+	"github.com/nasik90/gophermart/internal/app/oidc"
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	oidcStateExp         = 10 * time.Minute
+	oidcGeneratedLogin   = "oidc-"
+	oidcGeneratedLoginID = 12
+	// oidcReauthExp - сколько действует повторное подтверждение входа у провайдера
+	oidcReauthExp = 5 * time.Minute
+)
+
+var (
+	ErrOIDCDisabled           = errors.New("oidc login is not configured")
+	ErrReauthIdentityMismatch = errors.New("external identity is not linked to the user")
+)
+
+// IdentityProvider - внешний OpenID Connect провайдер.
+type IdentityProvider interface {
+	AuthCodeURL(state, nonce, codeVerifier string) string
+	Exchange(ctx context.Context, code, codeVerifier, nonce string) (*oidc.Identity, error)
+}
+
+// StartOIDCLogin начинает вход через провайдера и возвращает адрес для перенаправления и state,
+// который клиент должен предъявить при возврате. Если linkLogin задан, внешняя учётная запись
+// будет привязана к этому пользователю.
+func (s *Service) StartOIDCLogin(ctx context.Context, linkLogin string) (string, string, error) {
+	return s.startOIDC(ctx, storage.OIDCState{LinkLogin: linkLogin})
+}
+
+// StartOIDCReauth начинает повторное подтверждение входа у провайдера вошедшим пользователем.
+// Подтверждение заменяет пароль при удалении учётной записи с привязанным провайдером.
+func (s *Service) StartOIDCReauth(ctx context.Context, login string) (string, string, error) {
+	return s.startOIDC(ctx, storage.OIDCState{LinkLogin: login, Reauth: true})
+}
+
+func (s *Service) startOIDC(ctx context.Context, oidcState storage.OIDCState) (string, string, error) {
+	if s.identityProvider == nil {
+		return "", "", ErrOIDCDisabled
+	}
+	state, err := newRandomToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := newRandomToken()
+	if err != nil {
+		return "", "", err
+	}
+	codeVerifier, err := oidc.NewCodeVerifier()
+	if err != nil {
+		return "", "", err
+	}
+	oidcState.Nonce = nonce
+	oidcState.CodeVerifier = codeVerifier
+	oidcState.ExpiresAt = time.Now().Add(oidcStateExp)
+	if err := s.repo.SaveOIDCState(ctx, hashToken(state), oidcState); err != nil {
+		return "", "", err
+	}
+	return s.identityProvider.AuthCodeURL(state, nonce, codeVerifier), state, nil
+}
+
+// FinishOIDCLogin завершает вход по коду от провайдера и возвращает логин пользователя.
+// linked - true, если вход выполнялся уже вошедшим пользователем: внешняя учётная запись
+// привязана к нему или он повторно подтвердил вход. Токены в этом случае не выдаются.
+// Для неизвестной внешней учётной записи создаётся новый пользователь без пароля.
+func (s *Service) FinishOIDCLogin(ctx context.Context, state, code string) (login string, linked bool, err error) {
+	if s.identityProvider == nil {
+		return "", false, ErrOIDCDisabled
+	}
+	oidcState, err := s.repo.TakeOIDCState(ctx, hashToken(state))
+	if err != nil {
+		return "", false, err
+	}
+	identity, err := s.identityProvider.Exchange(ctx, code, oidcState.CodeVerifier, oidcState.Nonce)
+	if err != nil {
+		return "", false, err
+	}
+	if oidcState.Reauth {
+		return oidcState.LinkLogin, true, s.saveReauthentication(ctx, oidcState.LinkLogin, identity)
+	}
+	if oidcState.LinkLogin != "" {
+		return oidcState.LinkLogin, true, s.repo.LinkIdentity(ctx, oidcState.LinkLogin, identity.Issuer, identity.Subject)
+	}
+	login, err = s.repo.GetLoginByIdentity(ctx, identity.Issuer, identity.Subject)
+	if !errors.Is(err, storage.ErrUserNotFound) {
+		return login, false, err
+	}
+	login, err = s.registerExternalUser(ctx, identity)
+	return login, false, err
+}
+
+// saveReauthentication запоминает повторное подтверждение входа, если внешняя учётная запись
+// привязана именно к этому пользователю.
+func (s *Service) saveReauthentication(ctx context.Context, login string, identity *oidc.Identity) error {
+	identityLogin, err := s.repo.GetLoginByIdentity(ctx, identity.Issuer, identity.Subject)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		return ErrReauthIdentityMismatch
+	}
+	if err != nil {
+		return err
+	}
+	if identityLogin != login {
+		return ErrReauthIdentityMismatch
+	}
+	return s.repo.SaveReauthentication(ctx, identity.Issuer, identity.Subject, time.Now())
+}
+
+// registerExternalUser создаёт пользователя для внешней учётной записи. Логин берётся из
+// preferred_username, а если он занят или не подходит под правила - генерируется.
+// Пароль случайный: войти по паролю можно будет только после его сброса.
+func (s *Service) registerExternalUser(ctx context.Context, identity *oidc.Identity) (string, error) {
+	password, err := newRandomToken()
+	if err != nil {
+		return "", err
+	}
+	passwordHash, err := s.hasher.Hash(password)
+	if err != nil {
+		return "", err
+	}
+	generatedLogin := oidcGeneratedLogin + hashToken(identity.Issuer + " " + identity.Subject)[:oidcGeneratedLoginID]
+	login := identity.PreferredUsername
+	if login == "" || len(s.credentials.loginViolations(login)) != 0 {
+		login = generatedLogin
+	}
+	err = s.repo.SaveNewUserWithIdentity(ctx, login, passwordHash, identity.Issuer, identity.Subject)
+	if errors.Is(err, storage.ErrUserNotUnique) && login != generatedLogin {
+		login = generatedLogin
+		err = s.repo.SaveNewUserWithIdentity(ctx, login, passwordHash, identity.Issuer, identity.Subject)
+	}
+	if err != nil {
+		return "", err
+	}
+	logger.Log.Info("user registered via oidc", zap.String("login", login), zap.String("issuer", identity.Issuer))
+	return login, nil
+}
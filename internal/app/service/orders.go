@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nasik90/gophermart/internal/app/storage"
+)
+
+// MaxOrderBatchSize - максимальное количество заказов в одной пакетной загрузке
+const MaxOrderBatchSize = 1000
+
+// Результаты загрузки заказа в пакете
+const (
+	OrderBatchAccepted      = "accepted"
+	OrderBatchDuplicate     = "duplicate"
+	OrderBatchAnotherUser   = "owned_by_another_user"
+	OrderBatchInvalidFormat = "invalid_format"
+)
+
+var (
+	ErrEmptyOrderBatch    = errors.New("order batch is empty")
+	ErrOrderBatchTooLarge = fmt.Errorf("order batch is larger than %d", MaxOrderBatchSize)
+	ErrOrderAccessDenied  = errors.New("order belongs to another user")
+)
+
+// ParseOrderNumber проверяет номер заказа настроенными правилами.
+// Ошибка оборачивает ErrOrderFormat и называет нарушенное правило.
+func (s *Service) ParseOrderNumber(number string) (storage.OrderNumber, error) {
+	number = strings.TrimSpace(number)
+	if number == "" {
+		return "", ErrOrderFormat
+	}
+	if s.orderValidator != nil {
+		if err := s.orderValidator.Validate(number); err != nil {
+			return "", fmt.Errorf("%w: %w", ErrOrderFormat, err)
+		}
+	}
+	return storage.OrderNumber(number), nil
+}
+
+type OrderBatchResult struct {
+	Number string `json:"number"`
+	Result string `json:"result"`
+	// Error - причина отказа для номера неверного формата
+	Error string `json:"error,omitempty"`
+}
+
+// LoadOrders загружает пакет заказов. Номера с неверным форматом пропускаются,
+// остальные сохраняются в одной транзакции. Результаты возвращаются в порядке номеров.
+func (s *Service) LoadOrders(ctx context.Context, numbers []string, login string) ([]OrderBatchResult, error) {
+	if len(numbers) == 0 {
+		return nil, ErrEmptyOrderBatch
+	}
+	if len(numbers) > MaxOrderBatchSize {
+		return nil, ErrOrderBatchTooLarge
+	}
+	result := make([]OrderBatchResult, len(numbers))
+	ids := make([]storage.OrderNumber, 0, len(numbers))
+	positions := make([]int, 0, len(numbers))
+	for i, number := range numbers {
+		result[i].Number = number
+		id, err := s.ParseOrderNumber(number)
+		if err != nil {
+			result[i].Result = OrderBatchInvalidFormat
+			result[i].Error = err.Error()
+			continue
+		}
+		ids = append(ids, id)
+		positions = append(positions, i)
+	}
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	saved, err := s.repo.SaveNewOrders(ctx, ids, login)
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range saved {
+		switch {
+		case item.Err == nil:
+			result[positions[i]].Result = OrderBatchAccepted
+		case errors.Is(item.Err, storage.ErrOrderLoadedByAnotherUser):
+			result[positions[i]].Result = OrderBatchAnotherUser
+		case errors.Is(item.Err, storage.ErrOrderIDNotUnique):
+			result[positions[i]].Result = OrderBatchDuplicate
+		default:
+			return nil, fmt.Errorf("save order %s: %w", ids[i], item.Err)
+		}
+	}
+	return result, nil
+}
+
+// GetOrder возвращает заказ пользователя с историей статусов.
+// Чужой заказ не отдаётся, возвращается ErrOrderAccessDenied.
+func (s *Service) GetOrder(ctx context.Context, login string, number string) (*storage.OrderDetails, error) {
+	orderID, err := s.ParseOrderNumber(number)
+	if err != nil {
+		// номер неверного формата не может быть загружен
+		return nil, storage.ErrOrderNotFound
+	}
+	order, err := s.repo.GetOrder(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.Login != login {
+		return nil, ErrOrderAccessDenied
+	}
+	return order, nil
+}
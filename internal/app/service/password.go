@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nasik90/gophermart/internal/app/storage"
+)
+
+var (
+	ErrWrongPassword        = errors.New("wrong password")
+	ErrTooManyResetRequests = errors.New("too many password reset requests")
+)
+
+// ResetLimitError возвращается, пока запросы сброса пароля для логина или IP-адреса ограничены.
+type ResetLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ResetLimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrTooManyResetRequests, e.RetryAfter)
+}
+
+func (e *ResetLimitError) Unwrap() error {
+	return ErrTooManyResetRequests
+}
+
+// PasswordResetLimit ограничивает запросы сброса пароля: после LoginMaxRequests запросов для логина
+// или IPMaxRequests запросов с одного IP-адреса следующие отклоняются в течение Window.
+// Счётчик сбрасывается, если запросов не было дольше Window. Нулевые значения отключают ограничение.
+type PasswordResetLimit struct {
+	LoginMaxRequests int
+	IPMaxRequests    int
+	Window           time.Duration
+}
+
+func resetLoginKey(login string) string {
+	return "reset:login:" + login
+}
+
+func resetIPKey(ip string) string {
+	return "reset:ip:" + ip
+}
+
+// ChangePassword меняет пароль после проверки текущего, завершает все сессии пользователя и отзывает его API-ключи.
+// Неверный текущий пароль учитывается в блокировке входа так же, как при входе.
+func (s *Service) ChangePassword(ctx context.Context, login, oldPassword, newPassword, ip string) error {
+	isValid, err := s.UserIsValid(ctx, login, oldPassword, ip)
+	if err != nil {
+		return err
+	}
+	if !isValid {
+		return ErrWrongPassword
+	}
+	if err := s.credentials.validatePassword(login, newPassword); err != nil {
+		return err
+	}
+	passwordHash, err := s.hasher.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+	return s.repo.ChangePassword(ctx, login, passwordHash)
+}
+
+// RequestPasswordReset выпускает одноразовый токен сброса пароля и отправляет его пользователю.
+// Для несуществующего логина ничего не делает, чтобы ответ не выдавал наличие пользователя.
+// Частые запросы для одного логина или с одного IP-адреса отклоняются с *ResetLimitError.
+func (s *Service) RequestPasswordReset(ctx context.Context, login, ip string) error {
+	// ограничение проверяется и для несуществующих логинов, иначе по нему можно было бы их отличить
+	if err := s.limitPasswordReset(ctx, login, ip); err != nil {
+		return err
+	}
+	token, err := newRandomToken()
+	if err != nil {
+		return err
+	}
+	err = s.repo.SavePasswordResetToken(ctx, login, hashToken(token), time.Now().Add(s.resetTokenExp))
+	if errors.Is(err, storage.ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.notifier.Notify(ctx, login, "password reset",
+		"use this token to reset your password: "+token+", it expires in "+s.resetTokenExp.String())
+}
+
+// ResetPassword устанавливает новый пароль по токену сброса, завершает все сессии, отзывает API-ключи
+// и снимает блокировку входа по логину.
+func (s *Service) ResetPassword(ctx context.Context, token, newPassword string) error {
+	// Логин до погашения токена неизвестен, поэтому совпадение пароля с логином здесь не проверяется
+	if err := s.credentials.validatePassword("", newPassword); err != nil {
+		return err
+	}
+	passwordHash, err := s.hasher.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+	login, err := s.repo.ResetPassword(ctx, hashToken(token), passwordHash)
+	if err != nil {
+		return err
+	}
+	return s.repo.ResetAttempts(ctx, []string{loginAttemptsKey(login)})
+}
+
+func (s *Service) limitPasswordReset(ctx context.Context, login, ip string) error {
+	keys := []string{resetLoginKey(login)}
+	limits := []int{s.resetLimit.LoginMaxRequests}
+	if ip != "" {
+		keys = append(keys, resetIPKey(ip))
+		limits = append(limits, s.resetLimit.IPMaxRequests)
+	}
+	lockedUntil, err := s.repo.LockedUntil(ctx, keys)
+	if err != nil {
+		return err
+	}
+	if retryAfter := time.Until(lockedUntil); retryAfter > 0 {
+		return &ResetLimitError{RetryAfter: retryAfter}
+	}
+	now := time.Now()
+	for i, key := range keys {
+		if limits[i] <= 0 {
+			continue
+		}
+		requests, err := s.repo.RegisterAttempt(ctx, key, now.Add(-s.resetLimit.Window))
+		if err != nil {
+			return err
+		}
+		if requests >= limits[i] {
+			if err := s.repo.LockKey(ctx, key, now.Add(s.resetLimit.Window)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrPolicyViolation = errors.New("credentials do not satisfy policy")
+
+// PolicyViolation - нарушенное правило политики логинов и паролей.
+type PolicyViolation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PolicyError содержит все правила, которые нарушают переданные логин и пароль.
+type PolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, violation := range e.Violations {
+		messages = append(messages, violation.Message)
+	}
+	return ErrPolicyViolation.Error() + ": " + strings.Join(messages, "; ")
+}
+
+func (e *PolicyError) Unwrap() error {
+	return ErrPolicyViolation
+}
+
+// CredentialsPolicy - требования к логину и паролю. Нулевые значения отключают соответствующие проверки.
+// PasswordMaxLength ограничивает длину пароля в байтах, а не в символах: её диктует алгоритм хеширования.
+// PasswordMinClasses - сколько классов символов (строчные, заглавные, цифры, прочие) должно быть в пароле.
+type CredentialsPolicy struct {
+	LoginMinLength     int
+	LoginMaxLength     int
+	LoginPattern       *regexp.Regexp
+	PasswordMinLength  int
+	PasswordMaxLength  int
+	PasswordMinClasses int
+	BannedPasswords    map[string]struct{}
+}
+
+// LoadBannedPasswords читает список запрещённых паролей, по одному на строку.
+// Сравнение паролей со списком не зависит от регистра.
+func LoadBannedPasswords(path string) (map[string]struct{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if password := strings.TrimSpace(scanner.Text()); password != "" {
+			result[strings.ToLower(password)] = struct{}{}
+		}
+	}
+	return result, scanner.Err()
+}
+
+func (p CredentialsPolicy) validate(login, password string) error {
+	violations := append(p.loginViolations(login), p.passwordViolations(login, password)...)
+	if len(violations) == 0 {
+		return nil
+	}
+	return &PolicyError{Violations: violations}
+}
+
+func (p CredentialsPolicy) validatePassword(login, password string) error {
+	violations := p.passwordViolations(login, password)
+	if len(violations) == 0 {
+		return nil
+	}
+	return &PolicyError{Violations: violations}
+}
+
+func (p CredentialsPolicy) loginViolations(login string) []PolicyViolation {
+	var violations []PolicyViolation
+	length := utf8.RuneCountInString(login)
+	if length == 0 {
+		violations = append(violations, PolicyViolation{Field: "login", Rule: "required", Message: "login is required"})
+	} else if length < p.LoginMinLength {
+		violations = append(violations, PolicyViolation{Field: "login", Rule: "min_length",
+			Message: fmt.Sprintf("login must be at least %d characters long", p.LoginMinLength)})
+	}
+	if p.LoginMaxLength > 0 && length > p.LoginMaxLength {
+		violations = append(violations, PolicyViolation{Field: "login", Rule: "max_length",
+			Message: fmt.Sprintf("login must be at most %d characters long", p.LoginMaxLength)})
+	}
+	if p.LoginPattern != nil && length > 0 && !p.LoginPattern.MatchString(login) {
+		violations = append(violations, PolicyViolation{Field: "login", Rule: "charset",
+			Message: "login must match " + p.LoginPattern.String()})
+	}
+	return violations
+}
+
+func (p CredentialsPolicy) passwordViolations(login, password string) []PolicyViolation {
+	var violations []PolicyViolation
+	length := utf8.RuneCountInString(password)
+	if length == 0 {
+		violations = append(violations, PolicyViolation{Field: "password", Rule: "required", Message: "password is required"})
+	} else if length < p.PasswordMinLength {
+		violations = append(violations, PolicyViolation{Field: "password", Rule: "min_length",
+			Message: fmt.Sprintf("password must be at least %d characters long", p.PasswordMinLength)})
+	}
+	if p.PasswordMaxLength > 0 && len(password) > p.PasswordMaxLength {
+		violations = append(violations, PolicyViolation{Field: "password", Rule: "max_length",
+			Message: fmt.Sprintf("password must be at most %d bytes long", p.PasswordMaxLength)})
+	}
+	if classes := characterClasses(password); length > 0 && classes < p.PasswordMinClasses {
+		violations = append(violations, PolicyViolation{Field: "password", Rule: "complexity",
+			Message: fmt.Sprintf("password must contain at least %d of: lowercase letters, uppercase letters, digits, other characters", p.PasswordMinClasses)})
+	}
+	if _, ok := p.BannedPasswords[strings.ToLower(password)]; ok {
+		violations = append(violations, PolicyViolation{Field: "password", Rule: "banned", Message: "password is too common"})
+	}
+	if login != "" && strings.EqualFold(login, password) {
+		violations = append(violations, PolicyViolation{Field: "password", Rule: "equals_login", Message: "password must not match login"})
+	}
+	return violations
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
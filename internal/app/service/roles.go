@@ -0,0 +1,48 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/nasik90/gophermart/internal/app/logger"
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrUnknownRole       = errors.New("unknown role")
+	ErrAdminLoginIsTaken = errors.New("admin login belongs to an existing user with another password")
+)
+
+func (s *Service) GetUserRole(ctx context.Context, login string) (string, error) {
+	return s.repo.GetUserRole(ctx, login)
+}
+
+func (s *Service) SetUserRole(ctx context.Context, login, role string) error {
+	if role != storage.RoleUser && role != storage.RoleAdmin {
+		return ErrUnknownRole
+	}
+	return s.repo.SetUserRole(ctx, login, role)
+}
+
+// BootstrapAdmin создаёт администратора при первом запуске. Существующий пользователь
+// повышается до администратора, только если его пароль совпадает с паролем администратора:
+// логин мог занять кто угодно через регистрацию или вход через внешнего провайдера.
+func (s *Service) BootstrapAdmin(ctx context.Context, login, password string) error {
+	err := s.RegisterNewUser(ctx, login, password)
+	if err == nil {
+		logger.Log.Info("admin user created", zap.String("login", login))
+		return s.repo.SetUserRole(ctx, login, storage.RoleAdmin)
+	}
+	if !errors.Is(err, storage.ErrUserNotUnique) {
+		return err
+	}
+	isValid, err := s.checkPassword(ctx, login, password)
+	if err != nil {
+		return err
+	}
+	if !isValid {
+		return ErrAdminLoginIsTaken
+	}
+	return s.repo.SetUserRole(ctx, login, storage.RoleAdmin)
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/nasik90/gophermart/internal/app/hasher"
+	mock_service "github.com/nasik90/gophermart/internal/app/mocks"
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestService_BootstrapAdmin(t *testing.T) {
+	passwordHasher := hasher.NewBcrypt(bcrypt.MinCost)
+	adminHash, err := passwordHasher.Hash("admin-secret")
+	assert.NoError(t, err)
+	otherHash, err := passwordHasher.Hash("someone-else")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		storedHash *storage.PasswordHash
+		wantErr    error
+	}{
+		{
+			name: "new user is created",
+		},
+		{
+			name:       "existing user with admin password is promoted",
+			storedHash: &adminHash,
+		},
+		{
+			name:       "existing user with another password is not promoted",
+			storedHash: &otherHash,
+			wantErr:    ErrAdminLoginIsTaken,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			repo := mock_service.NewMockRepository(ctrl)
+			s := NewService(repo, passwordHasher, nil, Config{})
+			ctx := context.Background()
+
+			if tt.storedHash == nil {
+				repo.EXPECT().SaveNewUser(ctx, "admin", gomock.Any()).Return(nil)
+			} else {
+				repo.EXPECT().SaveNewUser(ctx, "admin", gomock.Any()).Return(storage.ErrUserNotUnique)
+				repo.EXPECT().GetPasswordHash(ctx, "admin").Return(tt.storedHash, nil)
+			}
+			if tt.wantErr == nil {
+				repo.EXPECT().SetUserRole(ctx, "admin", storage.RoleAdmin).Return(nil)
+			}
+			assert.ErrorIs(t, s.BootstrapAdmin(ctx, "admin", "admin-secret"), tt.wantErr)
+		})
+	}
+}
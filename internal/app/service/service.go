@@ -2,218 +2,308 @@ package service
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"net/http"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/nasik90/gophermart/internal/app/logger"
+	"github.com/nasik90/gophermart/internal/app/ratelimit"
 	"github.com/nasik90/gophermart/internal/app/storage"
-	"github.com/phedde/luhn-algorithm"
 	"go.uber.org/zap"
 )
 
 type Repository interface {
-	SaveNewUser(ctx context.Context, user, password string) error
-	UserIsValid(ctx context.Context, login, password string) (bool, error)
-	SaveNewOrder(ctx context.Context, orderNumber int, login string) error
-	GetOrderList(ctx context.Context, login string) (*[]storage.OrderData, error)
-	WithdrawPoints(ctx context.Context, login string, OrderID int, points float64) error
-	AccruePoints(ctx context.Context, OrderID int, points float64) error
+	SaveNewUser(ctx context.Context, user string, password storage.PasswordHash) error
+	GetPasswordHash(ctx context.Context, login string) (*storage.PasswordHash, error)
+	UpdatePasswordHash(ctx context.Context, login string, password storage.PasswordHash) error
+	GetUserRole(ctx context.Context, login string) (string, error)
+	SetUserRole(ctx context.Context, login, role string) error
+	SaveAPIKey(ctx context.Context, login, keyHash string, apiKey *storage.APIKey) error
+	GetAPIKeys(ctx context.Context, login string) ([]storage.APIKey, error)
+	RevokeAPIKey(ctx context.Context, login string, id int) error
+	UseAPIKey(ctx context.Context, keyHash string, usedAt, touchBefore time.Time) (string, []string, error)
+	SaveTOTP(ctx context.Context, login, secret string, recoveryCodeHashes []string) error
+	GetTOTP(ctx context.Context, login string) (*storage.TOTP, error)
+	UseTOTPStep(ctx context.Context, login string, step int64) error
+	UseRecoveryCode(ctx context.Context, login, codeHash string) error
+	DeleteTOTP(ctx context.Context, login string) error
+	SaveSession(ctx context.Context, login string, session storage.Session) error
+	TouchSession(ctx context.Context, id, login string, lastSeenAt, touchBefore time.Time) (bool, error)
+	GetSessions(ctx context.Context, login string) ([]storage.Session, error)
+	RevokeSession(ctx context.Context, login, id string) error
+	ExportUserData(ctx context.Context, login string) (*storage.UserExport, error)
+	AnonymizeUser(ctx context.Context, login, anonymousLogin string) error
+	SaveOIDCState(ctx context.Context, stateHash string, state storage.OIDCState) error
+	TakeOIDCState(ctx context.Context, stateHash string) (*storage.OIDCState, error)
+	GetLoginByIdentity(ctx context.Context, issuer, subject string) (string, error)
+	LinkIdentity(ctx context.Context, login, issuer, subject string) error
+	SaveReauthentication(ctx context.Context, issuer, subject string, reauthenticatedAt time.Time) error
+	TakeReauthentication(ctx context.Context, login string) (time.Time, error)
+	SaveNewUserWithIdentity(ctx context.Context, login string, password storage.PasswordHash, issuer, subject string) error
+	SaveRefreshToken(ctx context.Context, login string, token storage.RefreshToken) error
+	RotateRefreshToken(ctx context.Context, oldHash string, newToken storage.RefreshToken) (string, string, error)
+	RevokeRefreshTokenFamily(ctx context.Context, tokenHash string) error
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	AccessTokenIsRevoked(ctx context.Context, jti, login string, issuedAt time.Time) (bool, error)
+	ChangePassword(ctx context.Context, login string, password storage.PasswordHash) error
+	SavePasswordResetToken(ctx context.Context, login, tokenHash string, expiresAt time.Time) error
+	ResetPassword(ctx context.Context, tokenHash string, password storage.PasswordHash) (string, error)
+	LockedUntil(ctx context.Context, keys []string) (time.Time, error)
+	RegisterAttempt(ctx context.Context, key string, resetBefore time.Time) (int, error)
+	LockKey(ctx context.Context, key string, lockedUntil time.Time) error
+	ResetAttempts(ctx context.Context, keys []string) error
+	StartIdempotentRequest(ctx context.Context, login, key, fingerprint string, lockedUntil, expiresAt time.Time) (*storage.IdempotentResponse, error)
+	SaveIdempotentResponse(ctx context.Context, login, key string, response storage.IdempotentResponse) error
+	DeleteIdempotencyKey(ctx context.Context, login, key string) error
+	SaveNewOrder(ctx context.Context, orderNumber storage.OrderNumber, login string) error
+	SaveNewOrders(ctx context.Context, ids []storage.OrderNumber, login string) ([]storage.OrderBatchItem, error)
+	GetOrderList(ctx context.Context, login string, filter storage.ListFilter) (*[]storage.OrderData, error)
+	GetOrder(ctx context.Context, orderID storage.OrderNumber) (*storage.OrderDetails, error)
+	WithdrawPoints(ctx context.Context, login string, OrderID storage.OrderNumber, points float64) error
+	AccruePoints(ctx context.Context, OrderID storage.OrderNumber, instanceID string, points float64) error
 	GetUserBalance(ctx context.Context, login string) (*storage.UserBalance, error)
-	GetWithdrawals(ctx context.Context, login string) (*[]storage.Withdrawals, error)
-	SaveStatus(ctx context.Context, orderID, statusID int) error
-	NewAndProcessingOrders(ctx context.Context) ([]int, error)
+	GetWithdrawals(ctx context.Context, login string, filter storage.ListFilter) (*[]storage.Withdrawals, error)
+	SaveStatus(ctx context.Context, orderID storage.OrderNumber, instanceID string, statusID int) error
+	ClaimOrders(ctx context.Context, instanceID string, limit int, leaseUntil time.Time) ([]storage.ClaimedOrder, error)
+	RescheduleOrder(ctx context.Context, orderID storage.OrderNumber, instanceID string, nextAttemptAt time.Time, failure bool) error
+	ReleaseOrder(ctx context.Context, orderID storage.OrderNumber, instanceID string) error
+	MarkOrderStuck(ctx context.Context, orderID storage.OrderNumber, instanceID, reason string) error
+	GetStuckOrders(ctx context.Context, filter storage.ListFilter) ([]storage.StuckOrder, error)
+	RequeueOrder(ctx context.Context, orderID storage.OrderNumber) error
 }
 
-var (
-	ErrOrderFormat        = errors.New("order format is not valid")
-	ErrTooManyRequests    = errors.New("too many requests")
-	ErrOrderNotRegistered = errors.New("order not registered")
-)
+type PasswordHasher interface {
+	Hash(password string) (storage.PasswordHash, error)
+	Compare(hash storage.PasswordHash, password string) (bool, error)
+	NeedsRehash(hash storage.PasswordHash) bool
+}
 
-type Service struct {
-	repo         Repository
-	ordersCh     chan int
-	checkOrderID bool
+// OrderValidator проверяет формат номера заказа. Ошибка должна называть нарушенное правило.
+type OrderValidator interface {
+	Validate(number string) error
 }
 
-func NewService(store Repository, checkOrderID bool) *Service {
-	return &Service{repo: store, ordersCh: make(chan int), checkOrderID: checkOrderID}
+// Notifier доставляет пользователю служебные сообщения, например токен сброса пароля.
+type Notifier interface {
+	Notify(ctx context.Context, login, subject, message string) error
 }
 
-func (s *Service) RegisterNewUser(ctx context.Context, login, password string) error {
-	return s.repo.SaveNewUser(ctx, login, password)
+var (
+	ErrOrderFormat   = errors.New("order format is not valid")
+	ErrWithdrawalSum = errors.New("withdrawal sum must be positive")
+)
+
+type Config struct {
+	// AccrualWorkers - количество воркеров, одновременно опрашивающих систему начислений
+	AccrualWorkers int
+	// AccrualRateLimit - общее для воркеров ограничение запросов в секунду, 0 - без ограничения
+	AccrualRateLimit float64
+	// AccrualBatchSize - сколько заказов экземпляр берёт в аренду за одну выборку
+	AccrualBatchSize int
+	// AccrualLease - время аренды заказа, после него заказ может забрать другой экземпляр
+	AccrualLease time.Duration
+	// AccrualRetryBase и AccrualRetryMax - первая и наибольшая пауза перед повторным опросом заказа,
+	// пауза удваивается с каждой попыткой
+	AccrualRetryBase time.Duration
+	AccrualRetryMax  time.Duration
+	// AccrualMaxAttempts и AccrualMaxAge - после стольких неудачных опросов или спустя столько времени
+	// опроса заказ переводится в STUCK, 0 - без ограничения. Неудачным считается только опрос,
+	// на который система начислений не знает заказ или отвечает неразборчиво: недоступность системы
+	// и промежуточные статусы лишь откладывают следующий опрос.
+	AccrualMaxAttempts int
+	AccrualMaxAge      time.Duration
+	// InstanceID - идентификатор экземпляра сервиса в аренде заказов, пустой - генерируется при старте
+	InstanceID string
+	// IdempotencyKeyTTL - сколько хранится ответ на запрос с ключом идемпотентности
+	IdempotencyKeyTTL time.Duration
+	// OrderValidator проверяет формат номеров заказов, nil - принимается любой непустой номер
+	OrderValidator  OrderValidator
+	RefreshTokenExp time.Duration
+	ResetTokenExp   time.Duration
+	Lockout         LockoutPolicy
+	ResetLimit      PasswordResetLimit
+	Credentials     CredentialsPolicy
+	// WithdrawStepUpAmount - сумма, списания больше которой требуют кода второго фактора, 0 - не требуют
+	WithdrawStepUpAmount float64
+	// AccrualClient - клиент системы начислений, которую опрашивает HandleOrderQueue
+	AccrualClient AccrualClient
+	// IdentityProvider - внешний провайдер для входа, nil - вход через провайдера выключен
+	IdentityProvider IdentityProvider
 }
 
-func (s *Service) UserIsValid(ctx context.Context, login, password string) (bool, error) {
-	return s.repo.UserIsValid(ctx, login, password)
+type Service struct {
+	repo                 Repository
+	hasher               PasswordHasher
+	notifier             Notifier
+	ordersCh             chan storage.OrderNumber
+	orderValidator       OrderValidator
+	idempotencyKeyTTL    time.Duration
+	accrualWorkers       int
+	accrualLimiter       *ratelimit.TokenBucket
+	accrualBatchSize     int
+	accrualLease         time.Duration
+	accrualRetryBase     time.Duration
+	accrualRetryMax      time.Duration
+	accrualMaxAttempts   int
+	accrualMaxAge        time.Duration
+	instanceID           string
+	refreshTokenExp      time.Duration
+	resetTokenExp        time.Duration
+	lockout              LockoutPolicy
+	resetLimit           PasswordResetLimit
+	credentials          CredentialsPolicy
+	withdrawStepUpAmount float64
+	accrualClient        AccrualClient
+	identityProvider     IdentityProvider
 }
 
-func (s *Service) LoadOrder(ctx context.Context, OrderID int, login string) error {
-	if s.checkOrderID {
-		isValid := luhn.IsValid(int64(OrderID))
-		if !isValid {
-			return ErrOrderFormat
-		}
+func NewService(store Repository, hasher PasswordHasher, notifier Notifier, cfg Config) *Service {
+	if cfg.AccrualBatchSize <= 0 {
+		cfg.AccrualBatchSize = defaultAccrualBatchSize
 	}
-	if err := s.repo.SaveNewOrder(ctx, OrderID, login); err != nil {
-		return err
+	if cfg.AccrualLease <= 0 {
+		cfg.AccrualLease = defaultAccrualLease
+	}
+	if cfg.AccrualRetryBase <= 0 {
+		cfg.AccrualRetryBase = defaultAccrualRetryBase
+	}
+	if cfg.AccrualRetryMax < cfg.AccrualRetryBase {
+		cfg.AccrualRetryMax = max(defaultAccrualRetryMax, cfg.AccrualRetryBase)
+	}
+	if cfg.InstanceID == "" {
+		cfg.InstanceID = newInstanceID()
+	}
+	return &Service{
+		repo:                 store,
+		hasher:               hasher,
+		notifier:             notifier,
+		ordersCh:             make(chan storage.OrderNumber),
+		orderValidator:       cfg.OrderValidator,
+		idempotencyKeyTTL:    cfg.IdempotencyKeyTTL,
+		accrualWorkers:       max(cfg.AccrualWorkers, 1),
+		accrualLimiter:       ratelimit.New(cfg.AccrualRateLimit, max(cfg.AccrualWorkers, 1)),
+		accrualBatchSize:     cfg.AccrualBatchSize,
+		accrualLease:         cfg.AccrualLease,
+		accrualRetryBase:     cfg.AccrualRetryBase,
+		accrualRetryMax:      cfg.AccrualRetryMax,
+		accrualMaxAttempts:   cfg.AccrualMaxAttempts,
+		accrualMaxAge:        cfg.AccrualMaxAge,
+		instanceID:           cfg.InstanceID,
+		refreshTokenExp:      cfg.RefreshTokenExp,
+		resetTokenExp:        cfg.ResetTokenExp,
+		lockout:              cfg.Lockout,
+		resetLimit:           cfg.ResetLimit,
+		credentials:          cfg.Credentials,
+		withdrawStepUpAmount: cfg.WithdrawStepUpAmount,
+		accrualClient:        cfg.AccrualClient,
+		identityProvider:     cfg.IdentityProvider,
 	}
-	go s.loadOrderIDInOrderQueue(OrderID)
-	return nil
 }
 
-func (s *Service) GetOrderList(ctx context.Context, login string) (*[]storage.OrderData, error) {
-	return s.repo.GetOrderList(ctx, login)
+func (s *Service) RegisterNewUser(ctx context.Context, login, password string) error {
+	if err := s.credentials.validate(login, password); err != nil {
+		return err
+	}
+	passwordHash, err := s.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	return s.repo.SaveNewUser(ctx, login, passwordHash)
 }
 
-// списание баллов
-func (s *Service) WithdrawPoints(ctx context.Context, login string, OrderID int, points float64) error {
-	if s.checkOrderID {
-		isValid := luhn.IsValid(int64(OrderID))
-		if !isValid {
-			return ErrOrderFormat
-		}
+// UserIsValid проверяет логин и пароль. Неудачные попытки учитываются по логину и IP-адресу,
+// при превышении лимита возвращается *LoginLockedError.
+func (s *Service) UserIsValid(ctx context.Context, login, password, ip string) (bool, error) {
+	if err := s.checkLoginLock(ctx, login, ip); err != nil {
+		return false, err
 	}
-	return s.repo.WithdrawPoints(ctx, login, OrderID, points)
+	isValid, err := s.checkPassword(ctx, login, password)
+	if err != nil {
+		return false, err
+	}
+	if !isValid {
+		return false, s.registerLoginFailure(ctx, login, ip)
+	}
+	if err := s.repo.ResetAttempts(ctx, []string{loginAttemptsKey(login)}); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func (s *Service) loadOrderIDInOrderQueue(orderID int) {
-	s.ordersCh <- orderID
+func (s *Service) checkPassword(ctx context.Context, login, password string) (bool, error) {
+	passwordHash, err := s.repo.GetPasswordHash(ctx, login)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		// Хешируем впустую, чтобы по времени ответа нельзя было понять, существует ли пользователь
+		s.hasher.Hash(password)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	isValid, err := s.hasher.Compare(*passwordHash, password)
+	if err != nil || !isValid {
+		return false, err
+	}
+	// Пароли, сохранённые в открытом виде или устаревшим алгоритмом, перехешируем при входе
+	if s.hasher.NeedsRehash(*passwordHash) {
+		s.rehashPassword(ctx, login, password)
+	}
+	return true, nil
 }
 
-func (s *Service) HandleOrderQueue(serverAddress string, stop <-chan bool) {
-
-	ctx := context.Background()
-	forIter := 0
-	for {
-		select {
-		default:
-			orderIDs, err := s.repo.NewAndProcessingOrders(ctx)
-			if err != nil {
-				logger.Log.Error("select orders for processing in accrual service", zap.String("error", err.Error()))
-				return
-			}
-			if err := s.handleOrders(ctx, orderIDs, serverAddress); err != nil {
-				logger.Log.Error("order handle via accrual", zap.String("error", err.Error()))
-			}
-			// Если нет заказов для обработки, то сделаем паузу
-			// Пауза равна от 1 по нарастающей, максимум 3 секунды
-			if len(orderIDs) == 0 {
-				forIter++
-				time.Sleep(time.Duration(forIter) * time.Second)
-				if forIter == 3 {
-					forIter = 0
-				}
-			} else {
-				forIter = 0
-			}
-		case <-stop:
-			return
-		}
+// rehashPassword сохраняет пароль текущим алгоритмом. Ошибка не мешает входу: пароль уже проверен,
+// а старый хеш остаётся рабочим. Например, bcrypt не хеширует старые пароли длиннее 72 байт.
+func (s *Service) rehashPassword(ctx context.Context, login, password string) {
+	newPasswordHash, err := s.hasher.Hash(password)
+	if err == nil {
+		err = s.repo.UpdatePasswordHash(ctx, login, newPasswordHash)
+	}
+	if err != nil {
+		logger.Log.Warn("rehash password", zap.String("login", login), zap.String("error", err.Error()))
 	}
 }
 
-func (s *Service) handleOrders(ctx context.Context, orderIDs []int, serverAddress string) error {
-	const (
-		statusREGISTERED = "REGISTERED"
-		statusINVALID    = "INVALID"
-		statusPROCESSING = "PROCESSING"
-		statusPROCESSED  = "PROCESSED"
-	)
-	for _, orderID := range orderIDs {
-		accrualData, retryAfter, err := GetAccrualByOrderID(orderID, serverAddress)
-		if errors.Is(err, ErrTooManyRequests) {
-			timeToSleep := 5
-			if retryAfter != 0 {
-				timeToSleep = retryAfter
-			}
-			time.Sleep(time.Second * time.Duration(timeToSleep))
-		}
-		if errors.Is(err, ErrOrderNotRegistered) {
-			continue
-		}
-		if err != nil {
-			return err
-		}
-
-		switch accrualData.Status {
-		case statusREGISTERED:
-		case statusINVALID:
-			if err := s.repo.SaveStatus(ctx, orderID, storage.StatusINVALID); err != nil {
-				return errors.Join(errors.New("status: "+statusINVALID), err)
-			}
-		case statusPROCESSING:
-			if err := s.repo.SaveStatus(ctx, orderID, storage.StatusPROCESSING); err != nil {
-				return errors.Join(errors.New("status: "+statusPROCESSING), err)
-			}
-		case statusPROCESSED:
-			if err := s.repo.AccruePoints(ctx, orderID, accrualData.Accrual); err != nil {
-				return errors.Join(errors.New("status: "+statusPROCESSED), err)
-			}
-		}
+func (s *Service) LoadOrder(ctx context.Context, number string, login string) error {
+	OrderID, err := s.ParseOrderNumber(number)
+	if err != nil {
+		return err
 	}
+	if err := s.repo.SaveNewOrder(ctx, OrderID, login); err != nil {
+		return err
+	}
+	go s.loadOrderIDInOrderQueue(OrderID)
 	return nil
 }
 
-type orderDataType struct {
-	Order   string  `json:"order"`
-	Status  string  `json:"status"`
-	Accrual float64 `json:"accrual"`
-}
-
-func GetAccrualByOrderID(orderID int, serverAddress string) (orderDataType, int, error) {
-	start := time.Now()
-	var orderData orderDataType
-	client := &http.Client{}
-	// Как сделать красиво?
-	serverPrefix := ""
-	if !strings.Contains(serverAddress, "http") {
-		serverPrefix = "http://"
-	}
-	url := serverPrefix + serverAddress + "/api/orders/" + strconv.Itoa(orderID)
-	request, err := http.NewRequest(http.MethodGet, url, nil)
+// списание баллов
+// WithdrawPoints списывает баллы в счёт заказа. Код второго фактора для крупных списаний проверяется
+// после номера заказа, суммы и баланса, чтобы заведомо отклонённое списание не тратило код и попытки.
+func (s *Service) WithdrawPoints(ctx context.Context, login string, number string, points float64, otpCode string) error {
+	OrderID, err := s.ParseOrderNumber(number)
 	if err != nil {
-		return orderData, 0, err
+		return err
 	}
-	response, err := client.Do(request)
-	if err != nil {
-		return orderData, 0, err
-	}
-	defer response.Body.Close()
-	duration := time.Since(start)
-	logger.Log.Sugar().Infoln(
-		"uri", request.URL.Path,
-		"method", request.Method,
-		"status", response.StatusCode,
-		"duration", duration,
-	)
-	if response.StatusCode == http.StatusTooManyRequests {
-		retryAfterString := response.Header.Get("Retry-After")
-		retryAfter, err := strconv.Atoi(retryAfterString)
+	if points <= 0 {
+		return ErrWithdrawalSum
+	}
+	if s.withdrawStepUpAmount > 0 && points > s.withdrawStepUpAmount {
+		balance, err := s.repo.GetUserBalance(ctx, login)
 		if err != nil {
-			return orderData, 0, err
+			return err
+		}
+		if balance.Current < points {
+			return storage.ErrOutOfBalance
+		}
+		if err := s.checkWithdrawStepUp(ctx, login, otpCode); err != nil {
+			return err
 		}
-		return orderData, retryAfter, ErrTooManyRequests
-	}
-	if response.StatusCode == http.StatusNoContent {
-		return orderData, 0, ErrOrderNotRegistered
 	}
+	return s.repo.WithdrawPoints(ctx, login, OrderID, points)
+}
 
-	if err := json.NewDecoder(response.Body).Decode(&orderData); err != nil {
-		return orderData, 0, err
-	}
-	return orderData, 0, nil
+func (s *Service) loadOrderIDInOrderQueue(orderID storage.OrderNumber) {
+	s.ordersCh <- orderID
 }
 
 func (s *Service) GetUserBalance(ctx context.Context, login string) (*storage.UserBalance, error) {
 	return s.repo.GetUserBalance(ctx, login)
 }
-
-// список списаний
-func (s *Service) GetWithdrawals(ctx context.Context, login string) (*[]storage.Withdrawals, error) {
-	return s.repo.GetWithdrawals(ctx, login)
-}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/nasik90/gophermart/internal/app/hasher"
+	mock_service "github.com/nasik90/gophermart/internal/app/mocks"
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestService_UserIsValidLongPlainPassword(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	repo := mock_service.NewMockRepository(ctrl)
+	s := NewService(repo, hasher.NewBcrypt(bcrypt.MinCost), nil, Config{})
+	ctx := context.Background()
+
+	// старый пароль в открытом виде длиннее, чем принимает bcrypt: перехешировать его нельзя,
+	// но вход по нему должен работать
+	password := strings.Repeat("p", 100)
+	repo.EXPECT().LockedUntil(ctx, []string{"login:vasya"}).Return(time.Time{}, nil)
+	repo.EXPECT().GetPasswordHash(ctx, "vasya").Return(&storage.PasswordHash{Hash: password, Algorithm: hasher.AlgorithmPlain}, nil)
+	repo.EXPECT().ResetAttempts(ctx, []string{"login:vasya"}).Return(nil)
+
+	isValid, err := s.UserIsValid(ctx, "vasya", password, "")
+	assert.NoError(t, err)
+	assert.True(t, isValid)
+}
+
+func TestService_LoadOrdersUnexpectedItemError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	repo := mock_service.NewMockRepository(ctrl)
+	s := NewService(repo, hasher.NewBcrypt(bcrypt.MinCost), nil, Config{})
+	ctx := context.Background()
+
+	// неизвестная ошибка хранилища не должна выдаваться за дубль
+	saveErr := errors.New("unexpected")
+	repo.EXPECT().SaveNewOrders(ctx, []storage.OrderNumber{"1", "2"}, "vasya").
+		Return([]storage.OrderBatchItem{{ID: "1", Err: storage.ErrOrderIDNotUnique}, {ID: "2", Err: saveErr}}, nil)
+
+	result, err := s.LoadOrders(ctx, []string{"1", "2"}, "vasya")
+	assert.ErrorIs(t, err, saveErr)
+	assert.Nil(t, result)
+}
@@ -0,0 +1,33 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/nasik90/gophermart/internal/app/storage"
+)
+
+// sessionTouchInterval - время последней активности сессии обновляется не чаще этого интервала
+const sessionTouchInterval = time.Minute
+
+// SaveSession запоминает клиента, которому выдан access-токен сессии.
+func (s *Service) SaveSession(ctx context.Context, login string, session storage.Session) error {
+	now := time.Now()
+	session.CreatedAt = now
+	session.LastSeenAt = now
+	return s.repo.SaveSession(ctx, login, session)
+}
+
+// SessionIsActive отмечает активность сессии и сообщает, не завершена ли она.
+func (s *Service) SessionIsActive(ctx context.Context, id, login string) (bool, error) {
+	now := time.Now()
+	return s.repo.TouchSession(ctx, id, login, now, now.Add(-sessionTouchInterval))
+}
+
+func (s *Service) GetSessions(ctx context.Context, login string) ([]storage.Session, error) {
+	return s.repo.GetSessions(ctx, login)
+}
+
+func (s *Service) RevokeSession(ctx context.Context, login, id string) error {
+	return s.repo.RevokeSession(ctx, login, id)
+}
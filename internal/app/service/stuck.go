@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nasik90/gophermart/internal/app/storage"
+)
+
+// GetStuckOrders возвращает страницу заказов в статусе STUCK и курсор следующей страницы.
+// Период и сортировка относятся ко времени перевода заказа в STUCK.
+func (s *Service) GetStuckOrders(ctx context.Context, params ListParams) ([]storage.StuckOrder, string, error) {
+	if len(params.Statuses) != 0 {
+		return nil, "", fmt.Errorf("%w: stuck orders have one status", ErrInvalidListParams)
+	}
+	filter, err := params.filter()
+	if err != nil {
+		return nil, "", err
+	}
+	orders, err := s.repo.GetStuckOrders(ctx, filter)
+	if err != nil || len(orders) < filter.Limit {
+		return orders, "", err
+	}
+	page := orders[:filter.Limit-1]
+	last := page[len(page)-1]
+	cursor, err := encodeCursor(storage.ListCursor{Time: last.StuckAt, ID: storage.OrderNumber(last.Number)})
+	return page, cursor, err
+}
+
+// RequeueOrder возвращает заказ из STUCK в очередь опроса системы начислений.
+// Счётчик попыток и время опроса отсчитываются заново.
+func (s *Service) RequeueOrder(ctx context.Context, orderNumber string) error {
+	orderID, err := s.ParseOrderNumber(orderNumber)
+	if err != nil {
+		// номер неверного формата не может быть загружен
+		return storage.ErrOrderNotFound
+	}
+	return s.repo.RequeueOrder(ctx, orderID)
+}
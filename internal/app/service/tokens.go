@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/nasik90/gophermart/internal/app/storage"
+)
+
+// IssueRefreshToken выпускает refresh-токен, начинающий новую цепочку ротации (новую сессию),
+// и возвращает его вместе с идентификатором сессии.
+func (s *Service) IssueRefreshToken(ctx context.Context, login string) (string, string, error) {
+	token, err := newRandomToken()
+	if err != nil {
+		return "", "", err
+	}
+	familyID, err := newRandomToken()
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken := storage.RefreshToken{
+		Hash:      hashToken(token),
+		FamilyID:  familyID,
+		ExpiresAt: time.Now().Add(s.refreshTokenExp),
+	}
+	if err := s.repo.SaveRefreshToken(ctx, login, refreshToken); err != nil {
+		return "", "", err
+	}
+	return token, familyID, nil
+}
+
+// RotateRefreshToken обменивает refresh-токен на новый и возвращает логин его владельца и идентификатор сессии.
+// Повторное предъявление уже обменянного токена отзывает всю цепочку (storage.ErrRefreshTokenReused).
+func (s *Service) RotateRefreshToken(ctx context.Context, token string) (string, string, string, error) {
+	newToken, err := newRandomToken()
+	if err != nil {
+		return "", "", "", err
+	}
+	login, sessionID, err := s.repo.RotateRefreshToken(ctx, hashToken(token), storage.RefreshToken{
+		Hash:      hashToken(newToken),
+		ExpiresAt: time.Now().Add(s.refreshTokenExp),
+	})
+	if err != nil {
+		return "", "", "", err
+	}
+	return login, sessionID, newToken, nil
+}
+
+// Logout отзывает access-токен по jti, текущую сессию и цепочку refresh-токена, если он передан.
+func (s *Service) Logout(ctx context.Context, login, jti string, expiresAt time.Time, sessionID, refreshToken string) error {
+	if err := s.repo.RevokeAccessToken(ctx, jti, expiresAt); err != nil {
+		return err
+	}
+	if sessionID != "" {
+		if err := s.repo.RevokeSession(ctx, login, sessionID); err != nil && !errors.Is(err, storage.ErrSessionNotFound) {
+			return err
+		}
+	}
+	if refreshToken == "" {
+		return nil
+	}
+	return s.repo.RevokeRefreshTokenFamily(ctx, hashToken(refreshToken))
+}
+
+func (s *Service) TokenIsRevoked(ctx context.Context, jti, login string, issuedAt time.Time) (bool, error) {
+	return s.repo.AccessTokenIsRevoked(ctx, jti, login, issuedAt)
+}
+
+func newRandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
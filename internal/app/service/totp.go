@@ -0,0 +1,176 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"github.com/nasik90/gophermart/internal/app/totp"
+)
+
+const (
+	totpIssuer        = "Gophermart"
+	recoveryCodeCount = 10
+	recoveryCodeSize  = 5
+)
+
+var (
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTOTPRequired       = errors.New("two-factor authentication code is required")
+	ErrInvalidOTP         = errors.New("two-factor authentication code is invalid")
+)
+
+// TOTPEnrollment - данные для настройки приложения-аутентификатора. Отдаются пользователю один раз.
+type TOTPEnrollment struct {
+	Secret        string   `json:"secret"`
+	URI           string   `json:"otpauth_uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// EnrollTOTP создаёт секрет TOTP и коды восстановления. Второй фактор начинает
+// действовать после подтверждения кодом из приложения (ConfirmTOTP).
+func (s *Service) EnrollTOTP(ctx context.Context, login string) (*TOTPEnrollment, error) {
+	current, err := s.repo.GetTOTP(ctx, login)
+	if err != nil && !errors.Is(err, storage.ErrTOTPNotFound) {
+		return nil, err
+	}
+	if current != nil && current.Enabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	recoveryCodes := make([]string, recoveryCodeCount)
+	recoveryCodeHashes := make([]string, recoveryCodeCount)
+	for i := range recoveryCodes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		recoveryCodes[i] = code
+		recoveryCodeHashes[i] = hashToken(normalizeRecoveryCode(code))
+	}
+	if err := s.repo.SaveTOTP(ctx, login, secret, recoveryCodeHashes); err != nil {
+		return nil, err
+	}
+	return &TOTPEnrollment{
+		Secret:        secret,
+		URI:           totp.URI(totpIssuer, login, secret),
+		RecoveryCodes: recoveryCodes,
+	}, nil
+}
+
+// ConfirmTOTP включает второй фактор, если code совпадает с кодом приложения.
+func (s *Service) ConfirmTOTP(ctx context.Context, login, code string) error {
+	current, err := s.repo.GetTOTP(ctx, login)
+	if err != nil {
+		return err
+	}
+	if current.Enabled {
+		return ErrTOTPAlreadyEnabled
+	}
+	return s.useTOTPCode(ctx, login, current.Secret, code)
+}
+
+// DisableTOTP отключает второй фактор. Требуется действующий код или код восстановления.
+func (s *Service) DisableTOTP(ctx context.Context, login, code string) error {
+	if err := s.verifyOTP(ctx, login, code, stepUpAttemptsKey(login), ""); err != nil {
+		return err
+	}
+	return s.repo.DeleteTOTP(ctx, login)
+}
+
+func (s *Service) TOTPEnabled(ctx context.Context, login string) (bool, error) {
+	current, err := s.repo.GetTOTP(ctx, login)
+	if errors.Is(err, storage.ErrTOTPNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return current.Enabled, nil
+}
+
+// VerifyLoginOTP - второй шаг входа. Неверные коды блокируют второй шаг так же, как неверные пароли -
+// первый, но по своему счётчику, который не сбрасывается верным паролем.
+func (s *Service) VerifyLoginOTP(ctx context.Context, login, code, ip string) error {
+	return s.verifyOTP(ctx, login, code, otpAttemptsKey(login), ip)
+}
+
+// checkWithdrawStepUp требует код второго фактора для крупного списания.
+// Пользователь без включённого второго фактора такие списания сделать не может.
+func (s *Service) checkWithdrawStepUp(ctx context.Context, login string, code string) error {
+	enabled, err := s.TOTPEnabled(ctx, login)
+	if err != nil {
+		return err
+	}
+	if !enabled || code == "" {
+		return ErrTOTPRequired
+	}
+	return s.verifyOTP(ctx, login, code, stepUpAttemptsKey(login), "")
+}
+
+// verifyOTP проверяет код приложения или код восстановления включённого второго фактора.
+// Неверные коды считаются по ключу key, счётчик сбрасывается только верным кодом.
+func (s *Service) verifyOTP(ctx context.Context, login, code, key, ip string) error {
+	if err := s.checkLock(ctx, key, ip); err != nil {
+		return err
+	}
+	current, err := s.repo.GetTOTP(ctx, login)
+	if errors.Is(err, storage.ErrTOTPNotFound) {
+		return ErrInvalidOTP
+	}
+	if err != nil {
+		return err
+	}
+	if !current.Enabled {
+		return ErrInvalidOTP
+	}
+	if len(code) == totp.Digits {
+		err = s.useTOTPCode(ctx, login, current.Secret, code)
+	} else {
+		err = s.repo.UseRecoveryCode(ctx, login, hashToken(normalizeRecoveryCode(code)))
+		if errors.Is(err, storage.ErrRecoveryCodeInvalid) {
+			err = ErrInvalidOTP
+		}
+	}
+	if errors.Is(err, ErrInvalidOTP) {
+		if err := s.registerFailures(ctx, key, ip); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return s.repo.ResetAttempts(ctx, []string{key})
+}
+
+func (s *Service) useTOTPCode(ctx context.Context, login, secret, code string) error {
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return ErrInvalidOTP
+	}
+	err := s.repo.UseTOTPStep(ctx, login, step)
+	if errors.Is(err, storage.ErrTOTPCodeUsed) {
+		return ErrInvalidOTP
+	}
+	return err
+}
+
+func newRecoveryCode() (string, error) {
+	b := make([]byte, recoveryCodeSize*2)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(b)
+	return code[:recoveryCodeSize*2] + "-" + code[recoveryCodeSize*2:recoveryCodeSize*4], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
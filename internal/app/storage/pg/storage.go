@@ -4,6 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgerrcode"
@@ -37,8 +40,10 @@ func (s Store) Close() error {
 	return s.conn.Close()
 }
 
-func (s *Store) SaveNewUser(ctx context.Context, login, password string) error {
-	_, err := s.conn.ExecContext(ctx, `INSERT INTO users (login, password) VALUES ($1, $2)`, login, password)
+func (s *Store) SaveNewUser(ctx context.Context, login string, password storage.PasswordHash) error {
+	_, err := s.conn.ExecContext(ctx, `
+		INSERT INTO users (login, password, password_algorithm, password_params, tokens_valid_after) VALUES ($1, $2, $3, $4, $5)`,
+		login, password.Hash, password.Algorithm, password.Params, time.Now().Truncate(time.Second))
 	err = saveNewUserCheckInsertError(err)
 	return err
 }
@@ -56,22 +61,1018 @@ func saveNewUserCheckInsertError(err error) error {
 	return err
 }
 
-func (s *Store) UserIsValid(ctx context.Context, login, password string) (bool, error) {
-	rows, err := s.conn.ExecContext(ctx, `SELECT FROM users WHERE login = $1 and password = $2`, login, password)
+func (s *Store) GetPasswordHash(ctx context.Context, login string) (*storage.PasswordHash, error) {
+	row := s.conn.QueryRowContext(ctx, `
+		SELECT password, password_algorithm, password_params FROM users WHERE login = $1 AND deleted_at IS NULL`, login)
+	var result storage.PasswordHash
+	if err := row.Scan(&result.Hash, &result.Algorithm, &result.Params); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storage.ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (s *Store) UpdatePasswordHash(ctx context.Context, login string, password storage.PasswordHash) error {
+	_, err := s.conn.ExecContext(ctx, `
+		UPDATE users SET password = $2, password_algorithm = $3, password_params = $4 WHERE login = $1`,
+		login, password.Hash, password.Algorithm, password.Params)
+	return err
+}
+
+func (s *Store) GetUserRole(ctx context.Context, login string) (string, error) {
+	row := s.conn.QueryRowContext(ctx, `SELECT role FROM users WHERE login = $1`, login)
+	var role string
+	if err := row.Scan(&role); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", storage.ErrUserNotFound
+		}
+		return "", err
+	}
+	return role, nil
+}
+
+// SetUserRole меняет роль и, если она действительно изменилась, отзывает выпущенные токены,
+// чтобы старая роль не действовала до их истечения.
+func (s *Store) SetUserRole(ctx context.Context, login, role string) error {
+	// iat в JWT хранится с точностью до секунды, поэтому и границу храним с той же точностью
+	curTime := time.Now().Truncate(time.Second)
+	result, err := s.conn.ExecContext(ctx, `
+		UPDATE users SET role = $2,
+			tokens_valid_after = CASE WHEN role IS DISTINCT FROM $2 THEN $3 ELSE tokens_valid_after END
+		WHERE login = $1`, login, role, curTime)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return storage.ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *Store) SaveAPIKey(ctx context.Context, login, keyHash string, apiKey *storage.APIKey) error {
+	userID, err := s.getUserID(ctx, login)
+	if err != nil {
+		return err
+	}
+	row := s.conn.QueryRowContext(ctx, `
+		INSERT INTO api_keys (user_id, name, key_hash, prefix, scopes, created_at) VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`,
+		userID, apiKey.Name, keyHash, apiKey.Prefix, strings.Join(apiKey.Scopes, " "), apiKey.CreatedAt)
+	return row.Scan(&apiKey.ID)
+}
+
+func (s *Store) GetAPIKeys(ctx context.Context, login string) ([]storage.APIKey, error) {
+	var result []storage.APIKey
+	rows, err := s.conn.QueryContext(ctx, `
+		SELECT k.id, k.name, k.prefix, k.scopes, k.created_at, k.last_used_at
+		FROM api_keys k
+			INNER JOIN users u
+			ON k.user_id = u.id
+		WHERE u.login = $1 AND k.revoked_at IS NULL
+		ORDER BY k.created_at`, login)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			apiKey     storage.APIKey
+			scopes     string
+			lastUsedAt sql.NullTime
+		)
+		if err := rows.Scan(&apiKey.ID, &apiKey.Name, &apiKey.Prefix, &scopes, &apiKey.CreatedAt, &lastUsedAt); err != nil {
+			return nil, err
+		}
+		apiKey.Scopes = strings.Fields(scopes)
+		if lastUsedAt.Valid {
+			apiKey.LastUsedAt = &lastUsedAt.Time
+		}
+		result = append(result, apiKey)
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	return result, rows.Close()
+}
+
+func (s *Store) RevokeAPIKey(ctx context.Context, login string, id int) error {
+	result, err := s.conn.ExecContext(ctx, `
+		UPDATE api_keys SET revoked_at = $3
+		FROM users
+		WHERE api_keys.user_id = users.id AND users.login = $1 AND api_keys.id = $2 AND api_keys.revoked_at IS NULL`,
+		login, id, time.Now())
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return storage.ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// UseAPIKey находит действующий ключ по хешу и возвращает логин владельца и разрешения ключа.
+// Время использования обновляется, только если оно раньше touchBefore, чтобы не писать в базу на каждом запросе.
+func (s *Store) UseAPIKey(ctx context.Context, keyHash string, usedAt, touchBefore time.Time) (string, []string, error) {
+	row := s.conn.QueryRowContext(ctx, `
+		WITH found AS (
+			SELECT api_keys.id, api_keys.last_used_at, api_keys.scopes, users.login
+			FROM api_keys
+				INNER JOIN users
+				ON api_keys.user_id = users.id
+			WHERE api_keys.key_hash = $1 AND api_keys.revoked_at IS NULL
+		), used AS (
+			UPDATE api_keys SET last_used_at = $2
+			FROM found
+			WHERE api_keys.id = found.id AND (found.last_used_at IS NULL OR found.last_used_at < $3)
+		)
+		SELECT login, scopes FROM found`, keyHash, usedAt, touchBefore)
+	var login, scopes string
+	if err := row.Scan(&login, &scopes); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil, storage.ErrAPIKeyNotFound
+		}
+		return "", nil, err
+	}
+	return login, strings.Fields(scopes), nil
+}
+
+// SaveTOTP сохраняет новый неподтверждённый секрет TOTP и коды восстановления,
+// заменяя прежние.
+func (s *Store) SaveTOTP(ctx context.Context, login, secret string, recoveryCodeHashes []string) error {
+	userID, err := s.getUserID(ctx, login)
+	if err != nil {
+		return err
+	}
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO user_totp (user_id, secret, enabled, last_used_step, created_at) VALUES ($1, $2, false, 0, $3)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, enabled = false, last_used_step = 0, created_at = EXCLUDED.created_at`,
+		userID, secret, time.Now()); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for _, codeHash := range recoveryCodeHashes {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, codeHash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) GetTOTP(ctx context.Context, login string) (*storage.TOTP, error) {
+	row := s.conn.QueryRowContext(ctx, `
+		SELECT t.secret, t.enabled, t.last_used_step
+		FROM user_totp t
+			INNER JOIN users u
+			ON t.user_id = u.id
+		WHERE u.login = $1`, login)
+	var totp storage.TOTP
+	if err := row.Scan(&totp.Secret, &totp.Enabled, &totp.LastUsedStep); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storage.ErrTOTPNotFound
+		}
+		return nil, err
+	}
+	return &totp, nil
+}
+
+// UseTOTPStep запоминает принятый шаг TOTP и включает второй фактор, если он ещё не подтверждён.
+// Шаг, не превышающий ранее принятый, отклоняется с ErrTOTPCodeUsed.
+func (s *Store) UseTOTPStep(ctx context.Context, login string, step int64) error {
+	result, err := s.conn.ExecContext(ctx, `
+		UPDATE user_totp SET last_used_step = $2, enabled = true
+		FROM users
+		WHERE user_totp.user_id = users.id AND users.login = $1 AND user_totp.last_used_step < $2`,
+		login, step)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return storage.ErrTOTPCodeUsed
+	}
+	return nil
+}
+
+func (s *Store) UseRecoveryCode(ctx context.Context, login, codeHash string) error {
+	result, err := s.conn.ExecContext(ctx, `
+		UPDATE totp_recovery_codes SET used_at = $3
+		FROM users
+		WHERE totp_recovery_codes.user_id = users.id AND users.login = $1
+			AND totp_recovery_codes.code_hash = $2 AND totp_recovery_codes.used_at IS NULL`,
+		login, codeHash, time.Now())
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return storage.ErrRecoveryCodeInvalid
+	}
+	return nil
+}
+
+func (s *Store) DeleteTOTP(ctx context.Context, login string) error {
+	userID, err := s.getUserID(ctx, login)
+	if err != nil {
+		return err
+	}
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_totp WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ExportUserData собирает данные пользователя в одном согласованном снимке.
+func (s *Store) ExportUserData(ctx context.Context, login string) (*storage.UserExport, error) {
+	tx, err := s.conn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		result storage.UserExport
+		userID int
+	)
+	row := tx.QueryRowContext(ctx, `
+		SELECT u.id, u.login, u.role
+			,EXISTS (SELECT 1 FROM user_totp t WHERE t.user_id = u.id AND t.enabled)
+			,COALESCE(p.balance, 0), COALESCE(p.points_out, 0)
+		FROM users u
+			LEFT JOIN users_current_points p
+			ON u.id = p.user_id
+		WHERE u.login = $1 AND u.deleted_at IS NULL`, login)
+	profile := &result.Profile
+	if err := row.Scan(&userID, &profile.Login, &profile.Role, &profile.TOTPEnabled,
+		&profile.Balance.Current, &profile.Balance.Withdrawn); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storage.ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, uploaded_at FROM orders WHERE user_id = $1 ORDER BY uploaded_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var order storage.ExportOrder
+		if err := rows.Scan(&order.Number, &order.UploadedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result.Orders = append(result.Orders, order)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT h.order_id, k.name, h.date_time
+		FROM history_statuses h
+			INNER JOIN orders o
+			ON h.order_id = o.id
+			INNER JOIN status_values_kinds k
+			ON h.status_id = k.id
+		WHERE o.user_id = $1
+		ORDER BY h.order_id, h.date_time`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var status storage.ExportStatus
+		if err := rows.Scan(&status.Order, &status.Status, &status.DateTime); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result.HistoryStatuses = append(result.HistoryStatuses, status)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT order_id, date_time, flow_in, points FROM orders_points WHERE user_id = $1 ORDER BY date_time`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var movement storage.ExportPointsMovement
+		if err := rows.Scan(&movement.Order, &movement.DateTime, &movement.FlowIn, &movement.Points); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result.OrdersPoints = append(result.OrdersPoints, movement)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	return &result, tx.Commit()
+}
+
+// AnonymizeUser удаляет учётную запись: логин заменяется на anonymousLogin, пароль и все
+// данные входа стираются. Заказы, история статусов и движения баллов остаются за тем же user_id.
+func (s *Store) AnonymizeUser(ctx context.Context, login, anonymousLogin string) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+		SELECT id FROM users WHERE login = $1 AND deleted_at IS NULL FOR UPDATE`, login)
+	var userID int
+	if err := row.Scan(&userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return storage.ErrUserNotFound
+		}
+		return err
+	}
+
+	curTime := time.Now()
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users SET login = $2, password = '', password_algorithm = 'plain', password_params = '',
+			role = $3, tokens_valid_after = $4, deleted_at = $4
+		WHERE id = $1`,
+		userID, anonymousLogin, storage.RoleUser, curTime.Truncate(time.Second)); err != nil {
+		return err
+	}
+	for _, query := range []string{
+		`DELETE FROM refresh_tokens WHERE user_id = $1`,
+		`DELETE FROM sessions WHERE user_id = $1`,
+		`DELETE FROM api_keys WHERE user_id = $1`,
+		`DELETE FROM totp_recovery_codes WHERE user_id = $1`,
+		`DELETE FROM user_totp WHERE user_id = $1`,
+		`DELETE FROM password_reset_tokens WHERE user_id = $1`,
+		`DELETE FROM user_identities WHERE user_id = $1`,
+		`DELETE FROM oidc_states WHERE link_user_id = $1`,
+	} {
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM login_attempts WHERE key = ANY($1)`, []string{"login:" + login, "otp:" + login, "stepup:" + login, "reset:login:" + login}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) SaveOIDCState(ctx context.Context, stateHash string, state storage.OIDCState) error {
+	var linkUserID sql.NullInt64
+	if state.LinkLogin != "" {
+		userID, err := s.getUserID(ctx, state.LinkLogin)
+		if err != nil {
+			return err
+		}
+		linkUserID = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
+	curTime := time.Now()
+	// незавершённые входы больше не нужны
+	if _, err := s.conn.ExecContext(ctx, `DELETE FROM oidc_states WHERE expires_at < $1`, curTime); err != nil {
+		return err
+	}
+	_, err := s.conn.ExecContext(ctx, `
+		INSERT INTO oidc_states (state_hash, nonce, code_verifier, link_user_id, reauth, expires_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		stateHash, state.Nonce, state.CodeVerifier, linkUserID, state.Reauth, state.ExpiresAt)
+	return err
+}
+
+// TakeOIDCState возвращает и удаляет незавершённый вход, каждый state можно использовать один раз.
+func (s *Store) TakeOIDCState(ctx context.Context, stateHash string) (*storage.OIDCState, error) {
+	row := s.conn.QueryRowContext(ctx, `
+		WITH deleted AS (
+			DELETE FROM oidc_states WHERE state_hash = $1
+			RETURNING nonce, code_verifier, link_user_id, reauth, expires_at
+		)
+		SELECT d.nonce, d.code_verifier, COALESCE(u.login, ''), d.reauth, d.expires_at
+		FROM deleted d
+			LEFT JOIN users u
+			ON d.link_user_id = u.id`, stateHash)
+	var state storage.OIDCState
+	if err := row.Scan(&state.Nonce, &state.CodeVerifier, &state.LinkLogin, &state.Reauth, &state.ExpiresAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storage.ErrOIDCStateInvalid
+		}
+		return nil, err
+	}
+	if state.ExpiresAt.Before(time.Now()) {
+		return nil, storage.ErrOIDCStateInvalid
+	}
+	return &state, nil
+}
+
+func (s *Store) GetLoginByIdentity(ctx context.Context, issuer, subject string) (string, error) {
+	row := s.conn.QueryRowContext(ctx, `
+		SELECT u.login
+		FROM user_identities i
+			INNER JOIN users u
+			ON i.user_id = u.id
+		WHERE i.issuer = $1 AND i.subject = $2 AND u.deleted_at IS NULL`, issuer, subject)
+	var login string
+	if err := row.Scan(&login); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", storage.ErrUserNotFound
+		}
+		return "", err
+	}
+	return login, nil
+}
+
+// LinkIdentity привязывает внешнюю учётную запись к пользователю. Если она уже привязана
+// к другому пользователю, возвращает ErrIdentityLinked.
+func (s *Store) LinkIdentity(ctx context.Context, login, issuer, subject string) error {
+	userID, err := s.getUserID(ctx, login)
+	if err != nil {
+		return err
+	}
+	if _, err := s.conn.ExecContext(ctx, `
+		INSERT INTO user_identities (issuer, subject, user_id, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (issuer, subject) DO NOTHING`,
+		issuer, subject, userID, time.Now()); err != nil {
+		return err
+	}
+	row := s.conn.QueryRowContext(ctx, `
+		SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2`, issuer, subject)
+	var linkedUserID int
+	if err := row.Scan(&linkedUserID); err != nil {
+		return err
+	}
+	if linkedUserID != userID {
+		return storage.ErrIdentityLinked
+	}
+	return nil
+}
+
+// SaveReauthentication запоминает, что пользователь внешней учётной записи повторно подтвердил вход у провайдера.
+func (s *Store) SaveReauthentication(ctx context.Context, issuer, subject string, reauthenticatedAt time.Time) error {
+	result, err := s.conn.ExecContext(ctx, `
+		UPDATE user_identities SET reauthenticated_at = $3 WHERE issuer = $1 AND subject = $2`,
+		issuer, subject, reauthenticatedAt)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return storage.ErrIdentityNotFound
+	}
+	return nil
+}
+
+// TakeReauthentication возвращает и сбрасывает время последнего повторного подтверждения входа
+// у провайдера, каждое подтверждение можно использовать один раз. Нулевое время - подтверждения не было.
+// Если у пользователя нет привязанных внешних учётных записей, возвращает ErrIdentityNotFound.
+func (s *Store) TakeReauthentication(ctx context.Context, login string) (time.Time, error) {
+	userID, err := s.getUserID(ctx, login)
+	if err != nil {
+		return time.Time{}, err
+	}
+	row := s.conn.QueryRowContext(ctx, `
+		WITH identities AS (
+			SELECT issuer, subject, reauthenticated_at FROM user_identities WHERE user_id = $1 FOR UPDATE
+		), reset AS (
+			UPDATE user_identities i SET reauthenticated_at = NULL
+			FROM identities d
+			WHERE i.issuer = d.issuer AND i.subject = d.subject AND d.reauthenticated_at IS NOT NULL
+		)
+		SELECT count(*), max(reauthenticated_at) FROM identities`, userID)
+	var identities int
+	var reauthenticatedAt sql.NullTime
+	if err := row.Scan(&identities, &reauthenticatedAt); err != nil {
+		return time.Time{}, err
+	}
+	if identities == 0 {
+		return time.Time{}, storage.ErrIdentityNotFound
+	}
+	return reauthenticatedAt.Time, nil
+}
+
+// SaveNewUserWithIdentity создаёт пользователя, вошедшего через внешнего провайдера, вместе с привязкой.
+func (s *Store) SaveNewUserWithIdentity(ctx context.Context, login string, password storage.PasswordHash, issuer, subject string) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	curTime := time.Now()
+	row := tx.QueryRowContext(ctx, `
+		INSERT INTO users (login, password, password_algorithm, password_params, tokens_valid_after) VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`,
+		login, password.Hash, password.Algorithm, password.Params, curTime.Truncate(time.Second))
+	var userID int
+	if err := row.Scan(&userID); err != nil {
+		return saveNewUserCheckInsertError(err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO user_identities (issuer, subject, user_id, created_at) VALUES ($1, $2, $3, $4)`,
+		issuer, subject, userID, curTime); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return storage.ErrIdentityLinked
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) SaveRefreshToken(ctx context.Context, login string, token storage.RefreshToken) error {
+	userID, err := s.getUserID(ctx, login)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (token_hash, family_id, user_id, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)`,
+		token.Hash, token.FamilyID, userID, time.Now(), token.ExpiresAt)
+	return err
+}
+
+// RotateRefreshToken помечает токен использованным и сохраняет вместо него новый из той же цепочки.
+// Возвращает логин владельца и идентификатор цепочки. Если токен уже был использован или отозван,
+// отзывается вся цепочка.
+func (s *Store) RotateRefreshToken(ctx context.Context, oldHash string, newToken storage.RefreshToken) (string, string, error) {
+	tx, err := s.conn.BeginTx(ctx, nil)
 	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+		SELECT t.family_id, t.user_id, u.login, t.expires_at, t.used_at IS NOT NULL OR t.revoked_at IS NOT NULL
+		FROM refresh_tokens t
+			INNER JOIN users u
+			ON t.user_id = u.id
+		WHERE t.token_hash = $1 FOR UPDATE OF t`, oldHash)
+	var (
+		familyID  string
+		userID    int
+		login     string
+		expiresAt time.Time
+		isUsed    bool
+	)
+	if err := row.Scan(&familyID, &userID, &login, &expiresAt, &isUsed); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", storage.ErrRefreshTokenNotFound
+		}
+		return "", "", err
+	}
+
+	curTime := time.Now()
+	if isUsed {
+		if err := revokeRefreshTokenFamily(ctx, tx, familyID, curTime); err != nil {
+			return "", "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return "", "", err
+		}
+		return "", "", storage.ErrRefreshTokenReused
+	}
+	if expiresAt.Before(curTime) {
+		return "", "", storage.ErrRefreshTokenExpired
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE refresh_tokens SET used_at = $2 WHERE token_hash = $1`, oldHash, curTime); err != nil {
+		return "", "", err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (token_hash, family_id, user_id, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)`,
+		newToken.Hash, familyID, userID, curTime, newToken.ExpiresAt); err != nil {
+		return "", "", err
+	}
+
+	return login, familyID, tx.Commit()
+}
+
+func (s *Store) RevokeRefreshTokenFamily(ctx context.Context, tokenHash string) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `SELECT family_id FROM refresh_tokens WHERE token_hash = $1`, tokenHash)
+	var familyID string
+	if err := row.Scan(&familyID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	if err := revokeRefreshTokenFamily(ctx, tx, familyID, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// revokeRefreshTokenFamily отзывает цепочку refresh-токенов вместе с её сессией.
+func revokeRefreshTokenFamily(ctx context.Context, tx *sql.Tx, familyID string, revokedAt time.Time) error {
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE refresh_tokens SET revoked_at = $2 WHERE family_id = $1 AND revoked_at IS NULL`,
+		familyID, revokedAt); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `
+		UPDATE sessions SET revoked_at = $2 WHERE id = $1 AND revoked_at IS NULL`,
+		familyID, revokedAt)
+	return err
+}
+
+// SaveSession создаёт сессию или обновляет сведения о клиенте и время последней активности.
+func (s *Store) SaveSession(ctx context.Context, login string, session storage.Session) error {
+	userID, err := s.getUserID(ctx, login)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.ExecContext(ctx, `
+		INSERT INTO sessions (id, user_id, user_agent, ip, created_at, last_seen_at) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (id) DO UPDATE SET user_agent = EXCLUDED.user_agent, ip = EXCLUDED.ip, last_seen_at = EXCLUDED.last_seen_at
+		WHERE sessions.user_id = EXCLUDED.user_id`,
+		session.ID, userID, session.UserAgent, session.IP, session.CreatedAt, session.LastSeenAt)
+	return err
+}
+
+// TouchSession сообщает, действует ли сессия, и обновляет время последней активности,
+// если оно раньше touchBefore: так сессия не перезаписывается на каждом запросе.
+func (s *Store) TouchSession(ctx context.Context, id, login string, lastSeenAt, touchBefore time.Time) (bool, error) {
+	row := s.conn.QueryRowContext(ctx, `
+		WITH session AS (
+			SELECT sessions.id, sessions.last_seen_at
+			FROM sessions
+				INNER JOIN users
+				ON sessions.user_id = users.id
+			WHERE sessions.id = $1 AND users.login = $2 AND sessions.revoked_at IS NULL
+		), touched AS (
+			UPDATE sessions SET last_seen_at = $3
+			FROM session
+			WHERE sessions.id = session.id AND session.last_seen_at < $4
+		)
+		SELECT EXISTS (SELECT 1 FROM session)`,
+		id, login, lastSeenAt, touchBefore)
+	var active bool
+	if err := row.Scan(&active); err != nil {
+		return false, err
+	}
+	return active, nil
+}
+
+// GetSessions возвращает сессии, у которых остался действующий refresh-токен.
+func (s *Store) GetSessions(ctx context.Context, login string) ([]storage.Session, error) {
+	var result []storage.Session
+	rows, err := s.conn.QueryContext(ctx, `
+		SELECT s.id, s.user_agent, s.ip, s.created_at, s.last_seen_at
+		FROM sessions s
+			INNER JOIN users u
+			ON s.user_id = u.id
+		WHERE u.login = $1 AND s.revoked_at IS NULL
+			AND EXISTS (SELECT 1 FROM refresh_tokens t
+				WHERE t.family_id = s.id AND t.used_at IS NULL AND t.revoked_at IS NULL AND t.expires_at > $2)
+		ORDER BY s.last_seen_at DESC`, login, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var session storage.Session
+		if err := rows.Scan(&session.ID, &session.UserAgent, &session.IP, &session.CreatedAt, &session.LastSeenAt); err != nil {
+			return nil, err
+		}
+		result = append(result, session)
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	return result, rows.Close()
+}
+
+// RevokeSession завершает сессию пользователя: отзывает её refresh-токены,
+// а access-токены сессии перестают приниматься.
+func (s *Store) RevokeSession(ctx context.Context, login, id string) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+		SELECT s.id
+		FROM sessions s
+			INNER JOIN users u
+			ON s.user_id = u.id
+		WHERE s.id = $1 AND u.login = $2 AND s.revoked_at IS NULL FOR UPDATE OF s`, id, login)
+	if err := row.Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return storage.ErrSessionNotFound
+		}
+		return err
+	}
+	if err := revokeRefreshTokenFamily(ctx, tx, id, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Заодно чистим записи о токенах, срок действия которых уже истёк
+	if _, err := tx.ExecContext(ctx, `DELETE FROM revoked_tokens WHERE expires_at < $1`, time.Now()); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING`,
+		jti, expiresAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AccessTokenIsRevoked проверяет, отозван ли токен по jti или выпущен до момента,
+// когда все токены пользователя были признаны недействительными.
+func (s *Store) AccessTokenIsRevoked(ctx context.Context, jti, login string, issuedAt time.Time) (bool, error) {
+	row := s.conn.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)
+			OR NOT EXISTS (SELECT 1 FROM users WHERE login = $2 AND (tokens_valid_after IS NULL OR tokens_valid_after <= $3))`,
+		jti, login, issuedAt)
+	var isRevoked bool
+	if err := row.Scan(&isRevoked); err != nil {
 		return false, err
 	}
-	rowsAffected, err := rows.RowsAffected()
+	return isRevoked, nil
+}
+
+// ChangePassword сохраняет новый хеш пароля, завершает все сессии пользователя и отзывает его API-ключи.
+func (s *Store) ChangePassword(ctx context.Context, login string, password storage.PasswordHash) error {
+	userID, err := s.getUserID(ctx, login)
 	if err != nil {
-		return false, err
+		return err
+	}
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updatePasswordAndRevokeSessions(ctx, tx, userID, password); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) SavePasswordResetToken(ctx context.Context, login, tokenHash string, expiresAt time.Time) error {
+	userID, err := s.getUserID(ctx, login)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.ExecContext(ctx, `
+		INSERT INTO password_reset_tokens (token_hash, user_id, created_at, expires_at) VALUES ($1, $2, $3, $4)`,
+		tokenHash, userID, time.Now(), expiresAt)
+	return err
+}
+
+// ResetPassword гасит токен сброса пароля, сохраняет новый хеш пароля, завершает все сессии,
+// отзывает API-ключи и возвращает логин пользователя.
+func (s *Store) ResetPassword(ctx context.Context, tokenHash string, password storage.PasswordHash) (string, error) {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	curTime := time.Now()
+	row := tx.QueryRowContext(ctx, `
+		UPDATE password_reset_tokens SET used_at = $2
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2
+		RETURNING user_id`, tokenHash, curTime)
+	var userID int
+	if err := row.Scan(&userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", storage.ErrResetTokenInvalid
+		}
+		return "", err
+	}
+
+	if err := updatePasswordAndRevokeSessions(ctx, tx, userID, password); err != nil {
+		return "", err
+	}
+	// Остальные выданные токены сброса больше не нужны
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE password_reset_tokens SET used_at = $2 WHERE user_id = $1 AND used_at IS NULL`,
+		userID, curTime); err != nil {
+		return "", err
+	}
+
+	row = tx.QueryRowContext(ctx, `SELECT login FROM users WHERE id = $1`, userID)
+	var login string
+	if err := row.Scan(&login); err != nil {
+		return "", err
+	}
+	return login, tx.Commit()
+}
+
+func updatePasswordAndRevokeSessions(ctx context.Context, tx *sql.Tx, userID int, password storage.PasswordHash) error {
+	// iat в JWT хранится с точностью до секунды, поэтому и границу храним с той же точностью
+	curTime := time.Now().Truncate(time.Second)
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users SET password = $2, password_algorithm = $3, password_params = $4, tokens_valid_after = $5
+		WHERE id = $1`,
+		userID, password.Hash, password.Algorithm, password.Params, curTime); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE refresh_tokens SET revoked_at = $2 WHERE user_id = $1 AND revoked_at IS NULL`,
+		userID, curTime); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE sessions SET revoked_at = $2 WHERE user_id = $1 AND revoked_at IS NULL`,
+		userID, curTime); err != nil {
+		return err
+	}
+	// ключи могли быть выпущены тем, кто узнал старый пароль
+	_, err := tx.ExecContext(ctx, `
+		UPDATE api_keys SET revoked_at = $2 WHERE user_id = $1 AND revoked_at IS NULL`,
+		userID, curTime)
+	return err
+}
+
+// Счётчики попыток по ключам: неудачные входы ("login:", "ip:") и запросы сброса пароля ("reset:").
+// Что считается попыткой и когда ключ блокируется, решает сервис.
+
+// LockedUntil возвращает самое позднее время блокировки среди переданных ключей.
+// Если ни один ключ не заблокирован, возвращается нулевое время.
+func (s *Store) LockedUntil(ctx context.Context, keys []string) (time.Time, error) {
+	row := s.conn.QueryRowContext(ctx, `
+		SELECT MAX(locked_until) FROM login_attempts WHERE key = ANY($1)`, keys)
+	var lockedUntil sql.NullTime
+	if err := row.Scan(&lockedUntil); err != nil {
+		return time.Time{}, err
+	}
+	if !lockedUntil.Valid {
+		return time.Time{}, nil
+	}
+	return lockedUntil.Time, nil
+}
+
+// RegisterAttempt увеличивает счётчик попыток по ключу и возвращает его новое значение.
+// Если последняя попытка была раньше resetBefore, счётчик начинается заново.
+func (s *Store) RegisterAttempt(ctx context.Context, key string, resetBefore time.Time) (int, error) {
+	row := s.conn.QueryRowContext(ctx, `
+		INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure_at < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure_at = $2
+		RETURNING failures`, key, time.Now(), resetBefore)
+	var failures int
+	if err := row.Scan(&failures); err != nil {
+		return 0, err
+	}
+	return failures, nil
+}
+
+// LockKey блокирует ключ до lockedUntil.
+func (s *Store) LockKey(ctx context.Context, key string, lockedUntil time.Time) error {
+	_, err := s.conn.ExecContext(ctx, `UPDATE login_attempts SET locked_until = $2 WHERE key = $1`, key, lockedUntil)
+	return err
+}
+
+// ResetAttempts удаляет счётчики и блокировки ключей.
+func (s *Store) ResetAttempts(ctx context.Context, keys []string) error {
+	_, err := s.conn.ExecContext(ctx, `DELETE FROM login_attempts WHERE key = ANY($1)`, keys)
+	return err
+}
+
+// StartIdempotentRequest занимает ключ идемпотентности за пользователем. Если ключ уже занят
+// тем же запросом, возвращается сохранённый ответ, другим запросом - ErrIdempotencyKeyMismatch.
+// Ключ, занятый запросом без ответа, возвращает ErrIdempotencyKeyInProgress, пока не истёк lockedUntil,
+// после этого ключ занимается заново.
+func (s *Store) StartIdempotentRequest(ctx context.Context, login, key, fingerprint string, lockedUntil, expiresAt time.Time) (*storage.IdempotentResponse, error) {
+	userID, err := s.getUserID(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM idempotency_keys WHERE user_id = $1 AND expires_at <= $2`, userID, now); err != nil {
+		return nil, err
+	}
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO idempotency_keys (user_id, key, fingerprint, created_at, expires_at, locked_until)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, key) DO NOTHING`,
+		userID, key, fingerprint, now, expiresAt, lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if inserted == 1 {
+		return nil, tx.Commit()
+	}
+
+	var (
+		storedFingerprint string
+		statusCode        sql.NullInt64
+		storedLockedUntil sql.NullTime
+		response          storage.IdempotentResponse
+	)
+	row := tx.QueryRowContext(ctx, `
+		SELECT fingerprint, status_code, content_type, body, locked_until
+		FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2
+		FOR UPDATE`, userID, key)
+	if err := row.Scan(&storedFingerprint, &statusCode, &response.ContentType, &response.Body, &storedLockedUntil); err != nil {
+		return nil, err
+	}
+	if storedFingerprint != fingerprint {
+		return nil, storage.ErrIdempotencyKeyMismatch
 	}
-	if rowsAffected > 0 {
-		return true, nil
+	if !statusCode.Valid {
+		if storedLockedUntil.Valid && storedLockedUntil.Time.After(now) {
+			return nil, storage.ErrIdempotencyKeyInProgress
+		}
+		// запрос, занявший ключ, не завершился: ключ переходит к повторному
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE idempotency_keys SET locked_until = $3 WHERE user_id = $1 AND key = $2`,
+			userID, key, lockedUntil); err != nil {
+			return nil, err
+		}
+		return nil, tx.Commit()
 	}
-	return false, nil
+	response.StatusCode = int(statusCode.Int64)
+	return &response, tx.Commit()
+}
+
+// SaveIdempotentResponse сохраняет ответ на запрос, занявший ключ
+func (s *Store) SaveIdempotentResponse(ctx context.Context, login, key string, response storage.IdempotentResponse) error {
+	_, err := s.conn.ExecContext(ctx, `
+		UPDATE idempotency_keys SET status_code = $3, content_type = $4, body = $5
+		WHERE user_id = (SELECT id FROM users WHERE login = $1) AND key = $2`,
+		login, key, response.StatusCode, response.ContentType, response.Body)
+	return err
+}
+
+// DeleteIdempotencyKey освобождает ключ, например после ошибки сервера, чтобы запрос можно было повторить
+func (s *Store) DeleteIdempotencyKey(ctx context.Context, login, key string) error {
+	_, err := s.conn.ExecContext(ctx, `
+		DELETE FROM idempotency_keys
+		WHERE user_id = (SELECT id FROM users WHERE login = $1) AND key = $2`, login, key)
+	return err
 }
 
-func (s *Store) SaveNewOrder(ctx context.Context, id int, login string) error {
+func (s *Store) SaveNewOrder(ctx context.Context, id storage.OrderNumber, login string) error {
 
 	userID, err := s.getUserID(ctx, login)
 	if err != nil {
@@ -92,7 +1093,33 @@ func (s *Store) SaveNewOrder(ctx context.Context, id int, login string) error {
 	return tx.Commit()
 }
 
-func createOrderWithStatusNew(ctx context.Context, tx *sql.Tx, id int, userID int) error {
+// SaveNewOrders сохраняет пакет заказов в одной транзакции. Уже загруженные заказы не прерывают
+// загрузку остальных, их результат возвращается в соответствующем элементе.
+func (s *Store) SaveNewOrders(ctx context.Context, ids []storage.OrderNumber, login string) ([]storage.OrderBatchItem, error) {
+	userID, err := s.getUserID(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result := make([]storage.OrderBatchItem, 0, len(ids))
+	for _, id := range ids {
+		err := createOrderWithStatusNew(ctx, tx, id, userID)
+		if err != nil && !errors.Is(err, storage.ErrOrderIDNotUnique) && !errors.Is(err, storage.ErrOrderLoadedByAnotherUser) {
+			return nil, err
+		}
+		result = append(result, storage.OrderBatchItem{ID: id, Err: err})
+	}
+
+	return result, tx.Commit()
+}
+
+func createOrderWithStatusNew(ctx context.Context, tx *sql.Tx, id storage.OrderNumber, userID int) error {
 	uploadedAt := time.Now()
 
 	if _, err := tx.ExecContext(ctx, `
@@ -126,7 +1153,7 @@ func createOrderWithStatusNew(ctx context.Context, tx *sql.Tx, id int, userID in
 	return updateOrderStatus(ctx, tx, id, storage.StatusNEW, uploadedAt)
 }
 
-func updateOrderStatus(ctx context.Context, tx *sql.Tx, orderID int, statusID int, statusTime time.Time) error {
+func updateOrderStatus(ctx context.Context, tx *sql.Tx, orderID storage.OrderNumber, statusID int, statusTime time.Time) error {
 	if _, err := tx.ExecContext(ctx,
 		`INSERT INTO history_statuses (date_time, order_id, status_id) VALUES ($1, $2, $3)`,
 		statusTime, orderID, statusID); err != nil {
@@ -134,11 +1161,11 @@ func updateOrderStatus(ctx context.Context, tx *sql.Tx, orderID int, statusID in
 	}
 
 	if _, err := tx.ExecContext(ctx,
-		`INSERT INTO current_statuses (order_id, status_id, date_time)
-		VALUES ($1, $2, $3)
+		`INSERT INTO current_statuses (order_id, status_id, date_time, polling_since)
+		VALUES ($1, $2, $3, $4)
 	 	ON CONFLICT (order_id)
 		DO UPDATE SET status_id = $2, date_time = $3`,
-		orderID, statusID, statusTime); err != nil {
+		orderID, statusID, statusTime, statusTime); err != nil {
 		return err
 	}
 	return nil
@@ -161,12 +1188,15 @@ func (s *Store) getUserID(ctx context.Context, login string) (int, error) {
 	row := s.conn.QueryRowContext(ctx, `SELECT id FROM users WHERE login = $1`, login)
 	var userID int
 	if err := row.Scan(&userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, storage.ErrUserNotFound
+		}
 		return 0, err
 	}
 	return userID, nil
 }
 
-func (s *Store) getUserByOrder(ctx context.Context, OrderID int) (int, error) {
+func (s *Store) getUserByOrder(ctx context.Context, OrderID storage.OrderNumber) (int, error) {
 	row := s.conn.QueryRowContext(ctx, `SELECT user_id FROM orders WHERE id = $1`, OrderID)
 	var userID int
 	if err := row.Scan(&userID); err != nil {
@@ -175,7 +1205,7 @@ func (s *Store) getUserByOrder(ctx context.Context, OrderID int) (int, error) {
 	return userID, nil
 }
 
-func (s *Store) GetOrderList(ctx context.Context, login string) (*[]storage.OrderData, error) {
+func (s *Store) GetOrderList(ctx context.Context, login string, filter storage.ListFilter) (*[]storage.OrderData, error) {
 	var result []storage.OrderData
 
 	queryText :=
@@ -192,12 +1222,18 @@ func (s *Store) GetOrderList(ctx context.Context, login string) (*[]storage.Orde
 			ON current_statuses.status_id = status_values_kinds.id
 			LEFT JOIN orders_points
 			ON orders.id = orders_points.order_id
-		WHERE users.login = $1
-		`
-	rows, err := s.conn.QueryContext(ctx, queryText, login)
+		WHERE users.login = $1`
+	args := []interface{}{login}
+	if len(filter.Statuses) != 0 {
+		args = append(args, filter.Statuses)
+		queryText += ` AND status_values_kinds.name = ANY($2)`
+	}
+	queryText, args = listQuery(queryText, args, filter, "orders.uploaded_at", "orders.id")
+	rows, err := s.conn.QueryContext(ctx, queryText, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		orderData := new(storage.OrderData)
 		if err := rows.Scan(&orderData.Number, &orderData.Status, &orderData.UploadedAt, &orderData.Accrual); err != nil {
@@ -213,8 +1249,97 @@ func (s *Store) GetOrderList(ctx context.Context, login string) (*[]storage.Orde
 	return &result, rows.Close()
 }
 
+// listQuery дополняет запрос условиями по периоду и курсору, сортировкой и ограничением количества строк.
+// Сортировка по времени и номеру заказа, чтобы курсор однозначно задавал позицию.
+// Колонки времени хранят местное время без зоны, а pgx при записи в них отбрасывает зону,
+// поэтому границы периода переводятся в местное время.
+func listQuery(queryText string, args []interface{}, filter storage.ListFilter, timeColumn, idColumn string) (string, []interface{}) {
+	var query strings.Builder
+	query.WriteString(queryText)
+	param := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if !filter.From.IsZero() {
+		fmt.Fprintf(&query, " AND %s >= %s", timeColumn, param(filter.From.In(time.Local)))
+	}
+	if !filter.To.IsZero() {
+		fmt.Fprintf(&query, " AND %s < %s", timeColumn, param(filter.To.In(time.Local)))
+	}
+	direction, comparison := "DESC", "<"
+	if filter.Ascending {
+		direction, comparison = "ASC", ">"
+	}
+	if filter.Cursor != nil {
+		fmt.Fprintf(&query, " AND (%s, %s) %s (%s, %s)",
+			timeColumn, idColumn, comparison, param(filter.Cursor.Time), param(filter.Cursor.ID))
+	}
+	fmt.Fprintf(&query, " ORDER BY %s %s, %s %s", timeColumn, direction, idColumn, direction)
+	if filter.Limit > 0 {
+		fmt.Fprintf(&query, " LIMIT %s", param(filter.Limit))
+	}
+	return query.String(), args
+}
+
+// GetOrder возвращает заказ с историей статусов в порядке их смены
+func (s *Store) GetOrder(ctx context.Context, orderID storage.OrderNumber) (*storage.OrderDetails, error) {
+	tx, err := s.conn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var result storage.OrderDetails
+	row := tx.QueryRowContext(ctx, `
+		SELECT orders.id
+			,users.login
+			,COALESCE(status_values_kinds.name, '') as status
+			,orders.uploaded_at
+			,COALESCE(orders_points.points, 0) as accrual
+		FROM orders
+			INNER JOIN users
+			ON orders.user_id = users.id
+			LEFT JOIN current_statuses
+			ON orders.id = current_statuses.order_id
+			LEFT JOIN status_values_kinds
+			ON current_statuses.status_id = status_values_kinds.id
+			LEFT JOIN orders_points
+			ON orders.id = orders_points.order_id
+		WHERE orders.id = $1`, orderID)
+	if err := row.Scan(&result.Number, &result.Login, &result.Status, &result.UploadedAt, &result.Accrual); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storage.ErrOrderNotFound
+		}
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT COALESCE(status_values_kinds.name, ''), history_statuses.date_time
+		FROM history_statuses
+			LEFT JOIN status_values_kinds
+			ON history_statuses.status_id = status_values_kinds.id
+		WHERE history_statuses.order_id = $1
+		ORDER BY history_statuses.date_time`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result.History = []storage.OrderStatusChange{}
+	for rows.Next() {
+		var change storage.OrderStatusChange
+		if err := rows.Scan(&change.Status, &change.DateTime); err != nil {
+			return nil, err
+		}
+		result.History = append(result.History, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &result, tx.Commit()
+}
+
 // списание баллов
-func (s *Store) WithdrawPoints(ctx context.Context, login string, OrderID int, points float64) error {
+func (s *Store) WithdrawPoints(ctx context.Context, login string, OrderID storage.OrderNumber, points float64) error {
 	userID, err := s.getUserID(ctx, login)
 	if err != nil {
 		return err
@@ -269,8 +1394,8 @@ func (s *Store) WithdrawPoints(ctx context.Context, login string, OrderID int, p
 	return tx.Commit()
 }
 
-// начисление баллов
-func (s *Store) AccruePoints(ctx context.Context, orderID int, points float64) error {
+// начисление баллов по заказу, арендованному экземпляром instanceID
+func (s *Store) AccruePoints(ctx context.Context, orderID storage.OrderNumber, instanceID string, points float64) error {
 	userID, err := s.getUserByOrder(ctx, orderID)
 	if err != nil {
 		return err
@@ -284,6 +1409,10 @@ func (s *Store) AccruePoints(ctx context.Context, orderID int, points float64) e
 	}
 	defer tx.Rollback()
 
+	if err := lockOrderLease(ctx, tx, orderID, instanceID); err != nil {
+		return err
+	}
+
 	if _, err := tx.ExecContext(ctx, `
 		INSERT INTO users_current_points (user_id, points_in, points_out, balance) VALUES ($1, $2, $3, $4) 
 			ON CONFLICT ON CONSTRAINT users_current_points_unique_order_id DO 
@@ -335,22 +1464,19 @@ func (s *Store) GetUserBalance(ctx context.Context, login string) (*storage.User
 }
 
 // список списаний
-func (s *Store) GetWithdrawals(ctx context.Context, login string) (*[]storage.Withdrawals, error) {
+func (s *Store) GetWithdrawals(ctx context.Context, login string, filter storage.ListFilter) (*[]storage.Withdrawals, error) {
 
 	var result []storage.Withdrawals
 
-	stmt, err := s.conn.PrepareContext(ctx,
+	queryText, args := listQuery(
 		`SELECT date_time, order_id, points
 			FROM orders_points o
 			INNER JOIN users u
 			ON o.user_id = u.id
-		WHERE u.login = $1  and o.flow_in = false`)
+		WHERE u.login = $1  and o.flow_in = false`,
+		[]interface{}{login}, filter, "o.date_time", "o.order_id")
 
-	if err != nil {
-		return &result, err
-	}
-
-	rows, err := stmt.QueryContext(ctx, login)
+	rows, err := s.conn.QueryContext(ctx, queryText, args...)
 	if err != nil {
 		return &result, err
 	}
@@ -368,31 +1494,182 @@ func (s *Store) GetWithdrawals(ctx context.Context, login string) (*[]storage.Wi
 	return &result, rows.Close()
 }
 
-func (s *Store) SaveStatus(ctx context.Context, orderID int, statusID int) error {
+// SaveStatus сохраняет статус заказа, арендованного экземпляром instanceID
+func (s *Store) SaveStatus(ctx context.Context, orderID storage.OrderNumber, instanceID string, statusID int) error {
 	tx, err := s.conn.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
+	if err := lockOrderLease(ctx, tx, orderID, instanceID); err != nil {
+		return err
+	}
 	if err := updateOrderStatus(ctx, tx, orderID, statusID, time.Now()); err != nil {
 		return err
 	}
 	return tx.Commit()
 }
 
-func (s *Store) NewAndProcessingOrders(ctx context.Context) ([]int, error) {
-	var result []int
-	rows, err := s.conn.QueryContext(ctx, `SELECT order_id FROM current_statuses WHERE status_id IN ($1, $2) ORDER BY date_time ASC limit 1000`, storage.StatusNEW, storage.StatusPROCESSING)
+// lockOrderLease блокирует строку заказа до конца транзакции, если аренда всё ещё у экземпляра.
+// Иначе аренда истекла и заказ забрал другой экземпляр: результат опроса записывать нельзя,
+// чтобы баллы не начислились дважды, и возвращается storage.ErrOrderLeaseLost.
+func lockOrderLease(ctx context.Context, tx *sql.Tx, orderID storage.OrderNumber, instanceID string) error {
+	row := tx.QueryRowContext(ctx, `
+		SELECT order_id FROM current_statuses WHERE order_id = $1 AND locked_by = $2 FOR UPDATE`, orderID, instanceID)
+	var lockedOrderID string
+	if err := row.Scan(&lockedOrderID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return storage.ErrOrderLeaseLost
+		}
+		return err
+	}
+	return nil
+}
+
+// ClaimOrders берёт в аренду до limit заказов в статусах NEW и PROCESSING, время опроса которых
+// наступило и которые не арендованы другими экземплярами. Заказы с истёкшей арендой, например
+// после падения экземпляра, забираются снова. SKIP LOCKED не даёт двум экземплярам получить один заказ.
+func (s *Store) ClaimOrders(ctx context.Context, instanceID string, limit int, leaseUntil time.Time) ([]storage.ClaimedOrder, error) {
+	var result []storage.ClaimedOrder
+	now := time.Now()
+	rows, err := s.conn.QueryContext(ctx, `
+		UPDATE current_statuses SET locked_by = $1, lease_until = $2
+		WHERE order_id IN (
+			SELECT order_id FROM current_statuses
+			WHERE status_id IN ($3, $4)
+				AND (lease_until IS NULL OR lease_until < $5)
+				AND (next_attempt_at IS NULL OR next_attempt_at <= $5)
+			ORDER BY COALESCE(next_attempt_at, date_time) ASC
+			LIMIT $6
+			FOR UPDATE SKIP LOCKED)
+		RETURNING order_id, status_id, attempts, failures, polling_since`,
+		instanceID, leaseUntil, storage.StatusNEW, storage.StatusPROCESSING, now, limit)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		order := storage.ClaimedOrder{LeaseUntil: leaseUntil}
+		if err := rows.Scan(&order.Number, &order.StatusID, &order.Attempts, &order.Failures, &order.PollingSince); err != nil {
+			return nil, err
+		}
+		result = append(result, order)
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	return result, rows.Close()
+}
+
+// RescheduleOrder снимает аренду заказа и откладывает следующий опрос до nextAttemptAt,
+// увеличивая счётчик попыток, а при failure - и счётчик неудач
+func (s *Store) RescheduleOrder(ctx context.Context, orderID storage.OrderNumber, instanceID string, nextAttemptAt time.Time, failure bool) error {
+	_, err := s.conn.ExecContext(ctx, `
+		UPDATE current_statuses
+		SET locked_by = NULL, lease_until = NULL, attempts = attempts + 1, next_attempt_at = $3,
+			failures = failures + CASE WHEN $4 THEN 1 ELSE 0 END
+		WHERE order_id = $1 AND locked_by = $2`, orderID, instanceID, nextAttemptAt, failure)
+	return err
+}
+
+// MarkOrderStuck переводит арендованный экземпляром заказ в статус STUCK, после чего он больше не опрашивается.
+// Если аренду уже забрал другой экземпляр, заказ не меняется.
+func (s *Store) MarkOrderStuck(ctx context.Context, orderID storage.OrderNumber, instanceID, reason string) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, `
+		UPDATE current_statuses
+		SET locked_by = NULL, lease_until = NULL, attempts = attempts + 1, failures = failures + 1,
+			next_attempt_at = NULL, stuck_reason = $3
+		WHERE order_id = $1 AND locked_by = $2`, orderID, instanceID, reason)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return err
+	}
+	if err := updateOrderStatus(ctx, tx, orderID, storage.StatusSTUCK, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetStuckOrders возвращает заказы в статусе STUCK, время в фильтре - время перевода в STUCK
+func (s *Store) GetStuckOrders(ctx context.Context, filter storage.ListFilter) ([]storage.StuckOrder, error) {
+	var result []storage.StuckOrder
+	queryText, args := listQuery(`
+		SELECT current_statuses.order_id
+			,users.login
+			,current_statuses.attempts
+			,current_statuses.failures
+			,COALESCE(current_statuses.stuck_reason, '')
+			,orders.uploaded_at
+			,current_statuses.date_time
+		FROM current_statuses
+			INNER JOIN orders
+			ON current_statuses.order_id = orders.id
+			INNER JOIN users
+			ON orders.user_id = users.id
+		WHERE current_statuses.status_id = $1`,
+		[]interface{}{storage.StatusSTUCK}, filter, "current_statuses.date_time", "current_statuses.order_id")
+
+	rows, err := s.conn.QueryContext(ctx, queryText, args...)
 	if err != nil {
 		return result, err
 	}
+	defer rows.Close()
 	for rows.Next() {
-		var orderID int
-		rows.Scan(&orderID)
-		result = append(result, orderID)
+		var order storage.StuckOrder
+		if err := rows.Scan(&order.Number, &order.Login, &order.Attempts, &order.Failures, &order.Reason, &order.UploadedAt, &order.StuckAt); err != nil {
+			return nil, err
+		}
+		result = append(result, order)
 	}
 	if err := rows.Err(); err != nil {
 		return result, err
 	}
 	return result, rows.Close()
 }
+
+// RequeueOrder возвращает заказ из статуса STUCK в очередь опроса со статусом NEW
+// и обнуляет счётчик попыток
+func (s *Store) RequeueOrder(ctx context.Context, orderID storage.OrderNumber) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var statusID int
+	row := tx.QueryRowContext(ctx, `SELECT status_id FROM current_statuses WHERE order_id = $1 FOR UPDATE`, orderID)
+	if err := row.Scan(&statusID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return storage.ErrOrderNotFound
+		}
+		return err
+	}
+	if statusID != storage.StatusSTUCK {
+		return storage.ErrOrderNotStuck
+	}
+	now := time.Now()
+	if err := updateOrderStatus(ctx, tx, orderID, storage.StatusNEW, now); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE current_statuses
+		SET attempts = 0, failures = 0, next_attempt_at = NULL, polling_since = $2, stuck_reason = NULL
+		WHERE order_id = $1`, orderID, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReleaseOrder снимает аренду заказа, если она всё ещё принадлежит экземпляру
+func (s *Store) ReleaseOrder(ctx context.Context, orderID storage.OrderNumber, instanceID string) error {
+	_, err := s.conn.ExecContext(ctx, `
+		UPDATE current_statuses SET locked_by = NULL, lease_until = NULL
+		WHERE order_id = $1 AND locked_by = $2`, orderID, instanceID)
+	return err
+}
@@ -0,0 +1,76 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/nasik90/gophermart/internal/app/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestStore подключается к базе из TEST_DATABASE_URI и применяет миграции.
+// Без переменной окружения тесты хранилища пропускаются.
+func newTestStore(t *testing.T) *Store {
+	dsn := os.Getenv("TEST_DATABASE_URI")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+	conn, err := sql.Open("pgx", dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	// миграции ищутся относительно корня модуля
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir("../../../.."))
+	defer os.Chdir(wd)
+	store, err := NewStore(conn)
+	require.NoError(t, err)
+	return store
+}
+
+func TestStore_LockedUntil(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	login := "login:locked-until-" + time.Now().Format("150405.000000")
+	keys := []string{login, "ip:192.0.2.1"}
+	t.Cleanup(func() { store.ResetAttempts(ctx, keys) })
+
+	lockedUntil, err := store.LockedUntil(ctx, keys)
+	require.NoError(t, err)
+	assert.True(t, lockedUntil.IsZero())
+
+	_, err = store.RegisterAttempt(ctx, login, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	lockedUntil, err = store.LockedUntil(ctx, keys)
+	require.NoError(t, err)
+	assert.True(t, lockedUntil.IsZero())
+
+	require.NoError(t, store.LockKey(ctx, login, time.Now().Add(time.Minute)))
+	lockedUntil, err = store.LockedUntil(ctx, keys)
+	require.NoError(t, err)
+	assert.False(t, lockedUntil.IsZero())
+}
+
+func TestListQuery_PeriodInLocalTime(t *testing.T) {
+	local := time.Local
+	defer func() { time.Local = local }()
+	time.Local = time.FixedZone("UTC+5", 5*60*60)
+
+	from, err := time.Parse(time.RFC3339, "2025-05-01T00:00:00+03:00")
+	require.NoError(t, err)
+	to, err := time.Parse(time.RFC3339, "2025-05-02T00:00:00Z")
+	require.NoError(t, err)
+	_, args := listQuery(`SELECT 1 FROM orders WHERE user_id = $1`, []interface{}{1},
+		storage.ListFilter{From: from, To: to}, "uploaded_at", "id")
+
+	// в колонку без зоны попадают местные часы, поэтому границы должны быть в местном времени
+	require.Len(t, args, 3)
+	assert.Equal(t, "2025-05-01 02:00:00", args[1].(time.Time).Format(time.DateTime))
+	assert.Equal(t, "2025-05-02 05:00:00", args[2].(time.Time).Format(time.DateTime))
+}
@@ -7,11 +7,128 @@ import (
 
 var (
 	ErrUserNotUnique            = errors.New("user is not unique")
+	ErrUserNotFound             = errors.New("user not found")
+	ErrOrderNotFound            = errors.New("order not found")
+	ErrOrderNotStuck            = errors.New("order is not stuck")
+	ErrOrderLeaseLost           = errors.New("order lease is held by another instance")
 	ErrOrderIDNotUnique         = errors.New("order id is not unique")
 	ErrOrderLoadedByAnotherUser = errors.New("order loaded by another user")
 	ErrOutOfBalance             = errors.New("out of balance")
+	ErrRefreshTokenNotFound     = errors.New("refresh token not found")
+	ErrRefreshTokenExpired      = errors.New("refresh token expired")
+	ErrRefreshTokenReused       = errors.New("refresh token reused")
+	ErrResetTokenInvalid        = errors.New("password reset token is invalid or expired")
+	ErrAPIKeyNotFound           = errors.New("api key not found")
+	ErrTOTPNotFound             = errors.New("totp is not enrolled")
+	ErrTOTPCodeUsed             = errors.New("totp code already used")
+	ErrRecoveryCodeInvalid      = errors.New("recovery code is invalid or used")
+	ErrSessionNotFound          = errors.New("session not found")
+	ErrOIDCStateInvalid         = errors.New("oidc state is invalid or expired")
+	ErrIdentityLinked           = errors.New("external identity is linked to another user")
+	ErrIdentityNotFound         = errors.New("user has no linked external identity")
+	ErrIdempotencyKeyMismatch   = errors.New("idempotency key is already used for another request")
+	ErrIdempotencyKeyInProgress = errors.New("request with this idempotency key is in progress")
 )
 
+// IdempotentResponse - сохранённый ответ на запрос с ключом идемпотентности
+type IdempotentResponse struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// OrderNumber - номер заказа, прошедший проверку формата.
+// Номер хранится строкой: он может быть длиннее int64 и содержать не только цифры.
+type OrderNumber string
+
+// PasswordHash - хеш пароля вместе с алгоритмом и параметрами, которыми он получен
+type PasswordHash struct {
+	Hash      string
+	Algorithm string
+	Params    string
+}
+
+// RefreshToken - refresh-токен, в базе хранится только его хеш.
+// Все токены, полученные ротацией одного исходного, имеют общий FamilyID.
+type RefreshToken struct {
+	Hash      string
+	FamilyID  string
+	ExpiresAt time.Time
+}
+
+// Session - вход пользователя с одного устройства. ID совпадает с FamilyID его refresh-токенов.
+type Session struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	// Current - сессия, которой выполнен запрос
+	Current bool `json:"current"`
+}
+
+// OIDCState - незавершённый вход через OpenID Connect провайдера.
+// LinkLogin задан, если внешняя учётная запись привязывается к уже вошедшему пользователю.
+// Reauth - вошедший пользователь LinkLogin повторно подтверждает вход у провайдера, привязка не меняется.
+type OIDCState struct {
+	Nonce        string
+	CodeVerifier string
+	LinkLogin    string
+	Reauth       bool
+	ExpiresAt    time.Time
+}
+
+// TOTP - секрет второго фактора пользователя
+type TOTP struct {
+	Secret       string
+	Enabled      bool
+	LastUsedStep int64
+}
+
+// APIKey - сведения об API-ключе без самого ключа
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// UserExport - все данные пользователя для выгрузки по его запросу
+type UserExport struct {
+	Profile         UserProfile            `json:"profile"`
+	Orders          []ExportOrder          `json:"orders"`
+	HistoryStatuses []ExportStatus         `json:"history_statuses"`
+	OrdersPoints    []ExportPointsMovement `json:"orders_points"`
+}
+
+type UserProfile struct {
+	Login       string      `json:"login"`
+	Role        string      `json:"role"`
+	TOTPEnabled bool        `json:"totp_enabled"`
+	Balance     UserBalance `json:"balance"`
+}
+
+type ExportOrder struct {
+	Number     string    `json:"number"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+type ExportStatus struct {
+	Order    string    `json:"order"`
+	Status   string    `json:"status"`
+	DateTime time.Time `json:"date_time"`
+}
+
+// ExportPointsMovement - движение баллов, FlowIn - начисление, иначе списание
+type ExportPointsMovement struct {
+	Order    string    `json:"order"`
+	DateTime time.Time `json:"date_time"`
+	FlowIn   bool      `json:"flow_in"`
+	Points   float64   `json:"points"`
+}
+
 type OrderData struct {
 	Number     string    `json:"number"`
 	Status     string    `json:"status"`
@@ -19,6 +136,67 @@ type OrderData struct {
 	UploadedAt time.Time `json:"uploaded_at"`
 }
 
+// OrderDetails - заказ вместе с историей смены статусов.
+// Login - владелец заказа, в ответ не попадает.
+type OrderDetails struct {
+	OrderData
+	Login   string              `json:"-"`
+	History []OrderStatusChange `json:"history"`
+}
+
+type OrderStatusChange struct {
+	Status   string    `json:"status"`
+	DateTime time.Time `json:"date_time"`
+}
+
+// ClaimedOrder - заказ, взятый в аренду для опроса системы начислений.
+// Attempts - сколько раз заказ уже опрашивался без окончательного статуса,
+// Failures - сколько из этих раз система начислений не знала заказ или ответила неразборчиво,
+// PollingSince - когда заказ попал в очередь опроса, LeaseUntil - когда истекает аренда.
+type ClaimedOrder struct {
+	Number       OrderNumber
+	StatusID     int
+	Attempts     int
+	Failures     int
+	PollingSince time.Time
+	LeaseUntil   time.Time
+}
+
+// StuckOrder - заказ в статусе STUCK для администратора
+type StuckOrder struct {
+	Number     string    `json:"number"`
+	Login      string    `json:"login"`
+	Attempts   int       `json:"attempts"`
+	Failures   int       `json:"failures"`
+	Reason     string    `json:"reason"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	StuckAt    time.Time `json:"stuck_at"`
+}
+
+// OrderBatchItem - результат сохранения одного заказа из пакетной загрузки.
+// Err равен nil, если заказ принят, иначе ErrOrderIDNotUnique или ErrOrderLoadedByAnotherUser.
+type OrderBatchItem struct {
+	ID  OrderNumber
+	Err error
+}
+
+// ListFilter - параметры выборки списка заказов или списаний.
+// Нулевые From и To не ограничивают выборку, Cursor - последняя запись предыдущей страницы.
+type ListFilter struct {
+	Statuses  []string
+	From      time.Time
+	To        time.Time
+	Ascending bool
+	Limit     int
+	Cursor    *ListCursor
+}
+
+// ListCursor - позиция в списке: время записи и номер заказа
+type ListCursor struct {
+	Time time.Time   `json:"t"`
+	ID   OrderNumber `json:"id"`
+}
+
 type UserBalance struct {
 	Current   float64 `json:"current"`
 	Withdrawn float64 `json:"withdrawn"`
@@ -30,9 +208,25 @@ type Withdrawals struct {
 	ProcessedAt time.Time `json:"processed_at"`
 }
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// разрешения API-ключей
+const (
+	ScopeOrdersRead   = "orders:read"
+	ScopeOrdersWrite  = "orders:write"
+	ScopeBalanceRead  = "balance:read"
+	ScopeBalanceWrite = "balance:write"
+)
+
 const (
 	StatusNEW        = 1
 	StatusPROCESSING = 2
 	StatusINVALID    = 3
 	StatusPROCESSED  = 4
+	// StatusSTUCK - окончательный статус заказа, который система начислений не обработала
+	// за отведённое число попыток или время. Вернуть заказ в очередь может администратор.
+	StatusSTUCK = 5
 )
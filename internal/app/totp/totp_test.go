@@ -0,0 +1,48 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCode_RFC6238(t *testing.T) {
+	// тестовые значения из приложения B RFC 6238 (SHA1), последние 6 цифр
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "287082"},
+		{unix: 1111111109, code: "081804"},
+		{unix: 1111111111, code: "050471"},
+		{unix: 1234567890, code: "005924"},
+		{unix: 2000000000, code: "279037"},
+	}
+	for _, tt := range tests {
+		code, err := Code(secret, Step(time.Unix(tt.unix, 0)))
+		assert.NoError(t, err)
+		assert.Equal(t, tt.code, code)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	assert.NoError(t, err)
+	now := time.Now()
+
+	code, err := Code(secret, Step(now.Add(-Period)))
+	assert.NoError(t, err)
+	step, ok := Validate(secret, code, now)
+	assert.True(t, ok)
+	assert.Equal(t, Step(now)-1, step)
+
+	code, err = Code(secret, Step(now.Add(-3*Period)))
+	assert.NoError(t, err)
+	_, ok = Validate(secret, code, now)
+	assert.False(t, ok)
+
+	assert.Contains(t, URI("Gophermart", "vasya", secret), "otpauth://totp/Gophermart:vasya?")
+}
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- таблица для учёта неудачных попыток входа
+-- key - login:<логин> или ip:<адрес>
+-- locked_until - время, до которого вход по ключу заблокирован
+CREATE TABLE IF NOT EXISTS login_attempts
+(
+    key text CONSTRAINT login_attempts_pkey PRIMARY KEY,
+    failures int NOT NULL,
+    last_failure_at timestamp NOT NULL,
+    locked_until timestamp
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE login_attempts;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- таблица для одноразовых токенов сброса пароля
+-- token_hash - sha256 от токена, сам токен не хранится
+CREATE TABLE IF NOT EXISTS password_reset_tokens
+(
+    token_hash text CONSTRAINT password_reset_tokens_pkey PRIMARY KEY,
+    user_id int NOT NULL,
+    created_at timestamp NOT NULL,
+    expires_at timestamp NOT NULL,
+    used_at timestamp
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE password_reset_tokens;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+-- таблица сессий пользователей, сессия - это цепочка refresh-токенов,
+-- поэтому id совпадает с refresh_tokens.family_id
+CREATE TABLE IF NOT EXISTS sessions
+(
+    id text CONSTRAINT sessions_pkey PRIMARY KEY,
+    user_id int NOT NULL,
+    user_agent text NOT NULL,
+    ip text NOT NULL,
+    created_at timestamp NOT NULL,
+    last_seen_at timestamp NOT NULL,
+    revoked_at timestamp
+);
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE sessions;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- время удаления учётной записи: логин заменяется обезличенным, пароль стирается,
+-- заказы и движения баллов сохраняются
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at timestamp;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN IF EXISTS deleted_at;
+-- +goose StatementEnd
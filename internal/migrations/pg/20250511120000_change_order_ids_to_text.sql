@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- номера заказов хранятся строкой: они бывают длиннее bigint и не только из цифр
+ALTER TABLE orders ALTER COLUMN id TYPE text USING id::text;
+ALTER TABLE history_statuses ALTER COLUMN order_id TYPE text USING order_id::text;
+ALTER TABLE current_statuses ALTER COLUMN order_id TYPE text USING order_id::text;
+ALTER TABLE orders_points ALTER COLUMN order_id TYPE text USING order_id::text;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- откат невозможен, если уже загружены нецифровые номера или номера длиннее bigint
+ALTER TABLE orders_points ALTER COLUMN order_id TYPE bigint USING order_id::bigint;
+ALTER TABLE current_statuses ALTER COLUMN order_id TYPE bigint USING order_id::bigint;
+ALTER TABLE history_statuses ALTER COLUMN order_id TYPE bigint USING order_id::bigint;
+ALTER TABLE orders ALTER COLUMN id TYPE bigint USING id::bigint;
+-- +goose StatementEnd
@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+-- ключи идемпотентности изменяющих запросов
+-- fingerprint - sha256 от метода, пути и тела запроса
+-- status_code NULL, пока первый запрос с ключом ещё выполняется
+-- locked_until - до этого времени ключ занят выполняющимся запросом, после - ключ без ответа
+-- может занять повторный запрос, например если первый прервался падением сервиса
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+    user_id int NOT NULL,
+    key text NOT NULL,
+    fingerprint text NOT NULL,
+    status_code int,
+    content_type text NOT NULL DEFAULT '',
+    body bytea,
+    locked_until timestamp,
+    created_at timestamp NOT NULL,
+    expires_at timestamp NOT NULL,
+    CONSTRAINT idempotency_keys_pkey PRIMARY KEY (user_id, key)
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE idempotency_keys;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+-- STUCK - заказ, по которому система начислений так и не дала окончательного статуса
+INSERT INTO status_values_kinds (id, name) VALUES (5, 'STUCK') ON CONFLICT DO NOTHING;
+-- polling_since - с какого времени заказ опрашивается, сбрасывается при возврате в очередь.
+-- Сравнивается с текущим временем сервиса, поэтому хранится с часовым поясом.
+-- failures - сколько раз система начислений не знала заказ или вернула неразборчивый ответ,
+-- по этому счётчику заказ переводится в STUCK. attempts по-прежнему задаёт паузу между опросами.
+-- stuck_reason - почему заказ переведён в STUCK
+ALTER TABLE current_statuses ADD COLUMN IF NOT EXISTS polling_since timestamptz NOT NULL DEFAULT now();
+ALTER TABLE current_statuses ADD COLUMN IF NOT EXISTS failures int NOT NULL DEFAULT 0;
+ALTER TABLE current_statuses ADD COLUMN IF NOT EXISTS stuck_reason text;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE current_statuses DROP COLUMN stuck_reason;
+ALTER TABLE current_statuses DROP COLUMN failures;
+ALTER TABLE current_statuses DROP COLUMN polling_since;
+DELETE FROM status_values_kinds WHERE id = 5;
+-- +goose StatementEnd